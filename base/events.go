@@ -0,0 +1,58 @@
+package base
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/kopeio/kope"
+)
+
+// RecordEvent posts a (Normal) event against our pod; outside kubernetes it is only logged
+func (m *KopeBaseManager) RecordEvent(reason string, messageFmt string, args ...interface{}) {
+	m.recordEvent(kope.EventTypeNormal, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// RecordWarning posts a Warning event against our pod; outside kubernetes it is only logged
+func (m *KopeBaseManager) RecordWarning(reason string, messageFmt string, args ...interface{}) {
+	m.recordEvent(kope.EventTypeWarning, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// recordError posts a Warning event for the error; chained errors are flattened onto one line
+func (m *KopeBaseManager) recordError(reason string, err error) {
+	m.recordEvent(kope.EventTypeWarning, reason, strings.Replace(err.Error(), "\n", ": ", -1))
+}
+
+func (m *KopeBaseManager) recordEvent(eventType string, reason string, message string) {
+	recorder := m.getEventRecorder()
+	if recorder == nil {
+		glog.V(2).Infof("Not posting event (not running on kubernetes) %s %s: %s", eventType, reason, message)
+		return
+	}
+	recorder.Event(eventType, reason, message)
+}
+
+// getEventRecorder returns the recorder for our pod, or nil if we can't post events (e.g. outside kubernetes)
+func (m *KopeBaseManager) getEventRecorder() *kope.EventRecorder {
+	m.mutex.Lock()
+	recorder := m.eventRecorder
+	m.mutex.Unlock()
+	if recorder != nil {
+		return recorder
+	}
+
+	if m.KubernetesClient == nil {
+		return nil
+	}
+	selfPod, err := m.GetSelfPod()
+	if err != nil || selfPod.Pod == nil {
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.eventRecorder == nil {
+		m.eventRecorder = kope.NewEventRecorder(m.KubernetesClient, selfPod.Pod)
+	}
+	return m.eventRecorder
+}
@@ -0,0 +1,117 @@
+package base
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kopeio/kope"
+)
+
+// DefaultHealthPort is the port on which we serve /healthz, /readyz and /metrics; it can be overridden with HEALTH_PORT
+const DefaultHealthPort = 8901
+
+// HealthChecker is implemented by services that can report whether they are ready to serve
+type HealthChecker interface {
+	// HealthCheck returns nil if the service is healthy, or an error describing the problem
+	HealthCheck() error
+}
+
+type healthServer struct {
+	manager *KopeBaseManager
+
+	mutex   sync.Mutex
+	started bool
+	// ready is the result of the last readiness check
+	ready bool
+}
+
+func (m *KopeBaseManager) startHealthServer() error {
+	m.health.mutex.Lock()
+	defer m.health.mutex.Unlock()
+
+	if m.health.started {
+		return nil
+	}
+	m.health.manager = m
+
+	port := DefaultHealthPort
+	portString := os.Getenv("HEALTH_PORT")
+	if portString != "" {
+		var err error
+		port, err = strconv.Atoi(portString)
+		if err != nil {
+			return fmt.Errorf("error parsing HEALTH_PORT: %v", portString)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", m.health.serveHealthz)
+	mux.HandleFunc("/readyz", m.health.serveReadyz)
+	mux.Handle("/metrics", m.metricsHandler())
+
+	endpoint := ":" + strconv.Itoa(port)
+	go func() {
+		glog.Info("Health server listening on: ", endpoint)
+		err := http.ListenAndServe(endpoint, mux)
+		if err != nil {
+			glog.Warning("health server exited with error: ", err)
+		}
+	}()
+
+	m.health.started = true
+	return nil
+}
+
+// serveHealthz is the liveness check: we are alive as long as the manager is running
+// (if the process is crash-looping, the manager will exit)
+func (h *healthServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// serveReadyz is the readiness check: the process must be running and pass its health check
+func (h *healthServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	err := h.manager.checkReady()
+	h.setReady(err == nil)
+	if err != nil {
+		glog.V(2).Info("readiness check failed: ", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// setReady records the result of a readiness check, posting an event when we become ready
+func (h *healthServer) setReady(ready bool) {
+	h.mutex.Lock()
+	becameReady := ready && !h.ready
+	h.ready = ready
+	h.mutex.Unlock()
+
+	if becameReady {
+		h.manager.RecordEvent(kope.EventReasonHealthy, "Passed readiness check")
+	}
+}
+
+func (m *KopeBaseManager) checkReady() error {
+	supervisor := m.getSupervisor()
+	if supervisor == nil {
+		return fmt.Errorf("process not yet started")
+	}
+	if supervisor.Process() == nil {
+		return fmt.Errorf("process not running")
+	}
+	if pending := m.getPendingLeaderTasks(); len(pending) != 0 {
+		return fmt.Errorf("waiting for leader task %q", pending[0])
+	}
+	if healthChecker := m.getHealthChecker(); healthChecker != nil {
+		err := m.timedHealthCheck(healthChecker)
+		if err != nil {
+			return fmt.Errorf("health check failed: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kopeio/kope"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+// How long we wait before retrying a leader task that failed
+const leaderTaskRetryInterval = 10 * time.Second
+
+// How often a member that is not the leader checks whether it has become leader, or the leader has completed a task
+const leaderTaskPollInterval = 5 * time.Second
+
+// IsLeader returns true if this member is the leader of the cluster.
+// Outside kubernetes, or if we are not part of a cluster, there is no one to coordinate with, so we are always the leader.
+func (m *KopeBaseManager) IsLeader() (bool, error) {
+	elector, err := m.getLeaderElector()
+	if err != nil {
+		return false, err
+	}
+	if elector == nil {
+		return true, nil
+	}
+	return elector.IsLeader(), nil
+}
+
+// RunAsLeader runs a "once per cluster" task in the background, once this member is the leader of the cluster.
+// If the task fails it is retried (while we are still leader).  If we lose the leadership part-way through,
+// the task's context is cancelled and another member takes over, so tasks should be idempotent.
+// We don't report ready (see checkReady) until the task has completed, here or on the leader.
+func (m *KopeBaseManager) RunAsLeader(name string, task func(ctx context.Context) error) error {
+	elector, err := m.getLeaderElector()
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	m.pendingLeaderTasks = append(m.pendingLeaderTasks, name)
+	m.mutex.Unlock()
+
+	go func() {
+		m.waitForLeaderTask(elector, name, task, true)
+		m.leaderTaskCompleted(name)
+	}()
+	return nil
+}
+
+// runWhenLeader runs a task in the background, once this member is the leader of the cluster (retrying until it succeeds).
+// Unlike RunAsLeader, the task is not shared with the other members: we don't wait for it, and it runs again on a new leader.
+func (m *KopeBaseManager) runWhenLeader(name string, task func(ctx context.Context) error) error {
+	elector, err := m.getLeaderElector()
+	if err != nil {
+		return err
+	}
+
+	go m.waitForLeaderTask(elector, name, task, false)
+	return nil
+}
+
+// waitForLeaderTask runs the task once we are the leader, retrying until it succeeds.
+// If shared, the completion is recorded on the lock object, and we also return once the leader has completed it.
+func (m *KopeBaseManager) waitForLeaderTask(elector *kope.LeaderElector, name string, task func(ctx context.Context) error, shared bool) {
+	for {
+		if elector != nil && !elector.IsLeader() {
+			if shared {
+				completed, err := elector.IsTaskCompleted(name)
+				if err != nil {
+					glog.Warningf("error checking leader task %q: %v", name, err)
+				} else if completed {
+					glog.Infof("Leader task %q was completed by the leader", name)
+					return
+				}
+			}
+			time.Sleep(leaderTaskPollInterval)
+			continue
+		}
+
+		glog.Infof("Running leader task %q", name)
+		err := m.runLeaderTask(elector, task)
+		if err == nil && shared && elector != nil {
+			err = elector.RecordTaskCompleted(name)
+		}
+		if err == nil {
+			glog.Infof("Completed leader task %q", name)
+			return
+		}
+		glog.Warningf("error running leader task %q (will retry): %v", name, err)
+		time.Sleep(leaderTaskRetryInterval)
+	}
+}
+
+// runLeaderTask runs the task, cancelling its context if we lose the leadership
+func (m *KopeBaseManager) runLeaderTask(elector *kope.LeaderElector, task func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if elector != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			if elector.WaitForLeadershipLoss(done) {
+				cancel()
+			}
+		}()
+	}
+
+	err := task(ctx)
+	if ctx.Err() != nil {
+		return fmt.Errorf("lost leadership while running task")
+	}
+	return err
+}
+
+// leaderTaskCompleted removes the task from pendingLeaderTasks
+func (m *KopeBaseManager) leaderTaskCompleted(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var pending []string
+	for _, t := range m.pendingLeaderTasks {
+		if t != name {
+			pending = append(pending, t)
+		}
+	}
+	m.pendingLeaderTasks = pending
+}
+
+// getPendingLeaderTasks returns the names of the leader tasks that have not yet completed
+func (m *KopeBaseManager) getPendingLeaderTasks() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.pendingLeaderTasks
+}
+
+// getLeaderElector returns the elector for our cluster, starting it on first use.
+// The lock is an Endpoints object named <clusterid>-leader; nil is returned if there is no cluster.
+func (m *KopeBaseManager) getLeaderElector() (*kope.LeaderElector, error) {
+	if m.ClusterID == "" || m.KubernetesClient == nil {
+		return nil, nil
+	}
+
+	selfPod, err := m.GetSelfPod()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.leaderElector == nil {
+		config := &kope.LeaderElectionConfig{}
+		config.Namespace = selfPod.Pod.Namespace
+		config.Name = m.ClusterID + "-leader"
+		config.Identity = selfPod.Pod.Name
+
+		m.leaderElector = kope.NewLeaderElector(m.KubernetesClient, config)
+		go m.leaderElector.Run(util.NeverStop)
+	}
+	return m.leaderElector, nil
+}
@@ -1,24 +1,75 @@
 package base
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/kopeio/kope"
+	"github.com/kopeio/kope/cgroup"
 	"github.com/kopeio/kope/chained"
+	"github.com/kopeio/kope/process"
 )
 
+// DefaultShutdownGracePeriod is how long we wait for the process to stop cleanly before killing it.
+// It is a little less than the kubernetes default (30 seconds), so that we get to kill it ourselves.
+const DefaultShutdownGracePeriod = 25 * time.Second
+
+// How many lines of the output of a crashed process we include in the event
+const crashReportLines = 5
+
+// StopStrategy asks the managed process to shut down, after the manager received the signal sig.
+// The context is cancelled when the shutdown grace period expires.
+type StopStrategy func(ctx context.Context, p *process.Process, sig os.Signal) error
+
 type KopeBaseManager struct {
-	MemoryMB  int
+	MemoryMB int
+	// CPUs is the CPU limit, in cores (possibly fractional); 0 if there is no limit
+	CPUs      float64
 	ClusterID string
 
-	NodeID           *string
-	KubernetesClient *kope.Kubernetes
+	// StopStrategy is used to stop the process on SIGTERM / SIGINT; by default we forward the signal
+	StopStrategy StopStrategy
+	// ShutdownGracePeriod can also be set with SHUTDOWN_GRACE_PERIOD (in seconds)
+	ShutdownGracePeriod time.Duration
+
+	// HealthChecker is used for the readiness check (/readyz)
+	HealthChecker HealthChecker
+
+	NodeID *string
+	// KubernetesClient is created by Init when running on kubernetes, unless it has already been set (e.g. to a fake)
+	KubernetesClient kope.Client
+
+	// Cached self-pod (access through GetSelfPod, which holds selfPodMutex)
+	selfPodMutex sync.Mutex
+	selfPod      *kope.KopePod
+
+	health healthServer
 
-	// Cached self-pod (access through GetSelfPod)
-	selfPod *kope.KopePod
+	mutex      sync.Mutex
+	supervisor *process.Supervisor
+	// shutdownSignal is the SIGTERM / SIGINT we received, if any
+	shutdownSignal os.Signal
+	// clusterFingerprint summarizes the cluster map we last returned from GetClusterMap (or seeded in watchCluster)
+	clusterFingerprint     string
+	haveClusterFingerprint bool
+	// leaderElector is started on first use (see RunAsLeader)
+	leaderElector *kope.LeaderElector
+	// pendingLeaderTasks are the RunAsLeader tasks that have not yet completed; we are not ready until they have
+	pendingLeaderTasks []string
+	// eventRecorder is created on first use (see RecordEvent)
+	eventRecorder *kope.EventRecorder
+	// statefulSet is our identity if we are running in a StatefulSet (found by Configure)
+	statefulSet *kope.StatefulSetIdentity
 }
 
 func (m *KopeBaseManager) Configure() error {
@@ -27,13 +78,27 @@ func (m *KopeBaseManager) Configure() error {
 		return err
 	}
 
+	// Outside kubernetes (or if the pod has no limits), we fall back to the cgroup limits
+	cgroupLimits, err := cgroup.ReadLimits()
+	if err != nil {
+		glog.Warning("unable to read cgroup limits: ", err)
+		cgroupLimits = &cgroup.Limits{}
+	}
+
+	// Configure may be called again on reconfiguration, so we recompute from scratch
+	m.MemoryMB = 0
 	memory := os.Getenv("MEMORY_LIMIT")
 	if memory == "" {
 		memoryLimitBytes, found := selfPod.MemoryLimit()
-		if found &&  memoryLimitBytes > 0 {
+		if found && memoryLimitBytes > 0 {
 			memoryLimitMB := int(memoryLimitBytes / (1024 * 1024))
 			glog.Info("Found container memory limit: ", memoryLimitMB)
 
+			m.MemoryMB = memoryLimitMB
+		} else if cgroupLimits.MemoryBytes > 0 {
+			memoryLimitMB := int(cgroupLimits.MemoryBytes / (1024 * 1024))
+			glog.Info("Found cgroup memory limit: ", memoryLimitMB)
+
 			m.MemoryMB = memoryLimitMB
 		}
 	} else {
@@ -44,97 +109,114 @@ func (m *KopeBaseManager) Configure() error {
 		m.MemoryMB = memoryMB
 	}
 
+	m.CPUs = 0
+	cpuLimit, found := selfPod.CPULimit()
+	if found {
+		glog.Info("Found container CPU limit: ", cpuLimit)
+		m.CPUs = cpuLimit
+	} else if cgroupLimits.CPUs > 0 {
+		glog.Info("Found cgroup CPU limit: ", cgroupLimits.CPUs)
+		m.CPUs = cgroupLimits.CPUs
+	}
+
 	clusterID, _ := selfPod.Label("clusterid")
 	if clusterID != "" {
 		glog.Info("Found clusterid: ", clusterID)
 		m.ClusterID = clusterID
 	}
+
+	// In a StatefulSet, our identity and peers come from the ordinal names, so the volumes need not be labelled
+	statefulSet, err := kope.FindStatefulSetIdentity(selfPod.Pod)
+	if err != nil {
+		return chained.Error(err, "error checking for StatefulSet identity")
+	}
+	m.statefulSet = statefulSet
+	if statefulSet != nil {
+		glog.Info("Found StatefulSet identity: ", statefulSet)
+		if m.ClusterID == "" {
+			m.ClusterID = statefulSet.SetName
+		}
+	}
 	return nil
 }
 
-func (m *KopeBaseManager) GetClusterMap() (map[string]*kope.KopePod, error) {
-	if m.ClusterID == "" {
-		return nil, nil
+// CPUCount is the number of CPUs we should size thread pools etc for: the CPU limit rounded up,
+// or the number of CPUs on the machine if there is no limit
+func (m *KopeBaseManager) CPUCount() int {
+	if m.CPUs > 0 {
+		return int(math.Ceil(m.CPUs))
 	}
+	return runtime.NumCPU()
+}
 
-	selfPod, err := m.GetSelfPod()
-	if err != nil {
+// GetClusterMap returns the members of our cluster; it returns nil if we are not part of a cluster
+// (a nil ClusterMap behaves as an empty one).  In a StatefulSet the members are found from the headless service,
+// otherwise they are found from the labelled PVCs.
+func (m *KopeBaseManager) GetClusterMap() (*kope.ClusterMap, error) {
+	clusterMap, err := m.LookupClusterMap()
+	if err != nil || clusterMap == nil {
 		return nil, err
 	}
 
-	clusterID := m.ClusterID
-
-	clusterMap, err := selfPod.GetClusterMap(clusterID)
-	if err != nil {
-		return nil, err
-	}
+	m.mutex.Lock()
+	m.clusterFingerprint = clusterMap.Fingerprint()
+	m.haveClusterFingerprint = true
+	m.mutex.Unlock()
 
 	glog.Info("Cluster-map:")
-	for k, v := range clusterMap {
+	for _, member := range clusterMap.All() {
 		name := ""
-		if v != nil {
-			name = v.Pod.Name
+		if member.Pod != nil {
+			name = member.Pod.Pod.Name
 		}
-		glog.Info("\t", k, "\t", name)
+		self := ""
+		if member.NodeID == clusterMap.SelfNodeID {
+			self = "(self)"
+		}
+		glog.Info("\t", member.NodeID, "\t", name, "\t", member.IP(), "\t", self)
 	}
 
 	return clusterMap, nil
 }
 
+// LookupClusterMap returns the current members of our cluster (as GetClusterMap does), without recording them
+// as the membership we were configured with, so it does not affect the cluster change notifications.
+func (m *KopeBaseManager) LookupClusterMap() (*kope.ClusterMap, error) {
+	if m.statefulSet != nil {
+		return m.statefulSet.GetClusterMap(m.KubernetesClient)
+	}
+
+	if m.ClusterID == "" {
+		return nil, nil
+	}
+
+	selfPod, err := m.GetSelfPod()
+	if err != nil {
+		return nil, err
+	}
+
+	return selfPod.GetClusterMap(m.ClusterID)
+}
+
+// GetNodeId returns our nodeid (from our StatefulSet ordinal, or see KopePod.GetNodeID), or "" if we don't have one.
+// The nodeid can also be set explicitly, with NodeID.
 func (m *KopeBaseManager) GetNodeId() (string, error) {
 	nodeID := ""
 	if m.NodeID != nil {
 		nodeID = *m.NodeID
 	}
+	if nodeID == "" && m.statefulSet != nil {
+		nodeID = m.statefulSet.NodeID()
+	}
 	if nodeID == "" {
 		selfPod, err := m.GetSelfPod()
 		if err != nil {
 			return "", err
 		}
 
-		labels := selfPod.Pod.Labels
-		nodeID, _ := labels["kope.io/clusterid"]
-
-		if nodeID == "" {
-			volumes, err := selfPod.GetVolumes()
-			if err != nil {
-				return "", err
-			}
-
-			if nodeID == "" {
-				for _, volume := range volumes {
-					pvc, err := volume.GetPersistentVolumeClaim()
-					if err != nil {
-						return "", err
-					}
-					if pvc == nil {
-						continue
-					}
-					labels := pvc.Labels
-					nodeID = labels["kope.io/clusterid"]
-					if nodeID != "" {
-						break
-					}
-				}
-			}
-
-			if nodeID == "" {
-				for _, volume := range volumes {
-					pv, err := volume.GetPersistentVolume()
-					if err != nil {
-						return "", err
-					}
-					if pv == nil {
-						continue
-					}
-					labels := pv.Labels
-					nodeID = labels["kope.io/clusterid"]
-					if nodeID != "" {
-						break
-					}
-				}
-			}
-
+		nodeID, err = selfPod.GetNodeID()
+		if err != nil {
+			return "", err
 		}
 	}
 
@@ -149,6 +231,10 @@ func (m *KopeBaseManager) GetNodeId() (string, error) {
 
 // Gets the pod that we are running in.  Returns an error if it cannot be found.
 func (m *KopeBaseManager) GetSelfPod() (*kope.KopePod, error) {
+	// A separate lock from m.mutex, so that we do not hold m.mutex while the first call queries kubernetes
+	m.selfPodMutex.Lock()
+	defer m.selfPodMutex.Unlock()
+
 	selfPod := m.selfPod
 	if selfPod != nil {
 		return selfPod, nil
@@ -187,7 +273,17 @@ func (m *KopeBaseManager) GetLabels() (map[string]string, error) {
 }
 
 func (m *KopeBaseManager) Init() error {
-	if kope.IsKubernetes() {
+	if os.Getpid() == 1 {
+		glog.Info("Running as PID 1; will reap orphaned processes")
+		process.StartReaper()
+	}
+
+	err := m.startHealthServer()
+	if err != nil {
+		return err
+	}
+
+	if m.KubernetesClient == nil && kope.IsKubernetes() {
 		glog.Infof("Detected kubernetes")
 		client, err := kope.NewKubernetesClient()
 		if err != nil {
@@ -197,3 +293,154 @@ func (m *KopeBaseManager) Init() error {
 	}
 	return nil
 }
+
+// handleShutdownSignals listens for SIGTERM / SIGINT; it must be called before anything is started,
+// because as PID 1 a signal we don't handle is ignored.  On a signal, cancel is called (to abort any startup),
+// and the process is stopped using the StopStrategy (now, or as soon as it is supervised).
+func (m *KopeBaseManager) handleShutdownSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-signals
+		glog.Infof("Received signal %v; shutting down", sig)
+
+		m.mutex.Lock()
+		m.shutdownSignal = sig
+		supervisor := m.supervisor
+		m.mutex.Unlock()
+
+		cancel()
+		if supervisor != nil {
+			m.stopSupervisor(supervisor, sig)
+		}
+	}()
+}
+
+// Supervise keeps the managed process (which has already been started) running in the background,
+// restarting it (with backoff) whenever it exits.  The result is sent on the returned channel:
+// an error if the process is crash-looping (the manager should then exit so the pod is restarted),
+// or nil once the process has been stopped after a SIGTERM or SIGINT (see handleShutdownSignals).
+func (m *KopeBaseManager) Supervise(p *process.Process, start func() (*process.Process, error)) <-chan error {
+	supervisor := process.NewSupervisor(start)
+	supervisor.OnRestart = func(exit *process.ExitStatus, requested bool) {
+		if requested {
+			m.RecordEvent(kope.EventReasonRestarted, "Restarted process (%s)", exit)
+		} else {
+			tail := exit.Tail(crashReportLines)
+			if len(tail) != 0 {
+				m.RecordWarning(kope.EventReasonRestarted, "Process exited unexpectedly (%s); restarting.  Last output: %s", exit, strings.Join(tail, " | "))
+			} else {
+				m.RecordWarning(kope.EventReasonRestarted, "Process exited unexpectedly (%s); restarting", exit)
+			}
+		}
+	}
+	result := supervisor.Go(p)
+
+	m.mutex.Lock()
+	m.supervisor = supervisor
+	sig := m.shutdownSignal
+	m.mutex.Unlock()
+
+	// The signal arrived before we were supervising the process
+	if sig != nil {
+		go m.stopSupervisor(supervisor, sig)
+	}
+
+	return result
+}
+
+// stopAfterError kills the process (which we are supervising) because startup failed
+func (m *KopeBaseManager) stopAfterError() {
+	m.mutex.Lock()
+	supervisor := m.supervisor
+	m.mutex.Unlock()
+
+	kill := func(ctx context.Context, p *process.Process) error {
+		return p.Kill()
+	}
+	err := supervisor.Stop(kill, 0)
+	if err != nil {
+		glog.Warning("error stopping process: ", err)
+	}
+}
+
+// stopSupervisor stops the process (using the StopStrategy), waiting for the shutdown grace period before killing it
+func (m *KopeBaseManager) stopSupervisor(supervisor *process.Supervisor, sig os.Signal) {
+	gracePeriod, err := m.getShutdownGracePeriod()
+	if err != nil {
+		glog.Warningf("%v; using default of %v", err, DefaultShutdownGracePeriod)
+		gracePeriod = DefaultShutdownGracePeriod
+	}
+	err = supervisor.Stop(m.buildStopFunc(sig), gracePeriod)
+	if err != nil {
+		glog.Warning("error stopping process: ", err)
+	}
+}
+
+// RestartProcess stops the process (using the StopStrategy) and starts it again
+func (m *KopeBaseManager) RestartProcess() error {
+	supervisor := m.getSupervisor()
+	if supervisor == nil {
+		return fmt.Errorf("process is not being supervised")
+	}
+	gracePeriod, err := m.getShutdownGracePeriod()
+	if err != nil {
+		return err
+	}
+	return supervisor.Restart(m.buildStopFunc(syscall.SIGTERM), gracePeriod)
+}
+
+// SignalProcess sends a signal to the running process
+func (m *KopeBaseManager) SignalProcess(sig os.Signal) error {
+	supervisor := m.getSupervisor()
+	if supervisor == nil {
+		return fmt.Errorf("process is not being supervised")
+	}
+	p := supervisor.Process()
+	if p == nil {
+		return fmt.Errorf("process is not running")
+	}
+	return p.Signal(sig)
+}
+
+func (m *KopeBaseManager) buildStopFunc(sig os.Signal) process.StopFunc {
+	m.mutex.Lock()
+	stopStrategy := m.StopStrategy
+	m.mutex.Unlock()
+
+	return func(ctx context.Context, p *process.Process) error {
+		if stopStrategy != nil {
+			return stopStrategy(ctx, p, sig)
+		}
+		return p.Signal(sig)
+	}
+}
+
+func (m *KopeBaseManager) getHealthChecker() HealthChecker {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.HealthChecker
+}
+
+func (m *KopeBaseManager) getSupervisor() *process.Supervisor {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.supervisor
+}
+
+func (m *KopeBaseManager) getShutdownGracePeriod() (time.Duration, error) {
+	if m.ShutdownGracePeriod != 0 {
+		return m.ShutdownGracePeriod, nil
+	}
+
+	s := os.Getenv("SHUTDOWN_GRACE_PERIOD")
+	if s == "" {
+		return DefaultShutdownGracePeriod, nil
+	}
+	seconds, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing SHUTDOWN_GRACE_PERIOD: %v", s)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,67 @@
+package base
+
+import (
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// MemoryPolicy describes how a service sizes itself from the container memory limit
+type MemoryPolicy struct {
+	// DefaultMB is the memory we use when no memory limit is found (or the limit is too low)
+	DefaultMB int
+	// OverheadMB is reserved for everything we don't size explicitly (connections, thread stacks etc)
+	OverheadMB int
+	// HeapRatio is the fraction of the available memory used for the heap (or main cache)
+	HeapRatio float64
+}
+
+// MemorySizes is the result of applying a MemoryPolicy
+type MemorySizes struct {
+	// LimitMB is the memory limit we found, or 0 if there was none
+	LimitMB int
+	// AvailableMB is the memory the service may use: the limit less the overhead, or the default
+	AvailableMB int
+	// HeapMB is the size of the heap (or main cache)
+	HeapMB int
+}
+
+// Fraction returns the given fraction of the available memory, in MB
+func (s *MemorySizes) Fraction(ratio float64) int {
+	return int(float64(s.AvailableMB) * ratio)
+}
+
+// SizeMemory applies the policy to the memory limit found by Configure
+func (m *KopeBaseManager) SizeMemory(policy *MemoryPolicy) *MemorySizes {
+	sizes := &MemorySizes{}
+	sizes.LimitMB = m.MemoryMB
+
+	if m.MemoryMB == 0 {
+		glog.Info("No memory limit found; using default of ", policy.DefaultMB, "MB")
+		sizes.AvailableMB = policy.DefaultMB
+	} else {
+		sizes.AvailableMB = m.MemoryMB - policy.OverheadMB
+		if sizes.AvailableMB <= 0 {
+			glog.Warningf("Memory limit of %dMB was too low (overhead is %dMB); ignoring", m.MemoryMB, policy.OverheadMB)
+			sizes.AvailableMB = policy.DefaultMB
+		}
+	}
+
+	heapRatio := policy.HeapRatio
+	if heapRatio == 0 {
+		heapRatio = 1
+	}
+	sizes.HeapMB = sizes.Fraction(heapRatio)
+	if sizes.HeapMB < 1 {
+		sizes.HeapMB = 1
+	}
+
+	glog.Infof("Memory sizing: limit=%dMB available=%dMB heap=%dMB", sizes.LimitMB, sizes.AvailableMB, sizes.HeapMB)
+	return sizes
+}
+
+// JavaHeapArgs returns the JVM arguments to set the heap to the given size (in MB)
+func JavaHeapArgs(heapMB int) []string {
+	// We set Xms = Xmx so we don't pay for heap resizing, and so we fail early if the memory isn't there
+	return []string{"-Xms" + strconv.Itoa(heapMB) + "m", "-Xmx" + strconv.Itoa(heapMB) + "m"}
+}
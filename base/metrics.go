@@ -0,0 +1,86 @@
+package base
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var healthCheckLatency = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "kope",
+		Subsystem: "health",
+		Name:      "check_latency_seconds",
+		Help:      "Latency of the service health check.",
+	},
+	[]string{"result"},
+)
+
+var registerMetrics sync.Once
+
+// processCollector exposes the state of the supervised process
+type processCollector struct {
+	manager *KopeBaseManager
+
+	up       *prometheus.Desc
+	uptime   *prometheus.Desc
+	restarts *prometheus.Desc
+}
+
+var _ prometheus.Collector = &processCollector{}
+
+func newProcessCollector(m *KopeBaseManager) *processCollector {
+	c := &processCollector{manager: m}
+	c.up = prometheus.NewDesc("kope_process_up", "Whether the managed process is running.", nil, nil)
+	c.uptime = prometheus.NewDesc("kope_process_uptime_seconds", "How long the managed process has been running.", nil, nil)
+	c.restarts = prometheus.NewDesc("kope_process_restarts_total", "Number of times the managed process has been restarted.", nil, nil)
+	return c
+}
+
+func (c *processCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.uptime
+	ch <- c.restarts
+}
+
+func (c *processCollector) Collect(ch chan<- prometheus.Metric) {
+	up := 0.0
+	uptime := 0.0
+	restarts := 0.0
+
+	supervisor := c.manager.getSupervisor()
+	if supervisor != nil {
+		if supervisor.Process() != nil {
+			up = 1
+		}
+		uptime = supervisor.Uptime().Seconds()
+		restarts = float64(supervisor.Restarts())
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up)
+	ch <- prometheus.MustNewConstMetric(c.uptime, prometheus.GaugeValue, uptime)
+	ch <- prometheus.MustNewConstMetric(c.restarts, prometheus.CounterValue, restarts)
+}
+
+// metricsHandler registers the manager metrics, and returns the handler for /metrics.
+// Services can expose their own metrics by registering additional collectors with prometheus.
+func (m *KopeBaseManager) metricsHandler() http.Handler {
+	registerMetrics.Do(func() {
+		prometheus.MustRegister(healthCheckLatency)
+		prometheus.MustRegister(newProcessCollector(m))
+	})
+	return prometheus.Handler()
+}
+
+func (m *KopeBaseManager) timedHealthCheck(healthChecker HealthChecker) error {
+	start := time.Now()
+	err := healthChecker.HealthCheck()
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	healthCheckLatency.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	return err
+}
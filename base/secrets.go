@@ -0,0 +1,121 @@
+package base
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kopeio/kope"
+	"github.com/kopeio/kope/chained"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+// SecretRotateFunc generates new credentials and writes them to the secret (removing kope.RotateAnnotation, e.g. with kope.ClearRotation).
+// It only runs on the leader, and the context is cancelled if we lose the leadership.
+type SecretRotateFunc func(ctx context.Context, secret *api.Secret) error
+
+// SecretChangedFunc puts the credentials in the secret into service, if they are not already.
+// It runs on every member, whenever the secret is added or updated.  It runs on its own goroutine (not the watch's),
+// so it may take a while; if the secret changes again meanwhile, it is then called once with the latest version.
+type SecretChangedFunc func(secret *api.Secret) error
+
+// WatchSecretRotation watches the named secret in our namespace.  When the secret is annotated with kope.RotateAnnotation,
+// the leader calls rotate to write new credentials to the secret; every member calls changed whenever the secret changes,
+// so that it picks up the new credentials (even if it never saw the annotation).
+func (m *KopeBaseManager) WatchSecretRotation(secretName string, rotate SecretRotateFunc, changed SecretChangedFunc) error {
+	if m.KubernetesClient == nil {
+		return nil
+	}
+
+	selfPod, err := m.GetSelfPod()
+	if err != nil {
+		return err
+	}
+	namespace := selfPod.Pod.Namespace
+
+	var mutex sync.Mutex
+	// rotating is set while a rotation is waiting for (or running on) the leader
+	rotating := false
+	// latest is the newest version of the secret that changed has not yet been called with
+	var latest *api.Secret
+	pending := make(chan struct{}, 1)
+
+	go func() {
+		for range pending {
+			mutex.Lock()
+			secret := latest
+			latest = nil
+			mutex.Unlock()
+			if secret == nil {
+				continue
+			}
+
+			err := changed(secret)
+			if err != nil {
+				glog.Warningf("error applying credentials from secret %s/%s: %v", secret.Namespace, secret.Name, err)
+				m.recordError(kope.EventReasonReconfigureFailed, chained.Error(err, "error applying credentials from secret ", secret.Name))
+			}
+		}
+	}()
+
+	rotateTask := func(ctx context.Context) error {
+		// The rotation may already have been done by a previous leader
+		secret, err := m.KubernetesClient.FindSecret(namespace, secretName)
+		if err != nil {
+			return chained.Error(err, "error reading secret")
+		}
+		if secret != nil && kope.NeedsRotation(secret) {
+			glog.Infof("Rotating credentials in secret %s/%s", namespace, secretName)
+			err = rotate(ctx, secret)
+			if err != nil {
+				return err
+			}
+			glog.Infof("Rotated credentials in secret %s/%s", namespace, secretName)
+		}
+
+		mutex.Lock()
+		rotating = false
+		mutex.Unlock()
+		return nil
+	}
+
+	onChange := func(o interface{}) {
+		secret := o.(*api.Secret)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		latest = secret
+		select {
+		case pending <- struct{}{}:
+		default:
+			// The goroutine has yet to pick up an earlier change; it will see this version instead
+		}
+
+		if !kope.NeedsRotation(secret) || rotating {
+			return
+		}
+		rotating = true
+		err := m.runWhenLeader("rotate secret "+secretName, rotateTask)
+		if err != nil {
+			glog.Warningf("error starting rotation of secret %s/%s: %v", secret.Namespace, secret.Name, err)
+			rotating = false
+		}
+	}
+
+	handler := &kope.WatchHandler{}
+	handler.OnAdd = onChange
+	handler.OnUpdate = func(oldObj, newObj interface{}) {
+		onChange(newObj)
+	}
+
+	options := &kope.WatchOptions{}
+	options.Namespaces = []string{namespace}
+	options.FieldSelector = fields.OneTermEqualSelector("metadata.name", secretName)
+	options.StopCh = util.NeverStop
+
+	m.KubernetesClient.WatchResource(kope.SecretsResource, handler, options)
+	return nil
+}
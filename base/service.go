@@ -0,0 +1,250 @@
+package base
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kopeio/kope"
+	"github.com/kopeio/kope/chained"
+	"github.com/kopeio/kope/process"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+// In a StatefulSet we can't watch the cluster membership, so we poll it this often
+const clusterPollInterval = 30 * time.Second
+
+// Service is implemented by each of the services we manage.
+// KopeBaseManager provides defaults for everything except Start,
+// so a new service typically embeds KopeBaseManager and implements Configure and Start.
+type Service interface {
+	// Configure computes the configuration (it should call KopeBaseManager.Configure)
+	Configure() error
+	// Prepare does any setup needed before the process is first started (e.g. initializing the data directory)
+	// The context is cancelled if we are asked to shut down.
+	Prepare(ctx context.Context) error
+	// Start starts the process; it is also called to restart the process.
+	// Start should return errors rather than exiting (e.g. with glog.Fatal), so that the failure is posted as an event.
+	Start() (*process.Process, error)
+	// HealthCheck returns nil if the service is ready to serve
+	HealthCheck() error
+	// Stop asks the process to shut down, after the manager received the signal sig
+	// The context is cancelled when the shutdown grace period expires.
+	Stop(ctx context.Context, p *process.Process, sig os.Signal) error
+	// Reconfigure is called when the configuration may have changed (e.g. on SIGHUP)
+	Reconfigure() error
+}
+
+// PostStarter can be implemented by a Service that needs to do work once the process is first started
+// The context is cancelled if we are asked to shut down.
+type PostStarter interface {
+	PostStart(ctx context.Context) error
+}
+
+// ClusterChangeHandler should be implemented by a Service that renders the cluster members into its configuration,
+// so that it can pick up membership changes (typically by restarting).  Other services are not notified.
+type ClusterChangeHandler interface {
+	ClusterChanged(clusterMap *kope.ClusterMap) error
+}
+
+// Run drives the service through its lifecycle: Init, Configure, Prepare, Start, PostStart,
+// and then supervises the process until it is stopped (or is crash-looping).
+// The main transitions are posted as events against our pod.
+func (m *KopeBaseManager) Run(service Service) error {
+	err := m.run(service)
+	if err != nil {
+		m.recordError(kope.EventReasonFailed, err)
+	}
+	return err
+}
+
+func (m *KopeBaseManager) run(service Service) error {
+	// We handle signals from the start, so that a shutdown during startup is not ignored
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.handleShutdownSignals(cancel)
+
+	err := m.Init()
+	if err != nil {
+		return chained.Error(err, "error initializing")
+	}
+
+	err = service.Configure()
+	if err != nil {
+		return chained.Error(err, "error configuring")
+	}
+
+	err = service.Prepare(ctx)
+	if ctx.Err() != nil {
+		glog.Info("Shut down during prepare")
+		return nil
+	}
+	if err != nil {
+		return chained.Error(err, "error preparing")
+	}
+	m.RecordEvent(kope.EventReasonInitialized, "Configured and initialized")
+
+	p, err := service.Start()
+	if err != nil {
+		return chained.Error(err, "error starting")
+	}
+	m.RecordEvent(kope.EventReasonStarted, "Started process (pid %d)", p.Pid())
+
+	// The health server (and the signal handler) are already running, so we must hold the lock
+	m.mutex.Lock()
+	m.HealthChecker = service
+	m.StopStrategy = service.Stop
+	m.mutex.Unlock()
+
+	// From here on, a shutdown signal stops the process through the supervisor
+	result := m.Supervise(p, service.Start)
+
+	postStarter, ok := service.(PostStarter)
+	if ok {
+		err = postStarter.PostStart(ctx)
+		if ctx.Err() != nil {
+			glog.Info("Shut down during post-start")
+			return <-result
+		}
+		if err != nil {
+			m.stopAfterError()
+			<-result
+			return chained.Error(err, "error running post-start")
+		}
+	}
+
+	err = m.watchCluster(service)
+	if err != nil {
+		m.stopAfterError()
+		<-result
+		return chained.Error(err, "error watching cluster")
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			glog.Info("Received SIGHUP; reconfiguring")
+			err := service.Reconfigure()
+			if err != nil {
+				glog.Warning("error reconfiguring: ", err)
+				m.recordError(kope.EventReasonReconfigureFailed, err)
+				continue
+			}
+			m.RecordEvent(kope.EventReasonReconfigured, "Reconfigured after SIGHUP")
+		}
+	}()
+
+	return <-result
+}
+
+// watchCluster notifies the service (if it is a ClusterChangeHandler) when the cluster membership is different
+// from that it was configured with
+func (m *KopeBaseManager) watchCluster(service Service) error {
+	handler, ok := service.(ClusterChangeHandler)
+	if !ok {
+		return nil
+	}
+
+	// If the service didn't call GetClusterMap, we compare against the membership now
+	m.mutex.Lock()
+	haveFingerprint := m.haveClusterFingerprint
+	m.mutex.Unlock()
+	if !haveFingerprint {
+		clusterMap, err := m.LookupClusterMap()
+		if err != nil {
+			return chained.Error(err, "error building cluster map")
+		}
+		m.mutex.Lock()
+		m.clusterFingerprint = clusterMap.Fingerprint()
+		m.haveClusterFingerprint = true
+		m.mutex.Unlock()
+	}
+
+	if m.statefulSet != nil {
+		go m.pollCluster(handler)
+		return nil
+	}
+
+	if m.ClusterID == "" || m.KubernetesClient == nil {
+		return nil
+	}
+
+	selfPod, err := m.GetSelfPod()
+	if err != nil {
+		return err
+	}
+
+	kope.WatchCluster(m.KubernetesClient, selfPod.Pod, m.ClusterID, func(clusterMap *kope.ClusterMap) {
+		m.clusterChanged(handler, clusterMap)
+	}, util.NeverStop)
+
+	return nil
+}
+
+// pollCluster periodically rebuilds the cluster map; we use this for a StatefulSet,
+// where the members come from the DNS (which we can't watch).  Like ClusterWatch, we only notify when the map changes.
+func (m *KopeBaseManager) pollCluster(handler ClusterChangeHandler) {
+	m.mutex.Lock()
+	last := m.clusterFingerprint
+	m.mutex.Unlock()
+
+	for {
+		time.Sleep(clusterPollInterval)
+
+		clusterMap, err := m.LookupClusterMap()
+		if err != nil {
+			glog.Warning("error building cluster map: ", err)
+			continue
+		}
+		fingerprint := clusterMap.Fingerprint()
+		if fingerprint == last {
+			continue
+		}
+		last = fingerprint
+		m.clusterChanged(handler, clusterMap)
+	}
+}
+
+// clusterChanged notifies the service if the cluster map is different from that it was configured with
+func (m *KopeBaseManager) clusterChanged(handler ClusterChangeHandler, clusterMap *kope.ClusterMap) {
+	fingerprint := clusterMap.Fingerprint()
+	m.mutex.Lock()
+	configured := m.clusterFingerprint
+	m.mutex.Unlock()
+	if fingerprint == configured {
+		return
+	}
+
+	glog.Infof("Cluster membership changed; reconfiguring")
+	err := handler.ClusterChanged(clusterMap)
+	if err != nil {
+		glog.Warning("error reconfiguring after cluster change: ", err)
+		m.recordError(kope.EventReasonReconfigureFailed, err)
+		return
+	}
+	m.RecordEvent(kope.EventReasonReconfigured, "Reconfigured after cluster membership change")
+}
+
+// Prepare is the default implementation of Service::Prepare; there is nothing to prepare
+func (m *KopeBaseManager) Prepare(ctx context.Context) error {
+	return nil
+}
+
+// HealthCheck is the default implementation of Service::HealthCheck; we only require the process to be running
+func (m *KopeBaseManager) HealthCheck() error {
+	return nil
+}
+
+// Stop is the default implementation of Service::Stop; we forward the signal to the process
+func (m *KopeBaseManager) Stop(ctx context.Context, p *process.Process, sig os.Signal) error {
+	return p.Signal(sig)
+}
+
+// Reconfigure is the default implementation of Service::Reconfigure; there is nothing to reconfigure
+func (m *KopeBaseManager) Reconfigure() error {
+	return nil
+}
@@ -1,26 +1,42 @@
 package cassandra
 
 import (
-	"github.com/golang/glog"
+	"embed"
+	"fmt"
 	"github.com/kopeio/kope"
 	"github.com/kopeio/kope/base"
 	"github.com/kopeio/kope/chained"
 	"github.com/kopeio/kope/process"
 	"os"
-	"time"
+	"strconv"
+	"strings"
 )
 
-const DefaultMemory = 256
+//go:embed templates/*.template
+var templates embed.FS
+
+var _ = kope.RegisterTemplates(templates)
+
+// Cassandra uses off-heap memory and the page cache, so we only give half the memory to the heap
+var memoryPolicy = &base.MemoryPolicy{DefaultMB: 256, OverheadMB: 64, HeapRatio: 0.5}
+
+// maxSeeds is the number of members we use as seeds; cassandra recommends a few per datacenter, not every node
+const maxSeeds = 3
 
 type Manager struct {
 	base.KopeBaseManager
-	process *process.Process
-	config  Config
+	memory *base.MemorySizes
+	config Config
 }
 
 type Config struct {
 	CommitLogDir string
 	DataDir      string
+
+	// ListenAddress is the address for the other nodes to talk to us on
+	ListenAddress string
+	// Seeds is the comma-separated list of the nodes that new nodes contact to join the ring
+	Seeds string
 }
 
 func (m *Manager) Configure() error {
@@ -32,48 +48,22 @@ func (m *Manager) Configure() error {
 	m.config.CommitLogDir = "/data/cassandra/logs"
 	m.config.DataDir = "/data/cassandra/data"
 
-	if m.MemoryMB == 0 {
-		m.MemoryMB = DefaultMemory
-	} else {
-		memoryLimitMB := m.MemoryMB
-
-		// We leave 32 MB for overhead (connections etc)
-		memoryLimitMB -= 32
-
-		if memoryLimitMB < 0 {
-			glog.Warning("Memory limit was too low; ignoring")
-			m.MemoryMB = DefaultMemory
-		} else {
-			glog.Info("Setting memory to ", memoryLimitMB)
-			m.MemoryMB = memoryLimitMB
-		}
-	}
+	m.memory = m.SizeMemory(memoryPolicy)
 
 	return nil
 }
 
 func (m *Manager) Manage() error {
-	err := m.Init()
-	if err != nil {
-		return chained.Error(err, "error initializing")
-	}
+	return m.Run(m)
+}
 
-	err = m.Configure()
+// Reconfigure recomputes the configuration, and restarts the process to pick it up
+func (m *Manager) Reconfigure() error {
+	err := m.Configure()
 	if err != nil {
 		return chained.Error(err, "error configuring")
 	}
-
-	process, err := m.Start()
-	if err != nil {
-		return chained.Error(err, "error starting")
-	}
-	m.process = process
-
-	for {
-		time.Sleep(5 * time.Second)
-	}
-
-	return nil
+	return m.RestartProcess()
 }
 
 func (m *Manager) Start() (*process.Process, error) {
@@ -89,9 +79,23 @@ func (m *Manager) Start() (*process.Process, error) {
 		return nil, err
 	}
 
-	if len(clusterMap) != 0 {
-		glog.Info("Detected cluster configuration")
-		glog.Fatalf("Cluster not yet implemented")
+	m.config.ListenAddress = "localhost"
+	m.config.Seeds = "127.0.0.1"
+	if clusterMap.Len() > 1 {
+		podIP, err := kope.FindSelfPodIP()
+		if err != nil {
+			return nil, err
+		}
+		if podIP == nil {
+			return nil, fmt.Errorf("cannot determine pod ip")
+		}
+		m.config.ListenAddress = podIP.String()
+
+		seeds := findSeeds(clusterMap)
+		if len(seeds) == 0 {
+			return nil, fmt.Errorf("no cluster members have an address yet")
+		}
+		m.config.Seeds = strings.Join(seeds, ",")
 	}
 
 	err = kope.WriteTemplate("/data/conf/cassandra.yaml", &m.config)
@@ -99,17 +103,26 @@ func (m *Manager) Start() (*process.Process, error) {
 		return nil, err
 	}
 
-	// TODO: Actually set memory
-
 	argv := []string{"/opt/cassandra/bin/cassandra"}
 	argv = append(argv, "-f")
 
-	env := []string{}
-	env = append(env, "CASSANDRA_CONF=" + "/data/conf")
+	// cassandra-env.sh computes the heap size from the machine memory unless these are set
+	// (and it requires both to be set); HEAP_NEWSIZE follows its rule of a quarter of the heap
+	var env []string
+	env = append(env, "CASSANDRA_CONF="+"/data/conf")
+	env = append(env, "MAX_HEAP_SIZE="+strconv.Itoa(m.memory.HeapMB)+"M")
+	env = append(env, "HEAP_NEWSIZE="+strconv.Itoa(m.memory.HeapMB/4)+"M")
 
 	config := &process.ProcessConfig{}
 	config.Argv = argv
 	config.Env = env
+	// The limits recommended for cassandra; memlock lets it lock the JVM heap in memory
+	config.Rlimits = []process.Rlimit{
+		{Resource: process.RlimitNofile, Soft: 100000, Hard: 100000},
+		{Resource: process.RlimitNproc, Soft: 32768, Hard: 32768},
+		{Resource: process.RlimitMemlock, Soft: process.RlimitInfinity, Hard: process.RlimitInfinity},
+	}
+	config.Setpgid = true
 
 	process, err := config.Start()
 	if err != nil {
@@ -117,3 +130,23 @@ func (m *Manager) Start() (*process.Process, error) {
 	}
 	return process, nil
 }
+
+// findSeeds returns the addresses of the first few members (by nodeid), so that every node picks the same seeds.
+// In a StatefulSet we use the stable hostnames, otherwise the pod IPs.
+func findSeeds(clusterMap *kope.ClusterMap) []string {
+	var seeds []string
+	for _, member := range clusterMap.All() {
+		address := member.Hostname
+		if address == "" {
+			address = member.IP()
+		}
+		if address == "" {
+			continue
+		}
+		seeds = append(seeds, address)
+		if len(seeds) >= maxSeeds {
+			break
+		}
+	}
+	return seeds
+}
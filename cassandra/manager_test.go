@@ -0,0 +1,42 @@
+package cassandra
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/kopeio/kope"
+)
+
+func TestFindSeeds(t *testing.T) {
+	grid := []struct {
+		Name      string
+		Addresses []string
+		Hostnames bool
+		Expected  []string
+	}{
+		{"three members", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, false, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"five members", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}, false, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"member without address", []string{"10.0.0.1", "", "10.0.0.3", "10.0.0.4"}, false, []string{"10.0.0.1", "10.0.0.3", "10.0.0.4"}},
+		{"statefulset hostnames", []string{"", "", ""}, true, []string{"cassandra-0.cassandra", "cassandra-1.cassandra", "cassandra-2.cassandra"}},
+	}
+	for _, g := range grid {
+		clusterMap := &kope.ClusterMap{}
+		clusterMap.SelfNodeID = "1"
+		clusterMap.Members = map[string]*kope.ClusterMember{}
+		for i, address := range g.Addresses {
+			member := &kope.ClusterMember{}
+			member.NodeID = strconv.Itoa(i + 1)
+			member.Address = address
+			if g.Hostnames {
+				member.Hostname = "cassandra-" + strconv.Itoa(i) + ".cassandra"
+			}
+			clusterMap.Members[member.NodeID] = member
+		}
+
+		seeds := findSeeds(clusterMap)
+		if !reflect.DeepEqual(seeds, g.Expected) {
+			t.Errorf("%s: seeds were %v, expected %v", g.Name, seeds, g.Expected)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// The cgroup filesystem is normally mounted here; in a container it is usually our own cgroup
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroup v1 reports "no limit" as a very large number (the max int64, rounded down to a page)
+const unlimitedMemoryThreshold = int64(1) << 62
+
+// Limits are the resource limits our cgroup imposes on us
+type Limits struct {
+	// MemoryBytes is the memory limit, or 0 if there is none
+	MemoryBytes int64
+	// CPUs is the CPU quota (in cores, possibly fractional), or 0 if there is none
+	CPUs float64
+}
+
+// ReadLimits reads the memory and CPU limits for our own process, from cgroup v2 if available, otherwise from cgroup v1
+func ReadLimits() (*Limits, error) {
+	paths, err := readSelfCgroups("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+
+	if isCgroup2() {
+		return readLimitsV2(paths[""])
+	}
+	return readLimitsV1(paths)
+}
+
+func isCgroup2() bool {
+	_, err := os.Stat(path.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// readSelfCgroups parses /proc/self/cgroup, returning a map from controller to cgroup path.
+// The cgroup v2 (unified) hierarchy is returned with a controller of "".
+func readSelfCgroups(p string) (map[string]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", p, err)
+	}
+	defer f.Close()
+
+	paths := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format is hierarchy-id:controller-list:path
+		tokens := strings.SplitN(scanner.Text(), ":", 3)
+		if len(tokens) != 3 {
+			continue
+		}
+		if tokens[1] == "" {
+			paths[""] = tokens[2]
+			continue
+		}
+		for _, controller := range strings.Split(tokens[1], ",") {
+			paths[controller] = tokens[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", p, err)
+	}
+	return paths, nil
+}
+
+// findFile finds a cgroup file; if we are in a cgroup namespace (or the container's cgroup is mounted
+// as the root, as docker does) the file is at the root of the mount, otherwise it is under our cgroup path
+func findFile(mount string, cgroupPath string, name string) string {
+	if cgroupPath != "" {
+		p := path.Join(mount, cgroupPath, name)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	p := path.Join(mount, name)
+	if _, err := os.Stat(p); err == nil {
+		return p
+	}
+	return ""
+}
+
+func readFile(p string) (string, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", p, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func readInt(p string) (int64, error) {
+	s, err := readFile(p)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %q", p, s)
+	}
+	return v, nil
+}
+
+func readLimitsV1(paths map[string]string) (*Limits, error) {
+	limits := &Limits{}
+
+	memoryFile := findFile(path.Join(cgroupRoot, "memory"), paths["memory"], "memory.limit_in_bytes")
+	if memoryFile != "" {
+		memory, err := readInt(memoryFile)
+		if err != nil {
+			return nil, err
+		}
+		if memory > 0 && memory < unlimitedMemoryThreshold {
+			limits.MemoryBytes = memory
+		}
+	} else {
+		glog.V(2).Info("cgroup v1 memory controller not found")
+	}
+
+	cpuMount := path.Join(cgroupRoot, "cpu")
+	quotaFile := findFile(cpuMount, paths["cpu"], "cpu.cfs_quota_us")
+	periodFile := findFile(cpuMount, paths["cpu"], "cpu.cfs_period_us")
+	if quotaFile != "" && periodFile != "" {
+		quota, err := readInt(quotaFile)
+		if err != nil {
+			return nil, err
+		}
+		period, err := readInt(periodFile)
+		if err != nil {
+			return nil, err
+		}
+		// A quota of -1 means no limit
+		if quota > 0 && period > 0 {
+			limits.CPUs = float64(quota) / float64(period)
+		}
+	} else {
+		glog.V(2).Info("cgroup v1 cpu controller not found")
+	}
+
+	return limits, nil
+}
+
+func readLimitsV2(cgroupPath string) (*Limits, error) {
+	limits := &Limits{}
+
+	memoryFile := findFile(cgroupRoot, cgroupPath, "memory.max")
+	if memoryFile != "" {
+		s, err := readFile(memoryFile)
+		if err != nil {
+			return nil, err
+		}
+		if s != "max" {
+			memory, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing %s: %q", memoryFile, s)
+			}
+			limits.MemoryBytes = memory
+		}
+	}
+
+	cpuFile := findFile(cgroupRoot, cgroupPath, "cpu.max")
+	if cpuFile != "" {
+		s, err := readFile(cpuFile)
+		if err != nil {
+			return nil, err
+		}
+		cpus, err := parseCPUMax(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", cpuFile, err)
+		}
+		limits.CPUs = cpus
+	}
+
+	return limits, nil
+}
+
+// parseCPUMax parses the cgroup v2 cpu.max format: "$MAX $PERIOD", where $MAX may be "max"
+func parseCPUMax(s string) (float64, error) {
+	tokens := strings.Fields(s)
+	if len(tokens) != 2 {
+		return 0, fmt.Errorf("unexpected format %q", s)
+	}
+	if tokens[0] == "max" {
+		return 0, nil
+	}
+	quota, err := strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected format %q", s)
+	}
+	period, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil || period <= 0 {
+		return 0, fmt.Errorf("unexpected format %q", s)
+	}
+	return float64(quota) / float64(period), nil
+}
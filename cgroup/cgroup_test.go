@@ -0,0 +1,101 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUMax(t *testing.T) {
+	grid := []struct {
+		Input    string
+		Expected float64
+		Error    bool
+	}{
+		{"max 100000", 0, false},
+		{"100000 100000", 1, false},
+		{"50000 100000", 0.5, false},
+		{"250000 100000\n", 2.5, false},
+		{"max", 0, true},
+		{"", 0, true},
+		{"abc 100000", 0, true},
+		{"100000 0", 0, true},
+		{"100000 abc", 0, true},
+		{"1 2 3", 0, true},
+	}
+	for _, g := range grid {
+		actual, err := parseCPUMax(g.Input)
+		if g.Error {
+			if err == nil {
+				t.Errorf("parseCPUMax(%q): expected error", g.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCPUMax(%q): unexpected error: %v", g.Input, err)
+			continue
+		}
+		if actual != g.Expected {
+			t.Errorf("parseCPUMax(%q) was %v, expected %v", g.Input, actual, g.Expected)
+		}
+	}
+}
+
+func TestReadSelfCgroups(t *testing.T) {
+	grid := []struct {
+		Name     string
+		Contents string
+		Expected map[string]string
+	}{
+		{
+			Name:     "cgroup v2",
+			Contents: "0::/kubepods/pod1234/abcd\n",
+			Expected: map[string]string{"": "/kubepods/pod1234/abcd"},
+		},
+		{
+			Name: "cgroup v1",
+			Contents: "12:memory:/docker/abcd\n" +
+				"4:cpu,cpuacct:/docker/abcd\n" +
+				"1:name=systemd:/docker/abcd\n" +
+				"0::/\n",
+			Expected: map[string]string{
+				"memory":       "/docker/abcd",
+				"cpu":          "/docker/abcd",
+				"cpuacct":      "/docker/abcd",
+				"name=systemd": "/docker/abcd",
+				"":             "/",
+			},
+		},
+		{
+			Name:     "path containing colons",
+			Contents: "0::/a:b\n",
+			Expected: map[string]string{"": "/a:b"},
+		},
+		{
+			Name:     "malformed lines are skipped",
+			Contents: "garbage\n\n3:memory:/x\n",
+			Expected: map[string]string{"memory": "/x"},
+		},
+	}
+	for _, g := range grid {
+		p := path.Join(t.TempDir(), "cgroup")
+		err := ioutil.WriteFile(p, []byte(g.Contents), 0644)
+		if err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+		actual, err := readSelfCgroups(p)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, g.Expected) {
+			t.Errorf("%s: paths were %v, expected %v", g.Name, actual, g.Expected)
+		}
+	}
+
+	_, err := readSelfCgroups(path.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Errorf("expected error reading missing file")
+	}
+}
@@ -0,0 +1,35 @@
+package kope
+
+import (
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+// Client is the set of kubernetes operations that kope uses.
+// Kubernetes implements it against the API server; fake.Client implements it in memory, for tests.
+// The Find methods return nil (and no error) if the object does not exist.
+type Client interface {
+	GetSelfPod() (*api.Pod, error)
+
+	FindPod(namespace string, name string) (*api.Pod, error)
+	ListPods(namespace string, selector labels.Selector) ([]*api.Pod, error)
+
+	FindPersistentVolumeClaim(namespace string, name string) (*api.PersistentVolumeClaim, error)
+	ListPersistentVolumeClaims(namespace string, selector labels.Selector) ([]*api.PersistentVolumeClaim, error)
+	FindPersistentVolume(name string) (*api.PersistentVolume, error)
+
+	FindSecret(namespace string, name string) (*api.Secret, error)
+	CreateSecret(secret *api.Secret) (*api.Secret, error)
+	UpdateSecret(secret *api.Secret) (*api.Secret, error)
+	DeleteSecret(namespace string, name string) error
+
+	FindEndpoints(namespace string, name string) (*api.Endpoints, error)
+	CreateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error)
+	UpdateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error)
+
+	CreateEvent(event *api.Event) (*api.Event, error)
+
+	WatchResource(resource *ResourceType, handler *WatchHandler, options *WatchOptions) Watcher
+}
+
+var _ Client = &Kubernetes{}
@@ -0,0 +1,327 @@
+package kope
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+// ClusterIDLabel is set on the PVCs (and pods) that belong to a cluster
+const ClusterIDLabel = "kope.io/clusterid"
+
+// NodeIDLabel identifies the member of the cluster; it is normally set on the PVC (or PV),
+// so that the identity stays with the data, but it can also be set on the pod
+const NodeIDLabel = "kope.io/nodeid"
+
+// ClusterMember is one member of a cluster: the nodeid, its volume, and the pod using it (if any)
+type ClusterMember struct {
+	NodeID string
+
+	// PVC is the claim labelled with the nodeid; nil if the nodeid came from a pod label
+	PVC *api.PersistentVolumeClaim
+	// PV is the volume bound to the PVC; nil if the claim is not bound
+	PV *api.PersistentVolume
+	// Pod is the pod using the PVC; nil if no pod is running for this member
+	Pod *KopePod
+
+	// Hostname is the stable DNS name of the member, for members of a StatefulSet; "" otherwise
+	Hostname string
+	// Address is the address the DNS gives for Hostname (if any)
+	Address string
+}
+
+// IP returns the IP of the member's pod (or failing that, the address from the DNS), or "" if it does not have one
+func (c *ClusterMember) IP() string {
+	if c.Pod != nil && c.Pod.Pod != nil && c.Pod.Pod.Status.PodIP != "" {
+		return c.Pod.Pod.Status.PodIP
+	}
+	return c.Address
+}
+
+// IsReady returns true if the member's pod is running and passing its readiness check
+func (c *ClusterMember) IsReady() bool {
+	if c.Pod == nil || c.Pod.Pod == nil {
+		return false
+	}
+	pod := c.Pod.Pod
+	if pod.Status.Phase != api.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == api.PodReady {
+			return condition.Status == api.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Ordinal returns the nodeid as a number (our services use nodeids 1, 2, 3...)
+func (c *ClusterMember) Ordinal() (int, error) {
+	ordinal, err := strconv.Atoi(c.NodeID)
+	if err != nil {
+		return 0, fmt.Errorf("nodeid %q is not numeric", c.NodeID)
+	}
+	return ordinal, nil
+}
+
+// ClusterMap is the membership of a cluster, as seen from one member.
+// The methods can be called on a nil ClusterMap, which behaves as an empty map (e.g. when not running in a cluster).
+type ClusterMap struct {
+	ClusterID string
+	// SelfNodeID is our own nodeid, or "" if we are not a member
+	SelfNodeID string
+	// Members is keyed by nodeid
+	Members map[string]*ClusterMember
+}
+
+// Len returns the number of members
+func (c *ClusterMap) Len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.Members)
+}
+
+// Member returns the member with the nodeid, or nil
+func (c *ClusterMap) Member(nodeID string) *ClusterMember {
+	if c == nil {
+		return nil
+	}
+	return c.Members[nodeID]
+}
+
+// Self returns our own member, or nil if we are not a member
+func (c *ClusterMap) Self() *ClusterMember {
+	if c == nil || c.SelfNodeID == "" {
+		return nil
+	}
+	return c.Members[c.SelfNodeID]
+}
+
+// Ordinal returns our own ordinal (see ClusterMember.Ordinal)
+func (c *ClusterMap) Ordinal() (int, error) {
+	self := c.Self()
+	if self == nil {
+		return 0, fmt.Errorf("not a member of the cluster")
+	}
+	return self.Ordinal()
+}
+
+// All returns every member, sorted by nodeid
+func (c *ClusterMap) All() []*ClusterMember {
+	if c == nil {
+		return nil
+	}
+	var members []*ClusterMember
+	for _, member := range c.Members {
+		members = append(members, member)
+	}
+	sort.Sort(byNodeID(members))
+	return members
+}
+
+// Peers returns the members other than ourselves, sorted by nodeid
+func (c *ClusterMap) Peers() []*ClusterMember {
+	var peers []*ClusterMember
+	for _, member := range c.All() {
+		if member.NodeID == c.SelfNodeID {
+			continue
+		}
+		peers = append(peers, member)
+	}
+	return peers
+}
+
+// ReadyPeers returns the members other than ourselves whose pods are ready, sorted by nodeid
+func (c *ClusterMap) ReadyPeers() []*ClusterMember {
+	var peers []*ClusterMember
+	for _, member := range c.Peers() {
+		if member.IsReady() {
+			peers = append(peers, member)
+		}
+	}
+	return peers
+}
+
+// Fingerprint summarizes the parts of the cluster map that matter for configuration
+// (the nodeids, and the pod & IP of each), so that we can tell whether the cluster has changed.
+// Readiness is deliberately not included; members becoming ready or unready should not cause reconfiguration.
+func (c *ClusterMap) Fingerprint() string {
+	var entries []string
+	for _, member := range c.All() {
+		entry := member.NodeID + "="
+		if member.Pod != nil && member.Pod.Pod != nil {
+			entry += member.Pod.Pod.Name
+		}
+		entry += "/" + member.IP()
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, ",")
+}
+
+// byNodeID sorts members numerically by nodeid where possible, and then by string
+type byNodeID []*ClusterMember
+
+func (s byNodeID) Len() int      { return len(s) }
+func (s byNodeID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byNodeID) Less(i, j int) bool {
+	l, lErr := s[i].Ordinal()
+	r, rErr := s[j].Ordinal()
+	if lErr == nil && rErr == nil && l != r {
+		return l < r
+	}
+	return s[i].NodeID < s[j].NodeID
+}
+
+// clusterSelector selects the objects in the cluster
+func clusterSelector(clusterID string) labels.Selector {
+	return labels.Everything().Add(ClusterIDLabel, labels.InOperator, []string{clusterID})
+}
+
+// nodeIDForClaim returns the nodeid for a PVC: the label on the PVC, or failing that the label on its PV
+func nodeIDForClaim(pvc *api.PersistentVolumeClaim, pv *api.PersistentVolume) string {
+	if pvc != nil {
+		if nodeID := pvc.Labels[NodeIDLabel]; nodeID != "" {
+			return nodeID
+		}
+	}
+	if pv != nil {
+		return pv.Labels[NodeIDLabel]
+	}
+	return ""
+}
+
+// findBoundVolume returns the PV bound to the PVC, or nil if it is not bound (or cannot be read)
+func findBoundVolume(client Client, pvc *api.PersistentVolumeClaim) *api.PersistentVolume {
+	if pvc.Spec.VolumeName == "" {
+		return nil
+	}
+	pv, err := client.FindPersistentVolume(pvc.Spec.VolumeName)
+	if err != nil {
+		glog.Warningf("error reading PV %q for PVC %s/%s: %v", pvc.Spec.VolumeName, pvc.Namespace, pvc.Name, err)
+		return nil
+	}
+	return pv
+}
+
+// LookupClusterMap maps each nodeid (from the PVC or PV labels, or from the pod labels) to the member.
+// The nodeid of each pod is found as in KopePod.GetNodeID, so the map agrees with what each member believes.
+func LookupClusterMap(client Client, clusterID string, selfPodName string, pvcs []*api.PersistentVolumeClaim, pods []*api.Pod) *ClusterMap {
+	clusterMap := &ClusterMap{}
+	clusterMap.ClusterID = clusterID
+	clusterMap.Members = map[string]*ClusterMember{}
+
+	membersByClaim := map[string]*ClusterMember{}
+	for _, pvc := range pvcs {
+		glog.V(4).Info("PVC", pvc)
+		pv := findBoundVolume(client, pvc)
+		nodeID := nodeIDForClaim(pvc, pv)
+		if nodeID == "" {
+			continue
+		}
+
+		// If the pod is not found, we still want the cluster map to record the nodeid
+		member := &ClusterMember{}
+		member.NodeID = nodeID
+		member.PVC = pvc
+		member.PV = pv
+		clusterMap.Members[nodeID] = member
+		membersByClaim[pvc.Name] = member
+	}
+
+	for _, pod := range pods {
+		glog.V(4).Info("POD", pod)
+		var member *ClusterMember
+		if nodeID := pod.Labels[NodeIDLabel]; nodeID != "" {
+			member = clusterMap.Members[nodeID]
+			if member == nil {
+				member = &ClusterMember{}
+				member.NodeID = nodeID
+				clusterMap.Members[nodeID] = member
+			}
+		} else {
+			for j := range pod.Spec.Volumes {
+				volume := &pod.Spec.Volumes[j]
+				if volume.PersistentVolumeClaim != nil {
+					member = membersByClaim[volume.PersistentVolumeClaim.ClaimName]
+					if member != nil {
+						break
+					}
+				}
+			}
+		}
+		if member == nil {
+			continue
+		}
+
+		kopePod := &KopePod{}
+		kopePod.Pod = pod
+		kopePod.KubernetesClient = client
+		// While a pod is being replaced there can briefly be two; we prefer the one that is ready
+		if member.Pod == nil || !member.IsReady() {
+			member.Pod = kopePod
+		}
+
+		if pod.Name == selfPodName {
+			clusterMap.SelfNodeID = member.NodeID
+		}
+	}
+
+	return clusterMap
+}
+
+// GetClusterMap queries for the members of the cluster with the given clusterID, in our namespace
+func (k *KopePod) GetClusterMap(clusterID string) (*ClusterMap, error) {
+	namespace := k.Pod.Namespace
+
+	filter := clusterSelector(clusterID)
+	pvcs, err := k.KubernetesClient.ListPersistentVolumeClaims(namespace, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := k.KubernetesClient.ListPods(namespace, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return LookupClusterMap(k.KubernetesClient, clusterID, k.Pod.Name, pvcs, pods), nil
+}
+
+// GetNodeID finds our nodeid: from the kope.io/nodeid label on the pod, or on one of our PVCs or their PVs.
+// This matches how LookupClusterMap assigns pods to members.  "" is returned if there is no nodeid.
+func (k *KopePod) GetNodeID() (string, error) {
+	if k.Pod == nil {
+		return "", nil
+	}
+	if nodeID := k.Pod.Labels[NodeIDLabel]; nodeID != "" {
+		return nodeID, nil
+	}
+
+	volumes, err := k.GetVolumes()
+	if err != nil {
+		return "", err
+	}
+	for _, volume := range volumes {
+		pvc, err := volume.GetPersistentVolumeClaim()
+		if err != nil {
+			return "", err
+		}
+		if pvc == nil {
+			continue
+		}
+		pv, err := volume.GetPersistentVolume()
+		if err != nil {
+			return "", err
+		}
+		if nodeID := nodeIDForClaim(pvc, pv); nodeID != "" {
+			return nodeID, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,205 @@
+package kope_test
+
+import (
+	"testing"
+
+	"github.com/kopeio/kope"
+	"github.com/kopeio/kope/fake"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const testNamespace = "default"
+
+func buildPVC(name string, nodeID string, volumeName string) *api.PersistentVolumeClaim {
+	pvc := &api.PersistentVolumeClaim{}
+	pvc.Namespace = testNamespace
+	pvc.Name = name
+	pvc.Labels = map[string]string{kope.ClusterIDLabel: "zk"}
+	if nodeID != "" {
+		pvc.Labels[kope.NodeIDLabel] = nodeID
+	}
+	pvc.Spec.VolumeName = volumeName
+	return pvc
+}
+
+func buildPV(name string, nodeID string) *api.PersistentVolume {
+	pv := &api.PersistentVolume{}
+	pv.Name = name
+	pv.Labels = map[string]string{kope.NodeIDLabel: nodeID}
+	return pv
+}
+
+func buildPod(name string, claimName string, ip string, ready bool) *api.Pod {
+	pod := &api.Pod{}
+	pod.Namespace = testNamespace
+	pod.Name = name
+	pod.Labels = map[string]string{kope.ClusterIDLabel: "zk"}
+	if claimName != "" {
+		volume := api.Volume{Name: "data"}
+		volume.PersistentVolumeClaim = &api.PersistentVolumeClaimVolumeSource{ClaimName: claimName}
+		pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+	}
+	pod.Status.Phase = api.PodRunning
+	pod.Status.PodIP = ip
+	status := api.ConditionStatus("False")
+	if ready {
+		status = api.ConditionTrue
+	}
+	pod.Status.Conditions = []api.PodCondition{{Type: api.PodReady, Status: status}}
+	return pod
+}
+
+// buildCluster builds a cluster of three members: the nodeid of zk-1 is on its PVC, that of zk-2 on its PV,
+// and zk-3 has no volume (its nodeid is on the pod).  There is also a PVC for a member with no pod.
+func buildCluster() *fake.Client {
+	client := fake.NewClient()
+
+	client.Add(buildPVC("data-1", "1", ""))
+	client.Add(buildPVC("data-2", "", "pv-2"))
+	client.Add(buildPV("pv-2", "2"))
+	client.Add(buildPVC("data-4", "4", ""))
+	// Not part of the cluster
+	other := buildPVC("data-other", "1", "")
+	other.Labels[kope.ClusterIDLabel] = "other"
+	client.Add(other)
+
+	client.Add(buildPod("zk-1", "data-1", "10.0.0.1", true))
+	client.Add(buildPod("zk-2", "data-2", "10.0.0.2", false))
+	pod3 := buildPod("zk-3", "", "10.0.0.3", true)
+	pod3.Labels[kope.NodeIDLabel] = "3"
+	client.Add(pod3)
+
+	return client
+}
+
+func TestGetClusterMap(t *testing.T) {
+	client := buildCluster()
+	self, _ := client.FindPod(testNamespace, "zk-2")
+	client.SelfPod = self
+
+	selfPod := &kope.KopePod{Pod: self, KubernetesClient: client}
+	clusterMap, err := selfPod.GetClusterMap("zk")
+	if err != nil {
+		t.Fatalf("unexpected error building cluster map: %v", err)
+	}
+
+	if clusterMap.SelfNodeID != "2" {
+		t.Errorf("SelfNodeID was %q, expected %q", clusterMap.SelfNodeID, "2")
+	}
+
+	grid := []struct {
+		NodeID string
+		Pod    string
+		IP     string
+		Ready  bool
+	}{
+		{"1", "zk-1", "10.0.0.1", true},
+		{"2", "zk-2", "10.0.0.2", false},
+		{"3", "zk-3", "10.0.0.3", true},
+		{"4", "", "", false},
+	}
+	members := clusterMap.All()
+	if len(members) != len(grid) {
+		t.Fatalf("expected %d members, found %d: %s", len(grid), len(members), clusterMap.Fingerprint())
+	}
+	for i, g := range grid {
+		member := members[i]
+		if member.NodeID != g.NodeID {
+			t.Errorf("member %d: nodeid was %q, expected %q", i, member.NodeID, g.NodeID)
+			continue
+		}
+		pod := ""
+		if member.Pod != nil {
+			pod = member.Pod.Pod.Name
+		}
+		if pod != g.Pod {
+			t.Errorf("member %s: pod was %q, expected %q", g.NodeID, pod, g.Pod)
+		}
+		if member.IP() != g.IP {
+			t.Errorf("member %s: IP was %q, expected %q", g.NodeID, member.IP(), g.IP)
+		}
+		if member.IsReady() != g.Ready {
+			t.Errorf("member %s: IsReady was %v, expected %v", g.NodeID, member.IsReady(), g.Ready)
+		}
+	}
+
+	var readyPeers []string
+	for _, peer := range clusterMap.ReadyPeers() {
+		readyPeers = append(readyPeers, peer.NodeID)
+	}
+	if len(readyPeers) != 2 || readyPeers[0] != "1" || readyPeers[1] != "3" {
+		t.Errorf("ReadyPeers were %v, expected [1 3]", readyPeers)
+	}
+}
+
+func TestClusterMapFingerprint(t *testing.T) {
+	client := buildCluster()
+	self, _ := client.FindPod(testNamespace, "zk-1")
+	selfPod := &kope.KopePod{Pod: self, KubernetesClient: client}
+
+	clusterMap, err := selfPod.GetClusterMap("zk")
+	if err != nil {
+		t.Fatalf("unexpected error building cluster map: %v", err)
+	}
+	before := clusterMap.Fingerprint()
+
+	// Readiness does not affect the fingerprint
+	pod2, _ := client.FindPod(testNamespace, "zk-2")
+	pod2.Status.Conditions[0].Status = api.ConditionTrue
+	client.Update(pod2)
+	clusterMap, err = selfPod.GetClusterMap("zk")
+	if err != nil {
+		t.Fatalf("unexpected error building cluster map: %v", err)
+	}
+	if clusterMap.Fingerprint() != before {
+		t.Errorf("fingerprint changed when a member became ready: %q -> %q", before, clusterMap.Fingerprint())
+	}
+
+	// A member moving to a new IP does
+	pod2.Status.PodIP = "10.0.0.22"
+	client.Update(pod2)
+	clusterMap, err = selfPod.GetClusterMap("zk")
+	if err != nil {
+		t.Fatalf("unexpected error building cluster map: %v", err)
+	}
+	if clusterMap.Fingerprint() == before {
+		t.Errorf("fingerprint did not change when a member moved: %q", before)
+	}
+}
+
+func TestGetNodeID(t *testing.T) {
+	client := buildCluster()
+	client.Add(buildPod("no-volume", "", "10.0.0.9", true))
+
+	grid := []struct {
+		Pod    string
+		NodeID string
+	}{
+		{"zk-1", "1"},
+		{"zk-2", "2"},
+		{"zk-3", "3"},
+		{"no-volume", ""},
+	}
+	for _, g := range grid {
+		pod, _ := client.FindPod(testNamespace, g.Pod)
+		kopePod := &kope.KopePod{Pod: pod, KubernetesClient: client}
+		nodeID, err := kopePod.GetNodeID()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.Pod, err)
+			continue
+		}
+		if nodeID != g.NodeID {
+			t.Errorf("%s: nodeid was %q, expected %q", g.Pod, nodeID, g.NodeID)
+		}
+	}
+}
+
+func TestNilClusterMap(t *testing.T) {
+	var clusterMap *kope.ClusterMap
+	if clusterMap.Len() != 0 || clusterMap.Self() != nil || len(clusterMap.All()) != 0 || len(clusterMap.Peers()) != 0 {
+		t.Errorf("nil cluster map did not behave as empty")
+	}
+	if _, err := clusterMap.Ordinal(); err == nil {
+		t.Errorf("expected error from Ordinal on nil cluster map")
+	}
+}
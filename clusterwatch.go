@@ -0,0 +1,136 @@
+package kope
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// We wait a little after a change before recomputing the cluster map, so that a burst of changes
+// (e.g. a pod being deleted and recreated) only produces one notification.
+const clusterChangeDelay = 2 * time.Second
+
+// ClusterChangeFunc is called with the new cluster map when the membership of the cluster changes
+type ClusterChangeFunc func(clusterMap *ClusterMap)
+
+// ClusterWatch watches the pods and PVCs of a cluster (those labelled with kope.io/clusterid),
+// and notifies when the cluster map changes: a member is added or removed, or a member pod moves (gets a new IP).
+type ClusterWatch struct {
+	client      Client
+	clusterID   string
+	selfPodName string
+	onChange    ClusterChangeFunc
+
+	pods Watcher
+	pvcs Watcher
+
+	changes chan struct{}
+	last    string
+}
+
+// WatchCluster starts watching the cluster with the given clusterID, in the namespace of selfPod (which identifies our own member).
+// onChange is called (from a single goroutine) once the initial state is known, and after each change, until stopCh is closed.
+func WatchCluster(client Client, selfPod *api.Pod, clusterID string, onChange ClusterChangeFunc, stopCh <-chan struct{}) *ClusterWatch {
+	namespace := selfPod.Namespace
+	glog.Infof("Starting watch on cluster %s/%s", namespace, clusterID)
+
+	w := &ClusterWatch{}
+	w.client = client
+	w.clusterID = clusterID
+	w.selfPodName = selfPod.Name
+	w.onChange = onChange
+	w.changes = make(chan struct{}, 1)
+
+	options := &WatchOptions{}
+	options.Namespaces = []string{namespace}
+	options.LabelSelector = clusterSelector(clusterID)
+	options.StopCh = stopCh
+
+	handler := &WatchHandler{}
+	handler.OnAdd = func(o interface{}) {
+		w.changed()
+	}
+	handler.OnUpdate = func(oldObj, newObj interface{}) {
+		w.changed()
+	}
+	handler.OnDelete = func(o interface{}) {
+		w.changed()
+	}
+
+	w.pods = client.WatchResource(PodsResource, handler, options)
+	w.pvcs = client.WatchResource(PersistentVolumeClaimsResource, handler, options)
+
+	go w.run(stopCh)
+
+	return w
+}
+
+// changed records that something changed; the run loop will recompute the cluster map
+func (w *ClusterWatch) changed() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+		// A recompute is already pending
+	}
+}
+
+func (w *ClusterWatch) run(stopCh <-chan struct{}) {
+	if !w.pods.WaitForSync(0) || !w.pvcs.WaitForSync(0) {
+		return
+	}
+	w.changed()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-w.changes:
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(clusterChangeDelay):
+		}
+		// Any changes during the delay are included in this computation
+		select {
+		case <-w.changes:
+		default:
+		}
+
+		clusterMap := w.ClusterMap()
+		fingerprint := clusterMap.Fingerprint()
+		if fingerprint == w.last {
+			continue
+		}
+		glog.Infof("Cluster map changed: %s", fingerprint)
+		w.last = fingerprint
+		w.onChange(clusterMap)
+	}
+}
+
+// ClusterMap builds the cluster map from the current state of the watch
+func (w *ClusterWatch) ClusterMap() *ClusterMap {
+	var pvcs []*api.PersistentVolumeClaim
+	for _, o := range w.pvcs.List() {
+		pvc, ok := o.(*api.PersistentVolumeClaim)
+		if !ok {
+			glog.Warningf("Got unexpected object of type %T, expecting PersistentVolumeClaim", o)
+			continue
+		}
+		pvcs = append(pvcs, pvc)
+	}
+
+	var pods []*api.Pod
+	for _, o := range w.pods.List() {
+		pod, ok := o.(*api.Pod)
+		if !ok {
+			glog.Warningf("Got unexpected object of type %T, expecting Pod", o)
+			continue
+		}
+		pods = append(pods, pod)
+	}
+
+	return LookupClusterMap(w.client, w.clusterID, w.selfPodName, pvcs, pods)
+}
@@ -1,24 +1,33 @@
 package confluentschemaregistry
 
 import (
-	"github.com/golang/glog"
+	"embed"
+	"fmt"
 	"github.com/kopeio/kope"
 	"github.com/kopeio/kope/base"
 	"github.com/kopeio/kope/chained"
 	"github.com/kopeio/kope/process"
 	"os"
-	"time"
+	"strings"
 )
 
-const DefaultMemory = 256
+//go:embed templates/*.template
+var templates embed.FS
+
+var _ = kope.RegisterTemplates(templates)
+
+// The schema registry is a simple JVM service; most of its memory is heap
+var memoryPolicy = &base.MemoryPolicy{DefaultMB: 256, OverheadMB: 64, HeapRatio: 0.75}
 
 type Manager struct {
 	base.KopeBaseManager
-	process *process.Process
+	memory *base.MemorySizes
 }
 
 type Config struct {
 	KafkaZookeeperUrl string
+	// HostName is the address we advertise; the other instances forward writes to the elected master on it
+	HostName string
 }
 
 func (m *Manager) Configure() error {
@@ -27,48 +36,22 @@ func (m *Manager) Configure() error {
 		return err
 	}
 
-	if m.MemoryMB == 0 {
-		m.MemoryMB = DefaultMemory
-	} else {
-		memoryLimitMB := m.MemoryMB
-
-		// We leave 32 MB for overhead (connections etc)
-		memoryLimitMB -= 32
-
-		if memoryLimitMB < 0 {
-			glog.Warning("Memory limit was too low; ignoring")
-			m.MemoryMB = DefaultMemory
-		} else {
-			glog.Info("Setting memory to ", memoryLimitMB)
-			m.MemoryMB = memoryLimitMB
-		}
-	}
+	m.memory = m.SizeMemory(memoryPolicy)
 
 	return nil
 }
 
 func (m *Manager) Manage() error {
-	err := m.Init()
-	if err != nil {
-		return chained.Error(err, "error initializing")
-	}
+	return m.Run(m)
+}
 
-	err = m.Configure()
+// Reconfigure recomputes the configuration, and restarts the process to pick it up
+func (m *Manager) Reconfigure() error {
+	err := m.Configure()
 	if err != nil {
 		return chained.Error(err, "error configuring")
 	}
-
-	process, err := m.Start()
-	if err != nil {
-		return chained.Error(err, "error starting")
-	}
-	m.process = process
-
-	for {
-		time.Sleep(5 * time.Second)
-	}
-
-	return nil
+	return m.RestartProcess()
 }
 
 func (m *Manager) Start() (*process.Process, error) {
@@ -79,36 +62,40 @@ func (m *Manager) Start() (*process.Process, error) {
 		}
 	}
 
-	clusterMap, err := m.GetClusterMap()
-	if err != nil {
-		return nil, err
-	}
-
 	var config Config
 	// TODO: Discover zookeeper service
 	// TODO: How to bind groups of services together (what if we had two zookeepers?)
 	config.KafkaZookeeperUrl = "zookeeper:2181"
 
-	// TODO: Do we need to set host.name?
-
-	if len(clusterMap) != 0 && len(clusterMap) != 1 {
-		glog.Fatal("Detected cluster configuration but not implemented")
+	// The instances elect a master through zookeeper, so a cluster needs no more configuration than
+	// each instance advertising an address that the others can reach
+	podIP, err := kope.FindSelfPodIP()
+	if err != nil {
+		return nil, err
 	}
+	if podIP == nil {
+		return nil, fmt.Errorf("cannot determine pod ip")
+	}
+	config.HostName = podIP.String()
 
 	err = kope.WriteTemplate("/data/conf/schema-registry.properties", &config)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: Actually set memory
-
 	// TODO: Logging configuration?
 
 	argv := []string{"/opt/confluent/bin/schema-registry-start"}
 	argv = append(argv, "/data/conf/schema-registry.properties")
 
+	var env []string
+	env = append(env, "SCHEMA_REGISTRY_HEAP_OPTS="+strings.Join(base.JavaHeapArgs(m.memory.HeapMB), " "))
+
 	processConfig := &process.ProcessConfig{}
 	processConfig.Argv = argv
+	processConfig.Env = env
+	processConfig.Name = "schema-registry"
+	processConfig.Setpgid = true
 
 	process, err := processConfig.Start()
 	if err != nil {
@@ -1,54 +1,133 @@
 package etcd
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/kopeio/kope"
 	"github.com/kopeio/kope/base"
 	"github.com/kopeio/kope/chained"
 	"github.com/kopeio/kope/process"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 )
 
+const healthCheckTimeout = 5 * time.Second
+
+const clientPort = "2379"
+const peerPort = "2380"
+
 type Manager struct {
 	base.KopeBaseManager
-
-	process *process.Process
 }
 
 func (m *Manager) Configure() error {
-	return nil
+	return m.KopeBaseManager.Configure()
 }
 
 func (m *Manager) Manage() error {
-	err := m.Init()
+	return m.Run(m)
+}
+func (m *Manager) Start() (*process.Process, error) {
+	clusterMap, err := m.GetClusterMap()
 	if err != nil {
-		return chained.Error(err, "error initializing")
+		return nil, err
 	}
 
-	err = m.Configure()
-	if err != nil {
-		return chained.Error(err, "error configuring")
+	argv := []string{"/opt/etcd/etcd"}
+	if clusterMap.Self() != nil {
+		clusterArgs, err := buildClusterArgs(clusterMap)
+		if err != nil {
+			return nil, err
+		}
+		argv = append(argv, clusterArgs...)
 	}
 
-	process, err := m.Start()
+	config := &process.ProcessConfig{}
+	config.Argv = argv
+
+	process, err := config.Start()
 	if err != nil {
-		return chained.Error(err, "error starting")
+		return nil, err
 	}
-	m.process = process
+	return process, nil
+}
 
-	for {
-		time.Sleep(5 * time.Second)
-	}
+// memberName is the etcd name of the member; it is derived from the nodeid so that it is stable across restarts
+func memberName(member *kope.ClusterMember) string {
+	return "etcd-" + member.NodeID
+}
 
-	return nil
+// peerURL is the URL on which the member talks to its peers.  In a StatefulSet we use the stable hostname,
+// otherwise the pod IP (which means a member that moves must be re-added to the cluster).
+func peerURL(member *kope.ClusterMember) (string, error) {
+	host := member.Hostname
+	if host == "" {
+		host = member.IP()
+	}
+	if host == "" {
+		return "", fmt.Errorf("cluster member %s does not yet have an address", member.NodeID)
+	}
+	return "http://" + net.JoinHostPort(host, peerPort), nil
 }
-func (m *Manager) Start() (*process.Process, error) {
-	argv := []string{"/opt/etcd/etcd"}
 
-	config := &process.ProcessConfig{}
-	config.Argv = argv
+// buildClusterArgs builds the etcd flags for running as a member of the cluster.
+// The initial-cluster flags are only used when the data directory is first created, so a change in membership
+// after that must be made with etcdctl member add / remove.
+func buildClusterArgs(clusterMap *kope.ClusterMap) ([]string, error) {
+	self := clusterMap.Self()
 
-	process, err := config.Start()
+	var initialCluster []string
+	for _, member := range clusterMap.All() {
+		url, err := peerURL(member)
+		if err != nil {
+			return nil, err
+		}
+		initialCluster = append(initialCluster, memberName(member)+"="+url)
+	}
+
+	selfPeerURL, err := peerURL(self)
 	if err != nil {
 		return nil, err
 	}
-	return process, nil
+	selfClientURL := strings.TrimSuffix(selfPeerURL, peerPort) + clientPort
+
+	var argv []string
+	argv = append(argv, "--name", memberName(self))
+	argv = append(argv, "--data-dir", "/data/etcd")
+	argv = append(argv, "--listen-peer-urls", "http://"+net.JoinHostPort("0.0.0.0", peerPort))
+	argv = append(argv, "--listen-client-urls", "http://"+net.JoinHostPort("0.0.0.0", clientPort))
+	argv = append(argv, "--initial-advertise-peer-urls", selfPeerURL)
+	argv = append(argv, "--advertise-client-urls", selfClientURL)
+	argv = append(argv, "--initial-cluster", strings.Join(initialCluster, ","))
+	argv = append(argv, "--initial-cluster-state", "new")
+	argv = append(argv, "--initial-cluster-token", clusterMap.ClusterID)
+	return argv, nil
+}
+
+// HealthCheck checks the etcd /health endpoint
+func (m *Manager) HealthCheck() error {
+	client := &http.Client{Timeout: healthCheckTimeout}
+	response, err := client.Get("http://127.0.0.1:2379/health")
+	if err != nil {
+		return chained.Error(err, "error querying etcd health")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from etcd health: %s", response.Status)
+	}
+
+	health := struct {
+		Health string `json:"health"`
+	}{}
+	err = json.NewDecoder(response.Body).Decode(&health)
+	if err != nil {
+		return chained.Error(err, "error parsing etcd health")
+	}
+	if health.Health != "true" {
+		return fmt.Errorf("etcd reports unhealthy: %q", health.Health)
+	}
+	return nil
 }
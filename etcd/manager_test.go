@@ -0,0 +1,76 @@
+package etcd
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+
+	"github.com/kopeio/kope"
+)
+
+func TestBuildClusterArgs(t *testing.T) {
+	grid := []struct {
+		Name           string
+		Hostnames      bool
+		InitialCluster string
+		PeerURL        string
+		ClientURL      string
+	}{
+		{"pod IPs", false, "etcd-1=http://10.0.0.1:2380,etcd-2=http://10.0.0.2:2380,etcd-3=http://10.0.0.3:2380", "http://10.0.0.2:2380", "http://10.0.0.2:2379"},
+		{"statefulset hostnames", true, "etcd-1=http://etcd-0.etcd:2380,etcd-2=http://etcd-1.etcd:2380,etcd-3=http://etcd-2.etcd:2380", "http://etcd-1.etcd:2380", "http://etcd-1.etcd:2379"},
+	}
+	for _, g := range grid {
+		clusterMap := &kope.ClusterMap{}
+		clusterMap.ClusterID = "etcd"
+		clusterMap.SelfNodeID = "2"
+		clusterMap.Members = map[string]*kope.ClusterMember{}
+		for i := 1; i <= 3; i++ {
+			member := &kope.ClusterMember{}
+			member.NodeID = strconv.Itoa(i)
+			if g.Hostnames {
+				member.Hostname = "etcd-" + strconv.Itoa(i-1) + ".etcd"
+			}
+			pod := &api.Pod{}
+			pod.Status.PodIP = "10.0.0." + strconv.Itoa(i)
+			member.Pod = &kope.KopePod{Pod: pod}
+			clusterMap.Members[member.NodeID] = member
+		}
+
+		argv, err := buildClusterArgs(clusterMap)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.Name, err)
+			continue
+		}
+		flags := map[string]string{}
+		for i := 0; i+1 < len(argv); i += 2 {
+			flags[argv[i]] = argv[i+1]
+		}
+		if flags["--name"] != "etcd-2" {
+			t.Errorf("%s: name was %q, expected %q", g.Name, flags["--name"], "etcd-2")
+		}
+		if flags["--initial-cluster"] != g.InitialCluster {
+			t.Errorf("%s: initial-cluster was %q, expected %q", g.Name, flags["--initial-cluster"], g.InitialCluster)
+		}
+		if flags["--initial-advertise-peer-urls"] != g.PeerURL {
+			t.Errorf("%s: initial-advertise-peer-urls was %q, expected %q", g.Name, flags["--initial-advertise-peer-urls"], g.PeerURL)
+		}
+		if flags["--advertise-client-urls"] != g.ClientURL {
+			t.Errorf("%s: advertise-client-urls was %q, expected %q", g.Name, flags["--advertise-client-urls"], g.ClientURL)
+		}
+	}
+}
+
+func TestBuildClusterArgsNoAddress(t *testing.T) {
+	clusterMap := &kope.ClusterMap{}
+	clusterMap.SelfNodeID = "1"
+	clusterMap.Members = map[string]*kope.ClusterMember{
+		"1": {NodeID: "1", Address: "10.0.0.1"},
+		"2": {NodeID: "2"},
+	}
+	_, err := buildClusterArgs(clusterMap)
+	if err == nil || !strings.Contains(err.Error(), "does not yet have an address") {
+		t.Errorf("expected error for member without an address, got %v", err)
+	}
+}
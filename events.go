@@ -0,0 +1,81 @@
+package kope
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+// The reasons for the events we post about the lifecycle of a manager
+const (
+	EventReasonInitialized       = "Initialized"
+	EventReasonStarted           = "Started"
+	EventReasonHealthy           = "Healthy"
+	EventReasonRestarted         = "Restarted"
+	EventReasonReconfigured      = "Reconfigured"
+	EventReasonReconfigureFailed = "ReconfigureFailed"
+	EventReasonFailed            = "Failed"
+)
+
+// EventComponent is reported as the source of our events
+const EventComponent = "kope"
+
+// The types of event; the API we target has no type on an event, so the type only decides how we log it
+const (
+	EventTypeNormal  = "Normal"
+	EventTypeWarning = "Warning"
+)
+
+// EventRecorder posts events about a pod, so that `kubectl describe pod` shows what the manager did.
+// Errors posting the events are logged, but otherwise ignored.
+type EventRecorder struct {
+	client Client
+	pod    *api.Pod
+}
+
+func NewEventRecorder(client Client, pod *api.Pod) *EventRecorder {
+	r := &EventRecorder{}
+	r.client = client
+	r.pod = pod
+	return r
+}
+
+// Event posts an event of type EventTypeNormal or EventTypeWarning
+func (r *EventRecorder) Event(eventType string, reason string, message string) {
+	if eventType == EventTypeWarning {
+		glog.Warningf("Posting event %s: %s", reason, message)
+	} else {
+		glog.V(2).Infof("Posting event %s: %s", reason, message)
+	}
+
+	now := unversioned.Now()
+
+	event := &api.Event{}
+	event.Namespace = r.pod.Namespace
+	// Event names must be unique; this is the convention kubernetes itself uses
+	event.Name = fmt.Sprintf("%s.%x", r.pod.Name, time.Now().UnixNano())
+	event.InvolvedObject.Kind = "Pod"
+	event.InvolvedObject.Namespace = r.pod.Namespace
+	event.InvolvedObject.Name = r.pod.Name
+	event.InvolvedObject.UID = r.pod.UID
+	event.InvolvedObject.APIVersion = "v1"
+	event.InvolvedObject.ResourceVersion = r.pod.ResourceVersion
+	event.Reason = reason
+	event.Message = message
+	event.Source.Component = EventComponent
+	event.FirstTimestamp = now
+	event.LastTimestamp = now
+	event.Count = 1
+
+	_, err := r.client.CreateEvent(event)
+	if err != nil {
+		glog.Warningf("error posting event %s %q: %v", reason, message, err)
+	}
+}
+
+func (r *EventRecorder) Eventf(eventType string, reason string, messageFmt string, args ...interface{}) {
+	r.Event(eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
@@ -0,0 +1,415 @@
+package fake
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kopeio/kope"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+)
+
+// Client is an in-memory implementation of kope.Client, so that managers can be tested without a cluster.
+// Objects are added with Add / Update / Delete; watches see the changes immediately.
+// As with the real client, objects are copied when they are stored and when they are returned,
+// so callers can change what they are given (and then call Update) without affecting the stored objects.
+type Client struct {
+	// SelfPod is returned by GetSelfPod
+	SelfPod *api.Pod
+
+	mutex sync.Mutex
+	// objects is keyed by resource name (e.g. "pods"), then by namespace/name
+	objects map[string]map[string]runtime.Object
+	watches []*watch
+	// resourceVersion is incremented on every change, and assigned to the changed object
+	resourceVersion int
+}
+
+var _ kope.Client = &Client{}
+
+// NewClient builds an empty fake client
+func NewClient() *Client {
+	c := &Client{}
+	c.objects = make(map[string]map[string]runtime.Object)
+	return c
+}
+
+// describe returns the resource name and metadata of one of the objects we support
+func describe(obj runtime.Object) (string, *api.ObjectMeta) {
+	switch o := obj.(type) {
+	case *api.Pod:
+		return kope.PodsResource.Name, &o.ObjectMeta
+	case *api.PersistentVolumeClaim:
+		return kope.PersistentVolumeClaimsResource.Name, &o.ObjectMeta
+	case *api.PersistentVolume:
+		return "persistentvolumes", &o.ObjectMeta
+	case *api.Secret:
+		return kope.SecretsResource.Name, &o.ObjectMeta
+	case *api.Endpoints:
+		return kope.EndpointsResource.Name, &o.ObjectMeta
+	case *api.Service:
+		return kope.ServicesResource.Name, &o.ObjectMeta
+	case *api.Event:
+		return "events", &o.ObjectMeta
+	default:
+		panic(fmt.Sprintf("unsupported object type %T", obj))
+	}
+}
+
+func key(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// Add adds (or replaces) an object, notifying any watches.
+// As with the other changes, the object is assigned a new ResourceVersion.
+func (c *Client) Add(obj runtime.Object) {
+	c.Update(obj)
+}
+
+// Update replaces (or adds) an object, notifying any watches
+func (c *Client) Update(obj runtime.Object) {
+	obj = copyObject(obj)
+	resource, meta := describe(obj)
+
+	c.mutex.Lock()
+	objects := c.objects[resource]
+	if objects == nil {
+		objects = make(map[string]runtime.Object)
+		c.objects[resource] = objects
+	}
+	k := key(meta.Namespace, meta.Name)
+	oldObj := objects[k]
+	c.resourceVersion++
+	meta.ResourceVersion = strconv.Itoa(c.resourceVersion)
+	objects[k] = obj
+	watches := c.watchesFor(resource)
+	c.mutex.Unlock()
+
+	for _, w := range watches {
+		if oldObj == nil {
+			w.added(obj)
+		} else {
+			w.updated(oldObj, obj)
+		}
+	}
+}
+
+// Delete removes an object, notifying any watches
+func (c *Client) Delete(obj runtime.Object) {
+	resource, meta := describe(obj)
+
+	c.mutex.Lock()
+	k := key(meta.Namespace, meta.Name)
+	oldObj := c.objects[resource][k]
+	delete(c.objects[resource], k)
+	c.resourceVersion++
+	watches := c.watchesFor(resource)
+	c.mutex.Unlock()
+
+	if oldObj == nil {
+		return
+	}
+	for _, w := range watches {
+		w.deleted(oldObj)
+	}
+}
+
+// find returns a copy of the object with the given namespace & name, or nil
+func (c *Client) find(resource string, namespace string, name string) runtime.Object {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	obj := c.objects[resource][key(namespace, name)]
+	if obj == nil {
+		return nil
+	}
+	return copyObject(obj)
+}
+
+// list returns copies of the objects of the given resource matching the options, sorted by namespace/name
+func (c *Client) list(resource string, options *kope.WatchOptions) []runtime.Object {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var keys []string
+	for k, obj := range c.objects[resource] {
+		_, meta := describe(obj)
+		if options.Matches(meta) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var objects []runtime.Object
+	for _, k := range keys {
+		objects = append(objects, copyObject(c.objects[resource][k]))
+	}
+	return objects
+}
+
+func listOptions(namespace string, selector labels.Selector) *kope.WatchOptions {
+	options := &kope.WatchOptions{}
+	if namespace != api.NamespaceAll {
+		options.Namespaces = []string{namespace}
+	}
+	options.LabelSelector = selector
+	return options
+}
+
+func (c *Client) GetSelfPod() (*api.Pod, error) {
+	if c.SelfPod == nil {
+		return nil, fmt.Errorf("SelfPod not set")
+	}
+	return c.SelfPod, nil
+}
+
+func (c *Client) FindPod(namespace string, name string) (*api.Pod, error) {
+	obj := c.find(kope.PodsResource.Name, namespace, name)
+	if obj == nil {
+		return nil, nil
+	}
+	return obj.(*api.Pod), nil
+}
+
+func (c *Client) ListPods(namespace string, selector labels.Selector) ([]*api.Pod, error) {
+	var pods []*api.Pod
+	for _, obj := range c.list(kope.PodsResource.Name, listOptions(namespace, selector)) {
+		pods = append(pods, obj.(*api.Pod))
+	}
+	return pods, nil
+}
+
+func (c *Client) FindPersistentVolumeClaim(namespace string, name string) (*api.PersistentVolumeClaim, error) {
+	obj := c.find(kope.PersistentVolumeClaimsResource.Name, namespace, name)
+	if obj == nil {
+		return nil, nil
+	}
+	return obj.(*api.PersistentVolumeClaim), nil
+}
+
+func (c *Client) ListPersistentVolumeClaims(namespace string, selector labels.Selector) ([]*api.PersistentVolumeClaim, error) {
+	var pvcs []*api.PersistentVolumeClaim
+	for _, obj := range c.list(kope.PersistentVolumeClaimsResource.Name, listOptions(namespace, selector)) {
+		pvcs = append(pvcs, obj.(*api.PersistentVolumeClaim))
+	}
+	return pvcs, nil
+}
+
+func (c *Client) FindPersistentVolume(name string) (*api.PersistentVolume, error) {
+	obj := c.find("persistentvolumes", "", name)
+	if obj == nil {
+		return nil, nil
+	}
+	return obj.(*api.PersistentVolume), nil
+}
+
+func (c *Client) FindSecret(namespace string, name string) (*api.Secret, error) {
+	obj := c.find(kope.SecretsResource.Name, namespace, name)
+	if obj == nil {
+		return nil, nil
+	}
+	return obj.(*api.Secret), nil
+}
+
+// CreateSecret adds the secret, failing (as the API server would) if it already exists
+func (c *Client) CreateSecret(secret *api.Secret) (*api.Secret, error) {
+	existing, _ := c.FindSecret(secret.Namespace, secret.Name)
+	if existing != nil {
+		return nil, errors.NewAlreadyExists("secret", secret.Name)
+	}
+	c.Add(secret)
+	return c.FindSecret(secret.Namespace, secret.Name)
+}
+
+// UpdateSecret replaces the secret, failing (as the API server would) if it does not exist,
+// or if it has changed since secret.ResourceVersion (if that is set)
+func (c *Client) UpdateSecret(secret *api.Secret) (*api.Secret, error) {
+	existing, _ := c.FindSecret(secret.Namespace, secret.Name)
+	if existing == nil {
+		return nil, errors.NewNotFound("secret", secret.Name)
+	}
+	if secret.ResourceVersion != "" && secret.ResourceVersion != existing.ResourceVersion {
+		return nil, errors.NewConflict("secret", secret.Name, fmt.Errorf("resourceVersion %s is not current (%s)", secret.ResourceVersion, existing.ResourceVersion))
+	}
+	c.Update(secret)
+	return c.FindSecret(secret.Namespace, secret.Name)
+}
+
+func (c *Client) DeleteSecret(namespace string, name string) error {
+	existing, _ := c.FindSecret(namespace, name)
+	if existing == nil {
+		return errors.NewNotFound("secret", name)
+	}
+	c.Delete(existing)
+	return nil
+}
+
+func (c *Client) FindEndpoints(namespace string, name string) (*api.Endpoints, error) {
+	obj := c.find(kope.EndpointsResource.Name, namespace, name)
+	if obj == nil {
+		return nil, nil
+	}
+	return obj.(*api.Endpoints), nil
+}
+
+// CreateEndpoints adds the Endpoints, failing (as the API server would) if they already exist
+func (c *Client) CreateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error) {
+	existing, _ := c.FindEndpoints(endpoints.Namespace, endpoints.Name)
+	if existing != nil {
+		return nil, errors.NewAlreadyExists("endpoints", endpoints.Name)
+	}
+	c.Add(endpoints)
+	return c.FindEndpoints(endpoints.Namespace, endpoints.Name)
+}
+
+// UpdateEndpoints replaces the Endpoints, failing (as the API server would) if they do not exist,
+// or if they have changed since endpoints.ResourceVersion (if that is set)
+func (c *Client) UpdateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error) {
+	existing, _ := c.FindEndpoints(endpoints.Namespace, endpoints.Name)
+	if existing == nil {
+		return nil, errors.NewNotFound("endpoints", endpoints.Name)
+	}
+	if endpoints.ResourceVersion != "" && endpoints.ResourceVersion != existing.ResourceVersion {
+		return nil, errors.NewConflict("endpoints", endpoints.Name, fmt.Errorf("resourceVersion %s is not current (%s)", endpoints.ResourceVersion, existing.ResourceVersion))
+	}
+	c.Update(endpoints)
+	return c.FindEndpoints(endpoints.Namespace, endpoints.Name)
+}
+
+func (c *Client) CreateEvent(event *api.Event) (*api.Event, error) {
+	c.Add(event)
+	return event, nil
+}
+
+// Events returns the events that have been posted, sorted by namespace/name
+func (c *Client) Events() []*api.Event {
+	var events []*api.Event
+	for _, obj := range c.list("events", nil) {
+		events = append(events, obj.(*api.Event))
+	}
+	return events
+}
+
+// copyObject deep-copies an object; we only store objects the scheme knows, so copying cannot fail
+func copyObject(obj runtime.Object) runtime.Object {
+	c, err := api.Scheme.Copy(obj)
+	if err != nil {
+		panic(fmt.Sprintf("error copying %T: %v", obj, err))
+	}
+	return c
+}
+
+// WatchResource delivers the existing objects to the handler before returning, so the watch is synced immediately
+func (c *Client) WatchResource(resource *kope.ResourceType, handler *kope.WatchHandler, options *kope.WatchOptions) kope.Watcher {
+	w := &watch{}
+	w.client = c
+	w.resource = resource.Name
+	w.handler = handler
+	w.options = options
+	if options != nil {
+		w.stopCh = options.StopCh
+	}
+
+	c.mutex.Lock()
+	c.watches = append(c.watches, w)
+	c.mutex.Unlock()
+
+	for _, obj := range c.list(w.resource, options) {
+		w.added(obj)
+	}
+	return w
+}
+
+// watchesFor returns the running watches on the resource; the mutex must be held
+func (c *Client) watchesFor(resource string) []*watch {
+	var watches []*watch
+	for _, w := range c.watches {
+		if w.resource == resource && !w.stopped() {
+			watches = append(watches, w)
+		}
+	}
+	return watches
+}
+
+// watch implements kope.Watcher for the fake client
+type watch struct {
+	client   *Client
+	resource string
+	handler  *kope.WatchHandler
+	options  *kope.WatchOptions
+	stopCh   <-chan struct{}
+}
+
+var _ kope.Watcher = &watch{}
+
+func (w *watch) stopped() bool {
+	if w.stopCh == nil {
+		return false
+	}
+	select {
+	case <-w.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *watch) matches(obj runtime.Object) bool {
+	_, meta := describe(obj)
+	return w.options.Matches(meta)
+}
+
+func (w *watch) added(obj runtime.Object) {
+	if w.handler.OnAdd != nil && w.matches(obj) {
+		w.handler.OnAdd(obj)
+	}
+}
+
+// updated is called with the old & new versions; the object may have moved into or out of our selection
+func (w *watch) updated(oldObj, newObj runtime.Object) {
+	oldMatches := w.matches(oldObj)
+	newMatches := w.matches(newObj)
+	if oldMatches && newMatches {
+		if w.handler.OnUpdate != nil {
+			w.handler.OnUpdate(oldObj, newObj)
+		}
+	} else if newMatches {
+		w.added(newObj)
+	} else if oldMatches {
+		w.deleted(oldObj)
+	}
+}
+
+func (w *watch) deleted(obj runtime.Object) {
+	if w.handler.OnDelete != nil && w.matches(obj) {
+		w.handler.OnDelete(obj)
+	}
+}
+
+func (w *watch) HasSynced() bool {
+	return true
+}
+
+func (w *watch) WaitForSync(timeout time.Duration) bool {
+	return !w.stopped()
+}
+
+func (w *watch) List() []interface{} {
+	var objects []interface{}
+	for _, obj := range w.client.list(w.resource, w.options) {
+		objects = append(objects, obj)
+	}
+	return objects
+}
+
+func (w *watch) Wait() {
+	if w.stopCh == nil {
+		select {}
+	}
+	<-w.stopCh
+}
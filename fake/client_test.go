@@ -0,0 +1,125 @@
+package fake
+
+import (
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/labels"
+
+	"github.com/kopeio/kope"
+)
+
+func buildPod(name string, ip string) *api.Pod {
+	pod := &api.Pod{}
+	pod.Namespace = "default"
+	pod.Name = name
+	pod.Labels = map[string]string{"app": "test"}
+	pod.Status.PodIP = ip
+	return pod
+}
+
+func TestObjectsAreCopied(t *testing.T) {
+	client := NewClient()
+	pod := buildPod("pod-1", "10.0.0.1")
+	client.Add(pod)
+
+	if pod.ResourceVersion != "" {
+		t.Errorf("Add changed the caller's object")
+	}
+	pod.Status.PodIP = "10.0.0.2"
+
+	found, _ := client.FindPod("default", "pod-1")
+	if found.Status.PodIP != "10.0.0.1" {
+		t.Errorf("changing the added object changed the stored object")
+	}
+	if found.ResourceVersion == "" {
+		t.Errorf("stored object was not assigned a ResourceVersion")
+	}
+
+	found.Labels["app"] = "changed"
+	listed, _ := client.ListPods("default", labels.Everything())
+	if len(listed) != 1 || listed[0].Labels["app"] != "test" {
+		t.Errorf("changing a found object changed the stored object")
+	}
+}
+
+func TestWatchSeesChanges(t *testing.T) {
+	client := NewClient()
+	client.Add(buildPod("pod-1", "10.0.0.1"))
+
+	var added, deleted []string
+	var updates [][2]string
+	handler := &kope.WatchHandler{}
+	handler.OnAdd = func(obj interface{}) {
+		added = append(added, obj.(*api.Pod).Name)
+	}
+	handler.OnUpdate = func(oldObj, newObj interface{}) {
+		updates = append(updates, [2]string{oldObj.(*api.Pod).Status.PodIP, newObj.(*api.Pod).Status.PodIP})
+	}
+	handler.OnDelete = func(obj interface{}) {
+		deleted = append(deleted, obj.(*api.Pod).Name)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	client.WatchResource(kope.PodsResource, handler, &kope.WatchOptions{StopCh: stopCh})
+
+	if len(added) != 1 || added[0] != "pod-1" {
+		t.Errorf("existing objects were not delivered: %v", added)
+	}
+
+	// The usual find, change & update: the watch must see the old and new versions
+	pod, _ := client.FindPod("default", "pod-1")
+	pod.Status.PodIP = "10.0.0.2"
+	client.Update(pod)
+	if len(updates) != 1 || updates[0] != [2]string{"10.0.0.1", "10.0.0.2"} {
+		t.Errorf("updates were %v, expected [[10.0.0.1 10.0.0.2]]", updates)
+	}
+
+	client.Delete(pod)
+	if len(deleted) != 1 || deleted[0] != "pod-1" {
+		t.Errorf("deletes were %v, expected [pod-1]", deleted)
+	}
+}
+
+func TestUpdateSecretConflict(t *testing.T) {
+	client := NewClient()
+
+	secret := &api.Secret{}
+	secret.Namespace = "default"
+	secret.Name = "creds"
+	secret.Data = map[string][]byte{"password": []byte("a")}
+	created, err := client.CreateSecret(secret)
+	if err != nil {
+		t.Fatalf("unexpected error creating secret: %v", err)
+	}
+	if _, err := client.CreateSecret(secret); !errors.IsAlreadyExists(err) {
+		t.Errorf("expected AlreadyExists creating the secret twice, got %v", err)
+	}
+
+	first, _ := client.FindSecret("default", "creds")
+	second, _ := client.FindSecret("default", "creds")
+	if first.ResourceVersion != created.ResourceVersion {
+		t.Errorf("ResourceVersion of the created secret was %q, found %q", created.ResourceVersion, first.ResourceVersion)
+	}
+
+	first.Data["password"] = []byte("b")
+	if _, err := client.UpdateSecret(first); err != nil {
+		t.Fatalf("unexpected error updating secret: %v", err)
+	}
+	if string(second.Data["password"]) != "a" {
+		t.Errorf("update changed a previously found copy")
+	}
+
+	second.Data["password"] = []byte("c")
+	if _, err := client.UpdateSecret(second); !errors.IsConflict(err) {
+		t.Errorf("expected Conflict updating a stale secret, got %v", err)
+	}
+
+	if err := client.DeleteSecret("default", "creds"); err != nil {
+		t.Errorf("unexpected error deleting secret: %v", err)
+	}
+	if err := client.DeleteSecret("default", "creds"); !errors.IsNotFound(err) {
+		t.Errorf("expected NotFound deleting the secret twice, got %v", err)
+	}
+}
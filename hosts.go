@@ -26,8 +26,8 @@ func SetEtcHosts(prefix string, entries map[string]string) error {
 	var buffer bytes.Buffer
 	for _, line := range strings.Split(string(existing), "\n") {
 		write := line
-		trimmed := strings.TrimSpace(line)
-		tokens := strings.Split(trimmed, " ")
+		// Entries are separated by any whitespace (kubelet uses tabs), and IPv6 addresses are written as-is
+		tokens := strings.Fields(line)
 		if len(tokens) == 2 {
 			if strings.HasPrefix(tokens[1], prefix) {
 				ip, _ := entries[tokens[1]]
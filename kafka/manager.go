@@ -1,26 +1,54 @@
 package kafka
 
 import (
-	"github.com/golang/glog"
+	"context"
+	"embed"
+	"fmt"
 	"github.com/kopeio/kope"
 	"github.com/kopeio/kope/base"
 	"github.com/kopeio/kope/chained"
 	"github.com/kopeio/kope/process"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-const DefaultMemory = 256
+//go:embed templates/*.template
+var templates embed.FS
 
+var _ = kope.RegisterTemplates(templates)
+
+// Kafka relies heavily on the page cache, so we only give half the memory to the heap
+var memoryPolicy = &base.MemoryPolicy{DefaultMB: 256, OverheadMB: 64, HeapRatio: 0.5}
+
+const healthCheckTimeout = 5 * time.Second
+
+// We check the zookeeper registration less often than the port, because it means launching a JVM
+const registrationCheckInterval = 60 * time.Second
+
+// registrationCheckTimeout bounds the zookeeper registration check (including the JVM startup),
+// so that a hung zookeeper-shell doesn't block the health checks (which wait on healthMutex)
+const registrationCheckTimeout = 30 * time.Second
+
+// Manager is not a base.ClusterChangeHandler: the brokers find each other through zookeeper,
+// and our broker id (our ordinal) does not change, so we don't restart when the membership changes.
 type Manager struct {
 	base.KopeBaseManager
-	process *process.Process
+	memory *base.MemorySizes
+	config Config
+
+	healthMutex      sync.Mutex
+	lastRegisteredAt time.Time
 }
 
 type Config struct {
 	AdvertisedHostName string
 	ZookeeperConnect   string
 	BrokerID           int
+	NumNetworkThreads  int
 }
 
 func (m *Manager) Configure() error {
@@ -29,48 +57,25 @@ func (m *Manager) Configure() error {
 		return err
 	}
 
-	if m.MemoryMB == 0 {
-		m.MemoryMB = DefaultMemory
-	} else {
-		memoryLimitMB := m.MemoryMB
+	m.memory = m.SizeMemory(memoryPolicy)
 
-		// We leave 32 MB for overhead (connections etc)
-		memoryLimitMB -= 32
-
-		if memoryLimitMB < 0 {
-			glog.Warning("Memory limit was too low; ignoring")
-			m.MemoryMB = DefaultMemory
-		} else {
-			glog.Info("Setting memory to ", memoryLimitMB)
-			m.MemoryMB = memoryLimitMB
-		}
-	}
+	// The network threads are mostly busy, so we want one per CPU
+	m.config.NumNetworkThreads = m.CPUCount()
 
 	return nil
 }
 
 func (m *Manager) Manage() error {
-	err := m.Init()
-	if err != nil {
-		return chained.Error(err, "error initializing")
-	}
+	return m.Run(m)
+}
 
-	err = m.Configure()
+// Reconfigure recomputes the configuration, and restarts the process to pick it up
+func (m *Manager) Reconfigure() error {
+	err := m.Configure()
 	if err != nil {
 		return chained.Error(err, "error configuring")
 	}
-
-	process, err := m.Start()
-	if err != nil {
-		return chained.Error(err, "error starting")
-	}
-	m.process = process
-
-	for {
-		time.Sleep(5 * time.Second)
-	}
-
-	return nil
+	return m.RestartProcess()
 }
 
 func (m *Manager) Start() (*process.Process, error) {
@@ -90,28 +95,44 @@ func (m *Manager) Start() (*process.Process, error) {
 	if err != nil {
 		return nil, err
 	}
+	if podIP == nil {
+		return nil, fmt.Errorf("cannot determine pod ip")
+	}
 
-	var config Config
+	config := &m.config
 	config.BrokerID = 1
+	// In a cluster, each broker needs a unique id; we use the nodeid
+	if self := clusterMap.Self(); self != nil {
+		brokerID, err := self.Ordinal()
+		if err != nil {
+			return nil, err
+		}
+		config.BrokerID = brokerID
+	}
 	config.ZookeeperConnect = "zookeeper:2181"
+	// An IPv6 address is advertised as a bare literal (without brackets); kafka stores host and port separately
 	config.AdvertisedHostName = podIP.String()
 
-	if len(clusterMap) != 0 && len(clusterMap) != 1 {
-		glog.Fatal("Detected cluster configuration but not implemented")
-	}
-
-	err = kope.WriteTemplate("/data/conf/server.properties", &config)
+	err = kope.WriteTemplate("/data/conf/server.properties", config)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: Actually set memory
-
 	argv := []string{"/opt/kafka/bin/kafka-server-start.sh"}
 	argv = append(argv, "/data/conf/server.properties")
 
+	var env []string
+	env = append(env, "KAFKA_HEAP_OPTS="+strings.Join(base.JavaHeapArgs(m.memory.HeapMB), " "))
+
 	processConfig := &process.ProcessConfig{}
 	processConfig.Argv = argv
+	processConfig.Env = env
+	processConfig.Name = "kafka"
+	// Kafka keeps a file descriptor open for every log segment, as well as for every connection
+	processConfig.Rlimits = []process.Rlimit{
+		{Resource: process.RlimitNofile, Soft: 100000, Hard: 100000},
+	}
+	processConfig.Setpgid = true
 
 	process, err := processConfig.Start()
 	if err != nil {
@@ -119,3 +140,39 @@ func (m *Manager) Start() (*process.Process, error) {
 	}
 	return process, nil
 }
+
+// HealthCheck checks that the broker is listening, and that it has registered itself in zookeeper
+func (m *Manager) HealthCheck() error {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:9092", healthCheckTimeout)
+	if err != nil {
+		return chained.Error(err, "error connecting to kafka")
+	}
+	conn.Close()
+
+	m.healthMutex.Lock()
+	defer m.healthMutex.Unlock()
+
+	if time.Since(m.lastRegisteredAt) < registrationCheckInterval {
+		return nil
+	}
+
+	brokerPath := "/brokers/ids/" + strconv.Itoa(m.config.BrokerID)
+	argv := []string{"/opt/kafka/bin/zookeeper-shell.sh", m.config.ZookeeperConnect, "get", brokerPath}
+
+	processConfig := &process.ProcessConfig{}
+	processConfig.Argv = argv
+
+	ctx, cancel := context.WithTimeout(context.Background(), registrationCheckTimeout)
+	defer cancel()
+	stdout, stderr, err := processConfig.ExecContext(ctx, nil)
+	if err != nil {
+		return chained.Error(err, "error querying zookeeper for broker registration: ", stderr)
+	}
+	// zookeeper-shell does not set an exit code; if the node exists we will see the broker json
+	if !strings.Contains(stdout, "\"host\"") {
+		return fmt.Errorf("broker not registered in zookeeper at %s", brokerPath)
+	}
+
+	m.lastRegisteredAt = time.Now()
+	return nil
+}
@@ -2,48 +2,26 @@ package kope
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
 	"k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/api/unversioned"
-	"k8s.io/kubernetes/pkg/client/cache"
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
 	kclientcmd "k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
-	"k8s.io/kubernetes/pkg/controller/framework"
-	kcontrollerFramework "k8s.io/kubernetes/pkg/controller/framework"
 	"k8s.io/kubernetes/pkg/fields"
 	"k8s.io/kubernetes/pkg/labels"
-	"k8s.io/kubernetes/pkg/util"
 )
 
 const DefaultKubecfgFile = "/etc/kubernetes/kubeconfig"
 
-const (
-	// Resync period for the kube controller loop.
-	resyncPeriod = 60 * time.Second
-)
-
-type EndpointWatch interface {
-	AddEndpoints(e *api.Endpoints)
-	DeleteEndpoints(e *api.Endpoints)
-	UpdateEndpoints(oldEndpoints, newEndpoints *api.Endpoints)
-}
-
-type ServiceWatch interface {
-	AddService(s *api.Service)
-	DeleteService(s *api.Service)
-	UpdateService(oldService, newService *api.Service)
-}
-
-type SecretWatch interface {
-	AddSecret(s *api.Secret)
-	DeleteSecret(s *api.Secret)
-	UpdateSecret(oldSecret, newSecret *api.Secret)
-}
+// The namespace of the service account is mounted into every pod (unless automounting is disabled)
+const serviceAccountNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 
 type Kubernetes struct {
 	kubeClient *kclient.Client
@@ -150,145 +128,31 @@ func NewKubernetesClient() (*Kubernetes, error) {
 	return k, nil
 }
 
-func (k *Kubernetes) WatchEndpoints(watcher EndpointWatch) {
-	glog.Info("Starting watch on k8s endpoints")
-
-	// Watch all changes
-	// TODO: filter
-	lw := cache.NewListWatchFromClient(k.kubeClient, "endpoints", api.NamespaceAll, fields.Everything())
-
-	var controller *kcontrollerFramework.Controller
-	_, controller = framework.NewInformer(
-		lw,
-		&api.Endpoints{},
-		resyncPeriod,
-		framework.ResourceEventHandlerFuncs{
-			AddFunc: func(o interface{}) {
-				e, ok := o.(*api.Endpoints)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Endpoints", o)
-				} else {
-					watcher.AddEndpoints(e)
-				}
-			},
-			DeleteFunc: func(o interface{}) {
-				e, ok := o.(*api.Endpoints)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Endpoints", o)
-				} else {
-					watcher.DeleteEndpoints(e)
-				}
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				oldE, ok := oldObj.(*api.Endpoints)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Endpoints", oldObj)
-				}
-				newE, ok := newObj.(*api.Endpoints)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Endpoints", newObj)
-				}
-
-				watcher.UpdateEndpoints(oldE, newE)
-			},
-		},
-	)
-	controller.Run(util.NeverStop)
-}
-
-func (k *Kubernetes) WatchServices(watcher ServiceWatch) {
-	glog.Info("Starting watch on k8s services")
-
-	// Watch all changes
-	// TODO: filter
-	lw := cache.NewListWatchFromClient(k.kubeClient, "services", api.NamespaceAll, fields.Everything())
-
-	var controller *kcontrollerFramework.Controller
-	_, controller = framework.NewInformer(
-		lw,
-		&api.Service{},
-		resyncPeriod,
-		framework.ResourceEventHandlerFuncs{
-			AddFunc: func(o interface{}) {
-				e, ok := o.(*api.Service)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Service", o)
-				} else {
-					watcher.AddService(e)
-				}
-			},
-			DeleteFunc: func(o interface{}) {
-				e, ok := o.(*api.Service)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Service", o)
-				} else {
-					watcher.DeleteService(e)
-				}
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				oldE, ok := oldObj.(*api.Service)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Service", oldObj)
-				}
-				newE, ok := newObj.(*api.Service)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Service", newObj)
-				}
-
-				watcher.UpdateService(oldE, newE)
-			},
-		},
-	)
-	controller.Run(util.NeverStop)
-}
-
-func (k *Kubernetes) WatchSecrets(watcher SecretWatch) {
-	glog.Info("Starting watch on k8s secrets")
-
-	// Watch all changes
-	// TODO: filter
-	lw := cache.NewListWatchFromClient(k.kubeClient, "secrets", api.NamespaceAll, fields.Everything())
-
-	var controller *kcontrollerFramework.Controller
-	_, controller = framework.NewInformer(
-		lw,
-		&api.Secret{},
-		resyncPeriod,
-		framework.ResourceEventHandlerFuncs{
-			AddFunc: func(o interface{}) {
-				e, ok := o.(*api.Secret)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Secret", o)
-				} else {
-					watcher.AddSecret(e)
-				}
-			},
-			DeleteFunc: func(o interface{}) {
-				e, ok := o.(*api.Secret)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Secret", o)
-				} else {
-					watcher.DeleteSecret(e)
-				}
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				oldE, ok := oldObj.(*api.Secret)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Secret", oldObj)
-				}
-				newE, ok := newObj.(*api.Secret)
-				if !ok {
-					glog.Warning("Got unexpected object of type %T, expecting Secret", newObj)
-				}
-
-				watcher.UpdateSecret(oldE, newE)
-			},
-		},
-	)
-	controller.Run(util.NeverStop)
-}
-
+// FindSelfPodIP finds the IP address of the pod.  The candidates are the (non-loopback, non-link-local) addresses
+// of our interfaces, which can be restricted with POD_IP_INTERFACE and POD_IP_CIDR.  If POD_IP is set (from the downward API)
+// and matches a candidate, we use it; otherwise we prefer IPv4 over IPv6.
 func FindSelfPodIP() (net.IP, error) {
+	interfaceName := os.Getenv("POD_IP_INTERFACE")
+
+	var cidr *net.IPNet
+	cidrString := os.Getenv("POD_IP_CIDR")
+	if cidrString != "" {
+		var err error
+		_, cidr, err = net.ParseCIDR(cidrString)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing POD_IP_CIDR %q: %v", cidrString, err)
+		}
+	}
+
+	var podIP net.IP
+	podIPString := os.Getenv("POD_IP")
+	if podIPString != "" {
+		podIP = net.ParseIP(podIPString)
+		if podIP == nil {
+			return nil, fmt.Errorf("error parsing POD_IP %q", podIPString)
+		}
+	}
+
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
@@ -301,6 +165,9 @@ func FindSelfPodIP() (net.IP, error) {
 		if iface.Flags&net.FlagLoopback != 0 {
 			continue // loopback interface
 		}
+		if interfaceName != "" && iface.Name != interfaceName {
+			continue
+		}
 
 		addrs, err := iface.Addrs()
 		if err != nil {
@@ -319,40 +186,57 @@ func FindSelfPodIP() (net.IP, error) {
 			if ip == nil || ip.IsLoopback() {
 				continue
 			}
-			ip = ip.To4()
-			if ip == nil {
-				continue // not an ipv4 address
+			if ip.IsLinkLocalUnicast() {
+				continue // every IPv6 interface has one; they aren't reachable from other pods
+			}
+			if cidr != nil && !cidr.Contains(ip) {
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
 			}
 			ips = append(ips, ip)
 		}
 	}
 
+	if podIP != nil {
+		for _, ip := range ips {
+			if ip.Equal(podIP) {
+				return ip, nil
+			}
+		}
+		glog.Warningf("POD_IP %s did not match any local IP: %v", podIP, ips)
+	}
+
 	if len(ips) == 0 {
 		return nil, nil
 	}
 
+	var ipv4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		}
+	}
+	if len(ipv4) != 0 {
+		ips = ipv4
+	}
+
 	if len(ips) > 1 {
-		glog.Warning("Found multiple local IPs, making arbitrary choice: ", ips)
+		glog.Warning("Found multiple local IPs, making arbitrary choice (set POD_IP, POD_IP_INTERFACE or POD_IP_CIDR to choose): ", ips)
 	}
 	return ips[0], nil
 }
 
-// Gets the pod that we are running in; returns an error if it cannot be found
+// GetSelfPod finds the pod we are running in.  We prefer the POD_NAME / POD_NAMESPACE env vars (from the downward API),
+// then the hostname and the namespace of our service account, and only fall back to scanning every pod for our IP.
 func (k *Kubernetes) GetSelfPod() (*api.Pod, error) {
 	glog.Info("Querying kubernetes for self-pod")
 
-	podIP, err := FindSelfPodIP()
-	if err != nil {
-		return nil, err
-	}
-	if podIP == nil {
-		return nil, fmt.Errorf("cannot determine pod ip")
-	}
-
 	// We wait and retry in case of a delay before the pod is sent to the API
 	attempt := 0
 	for {
-		pod, err := k.FindPodByPodIp(podIP.String())
+		pod, err := k.findSelfPod()
 		if err != nil {
 			return nil, err
 		}
@@ -360,6 +244,7 @@ func (k *Kubernetes) GetSelfPod() (*api.Pod, error) {
 			return pod, nil
 		}
 
+		attempt++
 		if attempt > 10 {
 			return nil, fmt.Errorf("could not find self-pod in kubernetes API")
 		}
@@ -369,20 +254,82 @@ func (k *Kubernetes) GetSelfPod() (*api.Pod, error) {
 	}
 }
 
-func (k *Kubernetes) FindSecret(namespace string, name string) (*api.Secret, error) {
-	secret, err := k.kubeClient.Secrets(namespace).Get(name)
+func (k *Kubernetes) findSelfPod() (*api.Pod, error) {
+	podName := os.Getenv("POD_NAME")
+	podNamespace := os.Getenv("POD_NAMESPACE")
+	if podNamespace == "" {
+		namespace, err := readServiceAccountNamespace()
+		if err != nil {
+			return nil, err
+		}
+		podNamespace = namespace
+	}
+
+	if podName != "" && podNamespace != "" {
+		glog.V(2).Infof("Looking for self-pod using POD_NAME: %s/%s", podNamespace, podName)
+		return k.FindPod(podNamespace, podName)
+	}
+
+	podIP, err := FindSelfPodIP()
 	if err != nil {
+		return nil, err
+	}
 
-		apiStatusErr, ok := err.(kclient.APIStatus)
-		if ok {
-			status := apiStatusErr.Status()
-			if status.Reason == unversioned.StatusReasonNotFound {
-				return nil, nil
+	if podNamespace != "" {
+		// The hostname is the pod name, unless the pod sets spec.hostname
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("error getting hostname: %v", err)
+		}
+		glog.V(2).Infof("Looking for self-pod using hostname: %s/%s", podNamespace, hostname)
+		pod, err := k.FindPod(podNamespace, hostname)
+		if err != nil {
+			return nil, err
+		}
+		if pod != nil {
+			if podIP == nil || pod.Status.PodIP == "" || pod.Status.PodIP == podIP.String() {
+				return pod, nil
 			}
+			glog.V(2).Infof("Pod %s/%s has IP %s, not our IP %s; ignoring", podNamespace, hostname, pod.Status.PodIP, podIP)
+		}
+	}
+
+	if podIP == nil {
+		return nil, fmt.Errorf("cannot determine pod ip")
+	}
+	return k.FindPodByPodIp(podIP.String())
+}
 
-			glog.V(2).Info("got APIStatus err: ", status)
+// readServiceAccountNamespace returns the namespace of our service account, or "" if it is not mounted
+func readServiceAccountNamespace() (string, error) {
+	b, err := ioutil.ReadFile(serviceAccountNamespacePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
 		}
+		return "", fmt.Errorf("error reading %s: %v", serviceAccountNamespacePath, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
 
+// FindPod returns the pod with the given name, or nil if it does not exist
+func (k *Kubernetes) FindPod(namespace string, name string) (*api.Pod, error) {
+	pod, err := k.kubeClient.Pods(namespace).Get(name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return pod, nil
+}
+
+func (k *Kubernetes) FindSecret(namespace string, name string) (*api.Secret, error) {
+	secret, err := k.kubeClient.Secrets(namespace).Get(name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
 		return nil, err
 	}
 	return secret, nil
@@ -393,9 +340,121 @@ func (k *Kubernetes) CreateSecret(secret *api.Secret) (*api.Secret, error) {
 	return secret, err
 }
 
+// UpdateSecret replaces the secret; it fails with a conflict if the secret has changed since secret.ResourceVersion
+func (k *Kubernetes) UpdateSecret(secret *api.Secret) (*api.Secret, error) {
+	secret, err := k.kubeClient.Secrets(secret.Namespace).Update(secret)
+	return secret, err
+}
+
+func (k *Kubernetes) DeleteSecret(namespace string, name string) error {
+	return k.kubeClient.Secrets(namespace).Delete(name)
+}
+
+// FindEndpoints returns the Endpoints with the given name, or nil if they do not exist
+func (k *Kubernetes) FindEndpoints(namespace string, name string) (*api.Endpoints, error) {
+	endpoints, err := k.kubeClient.Endpoints(namespace).Get(name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+func (k *Kubernetes) CreateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error) {
+	return k.kubeClient.Endpoints(endpoints.Namespace).Create(endpoints)
+}
+
+// UpdateEndpoints replaces the Endpoints; it fails with a conflict if they have changed since endpoints.ResourceVersion
+func (k *Kubernetes) UpdateEndpoints(endpoints *api.Endpoints) (*api.Endpoints, error) {
+	return k.kubeClient.Endpoints(endpoints.Namespace).Update(endpoints)
+}
+
+func (k *Kubernetes) CreateEvent(event *api.Event) (*api.Event, error) {
+	return k.kubeClient.Events(event.Namespace).Create(event)
+}
+
+func (k *Kubernetes) ListPods(namespace string, selector labels.Selector) ([]*api.Pod, error) {
+	list, err := k.kubeClient.Pods(namespace).List(selector, fields.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var pods []*api.Pod
+	for i := range list.Items {
+		pods = append(pods, &list.Items[i])
+	}
+	return pods, nil
+}
+
+// FindPersistentVolumeClaim returns the PVC with the given name, or nil if it does not exist
+func (k *Kubernetes) FindPersistentVolumeClaim(namespace string, name string) (*api.PersistentVolumeClaim, error) {
+	pvc, err := k.kubeClient.PersistentVolumeClaims(namespace).Get(name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return pvc, nil
+}
+
+func (k *Kubernetes) ListPersistentVolumeClaims(namespace string, selector labels.Selector) ([]*api.PersistentVolumeClaim, error) {
+	list, err := k.kubeClient.PersistentVolumeClaims(namespace).List(selector, fields.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var pvcs []*api.PersistentVolumeClaim
+	for i := range list.Items {
+		pvcs = append(pvcs, &list.Items[i])
+	}
+	return pvcs, nil
+}
+
+// FindPersistentVolume returns the PV with the given name, or nil if it does not exist
+func (k *Kubernetes) FindPersistentVolume(name string) (*api.PersistentVolume, error) {
+	pv, err := k.kubeClient.PersistentVolumes().Get(name)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return pv, nil
+}
+
+// isNotFound returns true if the error is the API server telling us the object does not exist
+func isNotFound(err error) bool {
+	return hasStatusReason(err, unversioned.StatusReasonNotFound)
+}
+
+// isConflict returns true if the error is the API server telling us the object changed underneath us
+func isConflict(err error) bool {
+	return hasStatusReason(err, unversioned.StatusReasonConflict)
+}
+
+// isAlreadyExists returns true if the error is the API server telling us we tried to create an object that exists
+func isAlreadyExists(err error) bool {
+	return hasStatusReason(err, unversioned.StatusReasonAlreadyExists)
+}
+
+func hasStatusReason(err error, reason unversioned.StatusReason) bool {
+	apiStatusErr, ok := err.(kclient.APIStatus)
+	if ok {
+		status := apiStatusErr.Status()
+		if status.Reason == reason {
+			return true
+		}
+
+		glog.V(2).Info("got APIStatus err: ", status)
+	}
+	return false
+}
+
+// FindPodByPodIp lists every pod to find the one with the given IP; this is slow on a large cluster,
+// and needs permission to list pods in every namespace, so it is only our last resort.
 func (k *Kubernetes) FindPodByPodIp(podIP string) (*api.Pod, error) {
-	// TODO: make this efficient
-	glog.Warningf("Querying kubernetes for pod by podIP is inefficient %q", podIP)
+	glog.Warningf("Querying kubernetes for pod by podIP is inefficient %q; set POD_NAME and POD_NAMESPACE using the downward API", podIP)
 
 	// TODO: Can we use api.NamespaceAll,?
 	pods, err := k.kubeClient.Pods(api.NamespaceAll).List(labels.Everything(), fields.Everything())
@@ -434,80 +493,8 @@ func (k *Kubernetes) FindPodByPodIp(podIP string) (*api.Pod, error) {
 	return nil, nil
 }
 
-// TODO: Return map of ClusterMember (PV/PVC/Pod)?
-func (k *KopePod) GetClusterMap(clusterID string) (map[string]*KopePod, error) {
-	namespace := k.Pod.Namespace
-
-	//	pvs, err := k.KubernetesClient.kubeClient.PersistentVolumes().List(labels.NewRequirement("kope.io/clusterid", labels.InOperator, util.NewStringSet(clusterID)), fields.Everything())
-	//	if err != nil {
-	//		return nil, err
-	//	}
-
-	filter := labels.Everything().Add("kope.io/clusterid", labels.InOperator, []string{clusterID})
-	pvcs, err := k.KubernetesClient.kubeClient.PersistentVolumeClaims(namespace).List(filter, fields.Everything())
-	if err != nil {
-		return nil, err
-	}
-
-	pods, err := k.KubernetesClient.kubeClient.Pods(namespace).List(filter, fields.Everything())
-	if err != nil {
-		return nil, err
-	}
-
-	//	pvMap := map[string]string{}
-	//	for i := range pvs.Items {
-	//		pv := &pvs.Items[i]
-	//		nodeID := pv.Labels["kope.io/nodeid"]
-	//		if nodeID == "" {
-	//			continue
-	//		}
-	//		pvMap[pv.Name] = nodeID
-	//	}
-
-	clusterPods := map[string]*KopePod{}
-
-	pvcMap := map[string]string{}
-	for i := range pvcs.Items {
-		pvc := &pvcs.Items[i]
-		glog.Info("PVC", pvc)
-		nodeID := pvc.Labels["kope.io/nodeid"]
-		//		if nodeID == "" {
-		//			if pvc.Spec.VolumeName != "" {
-		//				nodeID, _ = pvMap[pvc.Spec.VolumeName]
-		//			}
-		//		}
-		if nodeID == "" {
-			continue
-		}
-		pvcMap[pvc.Name] = nodeID
-
-		// If the pod is not found, we still want the cluster map to record the nodeid
-		clusterPods[nodeID] = nil
-	}
-
-	for i := range pods.Items {
-		pod := &pods.Items[i]
-		glog.Info("POD", pod)
-		for j := range pod.Spec.Volumes {
-			volume := &pod.Spec.Volumes[j]
-			if volume.PersistentVolumeClaim != nil {
-				pvcName := volume.PersistentVolumeClaim.ClaimName
-				nodeId, _ := pvcMap[pvcName]
-				if nodeId != "" {
-					kopePod := &KopePod{}
-					kopePod.Pod = pod
-					kopePod.KubernetesClient = k.KubernetesClient
-					clusterPods[nodeId] = kopePod
-				}
-			}
-		}
-	}
-
-	return clusterPods, nil
-}
-
 type KopePod struct {
-	KubernetesClient *Kubernetes
+	KubernetesClient Client
 	Pod              *api.Pod
 
 	volumes []*KopeVolume
@@ -531,11 +518,30 @@ func (p *KopePod) MemoryLimit() (int64, bool) {
 	return 0, false
 }
 
-func (p*KopePod) Label(key string) (string, bool) {
+// CPULimit returns the CPU limit of the container, in cores (possibly fractional)
+func (p *KopePod) CPULimit() (float64, bool) {
+	if p.Pod != nil {
+		// Kubernetes
+		if len(p.Pod.Spec.Containers) > 1 {
+			glog.Warning("Found multiple containers in pod, choosing arbitrarily")
+		}
+		cpuLimit := p.Pod.Spec.Containers[0].Resources.Limits.Cpu()
+		if cpuLimit != nil {
+			milliCPU := cpuLimit.MilliValue()
+			if milliCPU > 0 {
+				return float64(milliCPU) / 1000, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func (p *KopePod) Label(key string) (string, bool) {
 	if p.Pod != nil {
 		// Kubernetes
 		labels := p.Pod.Labels
-		v, found :=  labels["kope.io/" + key]
+		v, found := labels["kope.io/"+key]
 		return v, found
 	}
 
@@ -568,14 +574,14 @@ type KopeVolume struct {
 }
 
 func (v *KopeVolume) GetPersistentVolumeClaim() (*api.PersistentVolumeClaim, error) {
-	client := v.pod.KubernetesClient.kubeClient
+	client := v.pod.KubernetesClient
 
 	pvc := v.pvc
 	if pvc == nil {
 		var err error
 		if v.volume.PersistentVolumeClaim != nil {
 			claimName := v.volume.PersistentVolumeClaim.ClaimName
-			pvc, err = client.PersistentVolumeClaims(v.pod.Pod.Namespace).Get(claimName)
+			pvc, err = client.FindPersistentVolumeClaim(v.pod.Pod.Namespace, claimName)
 			if err != nil {
 				return nil, err
 			}
@@ -586,7 +592,7 @@ func (v *KopeVolume) GetPersistentVolumeClaim() (*api.PersistentVolumeClaim, err
 }
 
 func (v *KopeVolume) GetPersistentVolume() (*api.PersistentVolume, error) {
-	client := v.pod.KubernetesClient.kubeClient
+	client := v.pod.KubernetesClient
 
 	pv := v.pv
 	if pv == nil {
@@ -595,8 +601,8 @@ func (v *KopeVolume) GetPersistentVolume() (*api.PersistentVolume, error) {
 			return nil, err
 		}
 
-		if pvc.Spec.VolumeName != "" {
-			pv, err = client.PersistentVolumes().Get(pvc.Spec.VolumeName)
+		if pvc != nil && pvc.Spec.VolumeName != "" {
+			pv, err = client.FindPersistentVolume(pvc.Spec.VolumeName)
 			if err != nil {
 				return nil, err
 			}
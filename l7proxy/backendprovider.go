@@ -11,6 +11,12 @@ type Backend struct {
 	Endpoint string
 }
 
+// ReadinessChecker is implemented by a BackendProvider that is not ready to serve immediately
+type ReadinessChecker interface {
+	// Ready returns nil if we are ready to serve, or an error describing why not
+	Ready() error
+}
+
 type BackendIdList []string
 
 func (b BackendIdList) Contains(s string) bool {
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"flag"
 	"math/rand"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -14,10 +15,22 @@ func main() {
 	//runtime.GOMAXPROCS(runtime.NumCPU())
 	rand.Seed(time.Now().UTC().UnixNano())
 
+	var namespaces string
+	flag.StringVar(&namespaces, "namespaces", "", "comma-separated list of namespaces to watch (default all)")
+	backendOptions := &l7proxy.KubernetesBackendOptions{}
+	flag.StringVar(&backendOptions.ServiceSelector, "service-selector", "", "label selector for the services to proxy to")
+	flag.StringVar(&backendOptions.SecretSelector, "secret-selector", "", "label selector for the TLS secrets to serve (e.g. kope.io/tls=true)")
+	flag.DurationVar(&backendOptions.SyncTimeout, "sync-timeout", 60*time.Second, "how long to wait for the initial sync with kubernetes before reporting ready anyway (0 to wait indefinitely)")
+	waitForSync := flag.Bool("wait-for-sync", false, "don't listen for HTTP/HTTPS until the initial sync with kubernetes completes (or the sync-timeout expires)")
+
 	flag.Parse()
 
+	if namespaces != "" {
+		backendOptions.Namespaces = strings.Split(namespaces, ",")
+	}
+
 	//backendProvider := l7proxy.NewDummyBackendProvider()
-	backendProvider, err := l7proxy.NewKubernetesBackendProvider()
+	backendProvider, err := l7proxy.NewKubernetesBackendProvider(backendOptions)
 	if err != nil {
 		glog.Fatalf("error initializing kubernetes backend provider: %v", err)
 	}
@@ -29,10 +42,20 @@ func main() {
 
 	httpListener := l7proxy.NewHTTPListener(":80", handler)
 	httpsListener := l7proxy.NewHTTPSListener(":443", handler, tlsConfig)
+	adminListener := l7proxy.NewHTTPListener(":8901", l7proxy.NewAdminHandler(backendProvider))
+
+	if *waitForSync {
+		waitFunc := func() {
+			backendProvider.WaitForSync()
+		}
+		httpListener.WaitFor(waitFunc)
+		httpsListener.WaitFor(waitFunc)
+	}
 
 	proxy := l7proxy.NewProxyServer()
 	proxy.AddListener(httpListener)
 	proxy.AddListener(httpsListener)
+	proxy.AddListener(adminListener)
 
 	err = proxy.ListenAndServe()
 	if err != nil {
@@ -57,15 +57,20 @@ func (h *ProxyingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w}
+
 	proxiedRequest := &proxiedRequest{
 		maxAttempts:     maxBackendAttempts,
-		response:        w,
+		response:        recorder,
 		request:         r,
 		transport:       h.transport,
 		backendProvider: h.backendProvider,
 	}
 
 	proxiedRequest.ServeHTTP()
+
+	recordRequest(proxiedRequest.metricsHost, recorder.status, start)
 }
 
 type proxiedRequest struct {
@@ -75,6 +80,9 @@ type proxiedRequest struct {
 	backendProvider BackendProvider
 
 	maxAttempts int
+
+	// The host we report in metrics; only set once we know the host is one we serve
+	metricsHost string
 }
 
 func (p *proxiedRequest) ServeHTTP() {
@@ -149,6 +157,9 @@ func (p *proxiedRequest) RoundTrip(request *http.Request) (*http.Response, error
 			return nil, fmt.Errorf("no healthy backends")
 		}
 
+		p.metricsHost = host
+		backendSelectionsTotal.WithLabelValues(host, backend.Endpoint).Inc()
+
 		request.URL.Host = backend.Endpoint
 		if bufferedBody != nil {
 			_, err := bufferedBody.Seek(0, 0)
@@ -174,6 +185,7 @@ func (p *proxiedRequest) RoundTrip(request *http.Request) (*http.Response, error
 		}
 
 		glog.V(2).Info("will retry after retryable error: ", err)
+		retriesTotal.WithLabelValues(host).Inc()
 
 		skip = append(skip, backend.Id)
 	}
@@ -9,11 +9,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/kopeio/kope"
 	"github.com/kopeio/kope/chained"
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/labels"
 )
 
 type CertificateProvider interface {
@@ -26,15 +28,76 @@ type KubernetesBackendProvider struct {
 
 var _ BackendProvider = &KubernetesBackendProvider{}
 
-func NewKubernetesBackendProvider() (*KubernetesBackendProvider, error) {
+// KubernetesBackendOptions restricts what we watch in kubernetes
+type KubernetesBackendOptions struct {
+	// Namespaces to watch; if empty we watch all namespaces
+	Namespaces []string
+	// ServiceSelector is a label selector for the services (and their endpoints) we proxy to
+	ServiceSelector string
+	// SecretSelector is a label selector for the TLS secrets we serve (e.g. kope.io/tls=true)
+	SecretSelector string
+	// SyncTimeout is how long we wait for the initial sync of our watches before we report ready anyway;
+	// if 0 we wait indefinitely
+	SyncTimeout time.Duration
+	// Client is the kubernetes client to use; if nil we connect to the API server
+	Client kope.Client
+}
+
+func NewKubernetesBackendProvider(options *KubernetesBackendOptions) (*KubernetesBackendProvider, error) {
 	k := &KubernetesBackendProvider{}
-	err := k.registry.init()
+	if options == nil {
+		options = &KubernetesBackendOptions{}
+	}
+	err := k.registry.init(options)
 	if err != nil {
 		return nil, chained.Error(err, "error initializing kubernetes registry")
 	}
 	return k, nil
 }
 
+// Stop stops watching kubernetes
+func (b *KubernetesBackendProvider) Stop() {
+	b.registry.stop()
+}
+
+// HasSynced returns true once we have the initial state of the endpoints, services and secrets
+func (b *KubernetesBackendProvider) HasSynced() bool {
+	return b.registry.hasSynced()
+}
+
+// WaitForSync blocks until HasSynced, or the SyncTimeout expires; it returns HasSynced
+func (b *KubernetesBackendProvider) WaitForSync() bool {
+	r := &b.registry
+	for _, w := range r.watches {
+		remaining := time.Duration(0)
+		if r.syncTimeout != 0 {
+			remaining = r.syncDeadline.Sub(time.Now())
+			if remaining <= 0 {
+				break
+			}
+		}
+		w.WaitForSync(remaining)
+	}
+
+	synced := r.hasSynced()
+	if !synced {
+		glog.Warningf("kubernetes watches did not sync within %v; continuing anyway", r.syncTimeout)
+	}
+	return synced
+}
+
+// Ready returns nil once we have synced, or once the SyncTimeout has expired (so that a stuck watch doesn't stop us serving)
+func (b *KubernetesBackendProvider) Ready() error {
+	r := &b.registry
+	if r.hasSynced() {
+		return nil
+	}
+	if r.syncTimeout != 0 && time.Now().After(r.syncDeadline) {
+		return nil
+	}
+	return fmt.Errorf("kubernetes watches have not yet synced")
+}
+
 func (b *KubernetesBackendProvider) PickBackend(r *http.Request, host string, backendCookie string, skip BackendIdList) *Backend {
 	if host == "" {
 		// TODO: Default site?
@@ -315,8 +378,14 @@ func (s *backendDataStore) findSecretByCN(cn string) *secretData {
 type kubernetesRegistry struct {
 	//	mutex sync.Mutex
 
-	k8s  *kope.Kubernetes
+	k8s  kope.Client
 	data backendDataStore
+
+	stopCh  chan struct{}
+	watches []kope.Watcher
+
+	syncTimeout  time.Duration
+	syncDeadline time.Time
 }
 
 func sliceBackendsEqual(l, r []Backend) bool {
@@ -453,24 +522,63 @@ func (r *kubernetesRegistry) UpdateSecret(old, s *api.Secret) {
 	r.data.updateSecret(s.Namespace, s.Name, s)
 }
 
-func (r *kubernetesRegistry) init() error {
+func (r *kubernetesRegistry) init(options *KubernetesBackendOptions) error {
 	r.data.init()
+	r.stopCh = make(chan struct{})
+	r.syncTimeout = options.SyncTimeout
+	r.syncDeadline = time.Now().Add(options.SyncTimeout)
 
-	k8s, err := kope.NewKubernetesClient()
+	serviceSelector, err := labels.Parse(options.ServiceSelector)
+	if err != nil {
+		return fmt.Errorf("error parsing service selector %q: %v", options.ServiceSelector, err)
+	}
+	secretSelector, err := labels.Parse(options.SecretSelector)
 	if err != nil {
-		return fmt.Errorf("error connecting to kubernetes: %v", err)
+		return fmt.Errorf("error parsing secret selector %q: %v", options.SecretSelector, err)
 	}
-	r.k8s = k8s
+
+	r.k8s = options.Client
+	if r.k8s == nil {
+		k8s, err := kope.NewKubernetesClient()
+		if err != nil {
+			return fmt.Errorf("error connecting to kubernetes: %v", err)
+		}
+		r.k8s = k8s
+	}
+
+	// Endpoints have the same labels as their service
+	serviceOptions := &kope.WatchOptions{}
+	serviceOptions.Namespaces = options.Namespaces
+	serviceOptions.LabelSelector = serviceSelector
+	serviceOptions.StopCh = r.stopCh
+
+	secretOptions := &kope.WatchOptions{}
+	secretOptions.Namespaces = options.Namespaces
+	secretOptions.LabelSelector = secretSelector
+	secretOptions.StopCh = r.stopCh
 
 	// TODO: Error handling here
 	// TODO: We don't really _need_ services; we could look for a tag on an RC
-	go r.k8s.WatchEndpoints(r)
-	go r.k8s.WatchServices(r)
-	go r.k8s.WatchSecrets(r)
+	r.watches = append(r.watches, kope.WatchEndpoints(r.k8s, r, serviceOptions))
+	r.watches = append(r.watches, kope.WatchServices(r.k8s, r, serviceOptions))
+	r.watches = append(r.watches, kope.WatchSecrets(r.k8s, r, secretOptions))
 
 	return nil
 }
 
+func (r *kubernetesRegistry) hasSynced() bool {
+	for _, w := range r.watches {
+		if !w.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *kubernetesRegistry) stop() {
+	close(r.stopCh)
+}
+
 func (s *secretData) GetCertificate() (*tls.Certificate, error) {
 	// TODO: Just use mutex to avoid repeated parsing??
 	if s.CertRaw == nil || s.KeyRaw == nil {
@@ -0,0 +1,291 @@
+package l7proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/types"
+
+	"github.com/kopeio/kope/fake"
+)
+
+func buildService(namespace, name string, host string) *api.Service {
+	service := &api.Service{}
+	service.Namespace = namespace
+	service.Name = name
+	service.Labels = map[string]string{"app": name}
+	if host != "" {
+		service.Annotations = map[string]string{"http.host": host}
+	}
+	return service
+}
+
+func buildEndpoints(namespace, name string, ports []api.EndpointPort, ips ...string) *api.Endpoints {
+	endpoints := &api.Endpoints{}
+	endpoints.Namespace = namespace
+	endpoints.Name = name
+	endpoints.Labels = map[string]string{"app": name}
+	subset := api.EndpointSubset{}
+	subset.Ports = ports
+	for _, ip := range ips {
+		address := api.EndpointAddress{IP: ip}
+		address.TargetRef = &api.ObjectReference{UID: types.UID("pod-" + ip)}
+		subset.Addresses = append(subset.Addresses, address)
+	}
+	endpoints.Subsets = []api.EndpointSubset{subset}
+	return endpoints
+}
+
+// newTestProvider builds a provider against the fake client; the caller must Stop it
+func newTestProvider(t *testing.T, client *fake.Client, options *KubernetesBackendOptions) *KubernetesBackendProvider {
+	options.Client = client
+	provider, err := NewKubernetesBackendProvider(options)
+	if err != nil {
+		t.Fatalf("error building provider: %v", err)
+	}
+	if !provider.HasSynced() || provider.Ready() != nil {
+		t.Fatalf("expected provider to be synced against the fake client")
+	}
+	return provider
+}
+
+func TestBuildBackends(t *testing.T) {
+	grid := []struct {
+		Name     string
+		Ports    []api.EndpointPort
+		Expected []Backend
+	}{
+		{
+			Name:     "single port",
+			Ports:    []api.EndpointPort{{Name: "web", Port: 8080}},
+			Expected: []Backend{{Id: "pod-10.0.0.1", Endpoint: "10.0.0.1:8080"}, {Id: "pod-10.0.0.2", Endpoint: "10.0.0.2:8080"}},
+		},
+		{
+			Name:     "http port",
+			Ports:    []api.EndpointPort{{Name: "metrics", Port: 9090}, {Name: "http", Port: 80}, {Name: "http-server", Port: 8000}},
+			Expected: []Backend{{Id: "pod-10.0.0.1", Endpoint: "10.0.0.1:80"}, {Id: "pod-10.0.0.2", Endpoint: "10.0.0.2:80"}},
+		},
+		{
+			Name:     "http-server port",
+			Ports:    []api.EndpointPort{{Name: "metrics", Port: 9090}, {Name: "http-server", Port: 8000}},
+			Expected: []Backend{{Id: "pod-10.0.0.1", Endpoint: "10.0.0.1:8000"}, {Id: "pod-10.0.0.2", Endpoint: "10.0.0.2:8000"}},
+		},
+		{
+			Name:     "no http port",
+			Ports:    []api.EndpointPort{{Name: "metrics", Port: 9090}, {Name: "grpc", Port: 9000}},
+			Expected: nil,
+		},
+	}
+	for _, g := range grid {
+		actual := buildBackends(buildEndpoints("default", "web", g.Ports, "10.0.0.1", "10.0.0.2"))
+		if !reflect.DeepEqual(actual, g.Expected) {
+			t.Errorf("%s: backends were %v, expected %v", g.Name, actual, g.Expected)
+		}
+	}
+
+	if buildBackends(nil) != nil {
+		t.Errorf("expected no backends for nil endpoints")
+	}
+}
+
+func TestPickBackend(t *testing.T) {
+	client := fake.NewClient()
+	ports := []api.EndpointPort{{Port: 8080}}
+	client.Add(buildService("default", "web", "www.example.com"))
+	client.Add(buildEndpoints("default", "web", ports, "10.0.0.1", "10.0.0.2"))
+
+	provider := newTestProvider(t, client, &KubernetesBackendOptions{})
+	defer provider.Stop()
+
+	if provider.PickBackend(nil, "", "", nil) != nil {
+		t.Errorf("expected no backend without a host")
+	}
+	if provider.PickBackend(nil, "other.example.com", "", nil) != nil {
+		t.Errorf("expected no backend for unknown host")
+	}
+
+	grid := []struct {
+		Name     string
+		Cookie   string
+		Skip     BackendIdList
+		Expected []string
+	}{
+		{"any", "", nil, []string{"pod-10.0.0.1", "pod-10.0.0.2"}},
+		{"cookie", "pod-10.0.0.2", nil, []string{"pod-10.0.0.2"}},
+		{"unknown cookie", "pod-10.0.0.9", nil, []string{"pod-10.0.0.1", "pod-10.0.0.2"}},
+		{"skip", "", BackendIdList{"pod-10.0.0.1"}, []string{"pod-10.0.0.2"}},
+		{"cookie skipped", "pod-10.0.0.1", BackendIdList{"pod-10.0.0.1"}, []string{"pod-10.0.0.2"}},
+		{"all skipped", "", BackendIdList{"pod-10.0.0.1", "pod-10.0.0.2"}, nil},
+	}
+	for _, g := range grid {
+		// Picking is random, so we try a few times
+		for i := 0; i < 10; i++ {
+			backend := provider.PickBackend(nil, "www.example.com", g.Cookie, g.Skip)
+			if backend == nil {
+				if g.Expected != nil {
+					t.Errorf("%s: no backend picked, expected one of %v", g.Name, g.Expected)
+				}
+				break
+			}
+			if !BackendIdList(g.Expected).Contains(backend.Id) {
+				t.Errorf("%s: picked %v, expected one of %v", g.Name, backend, g.Expected)
+				break
+			}
+		}
+	}
+}
+
+func TestBackendChanges(t *testing.T) {
+	client := fake.NewClient()
+	ports := []api.EndpointPort{{Port: 8080}}
+	service := buildService("default", "web", "www.example.com")
+	client.Add(service)
+
+	provider := newTestProvider(t, client, &KubernetesBackendOptions{})
+	if provider.PickBackend(nil, "www.example.com", "", nil) != nil {
+		t.Errorf("expected no backend before the endpoints exist")
+	}
+
+	endpoints := buildEndpoints("default", "web", ports, "10.0.0.1")
+	client.Add(endpoints)
+	backend := provider.PickBackend(nil, "www.example.com", "", nil)
+	if backend == nil || backend.Endpoint != "10.0.0.1:8080" {
+		t.Errorf("picked %v, expected 10.0.0.1:8080", backend)
+	}
+
+	client.Update(buildEndpoints("default", "web", ports, "10.0.0.2"))
+	backend = provider.PickBackend(nil, "www.example.com", "", nil)
+	if backend == nil || backend.Endpoint != "10.0.0.2:8080" {
+		t.Errorf("picked %v after update, expected 10.0.0.2:8080", backend)
+	}
+
+	// Changing the host moves the service
+	client.Update(buildService("default", "web", "web.example.com"))
+	if provider.PickBackend(nil, "www.example.com", "", nil) != nil {
+		t.Errorf("expected no backend for the old host")
+	}
+	if provider.PickBackend(nil, "web.example.com", "", nil) == nil {
+		t.Errorf("expected a backend for the new host")
+	}
+
+	client.Delete(endpoints)
+	if provider.PickBackend(nil, "web.example.com", "", nil) != nil {
+		t.Errorf("expected no backend after the endpoints were deleted")
+	}
+
+	// Once stopped we see no more changes
+	provider.Stop()
+	client.Add(buildEndpoints("default", "web", ports, "10.0.0.3"))
+	if provider.PickBackend(nil, "web.example.com", "", nil) != nil {
+		t.Errorf("expected no changes after stopping")
+	}
+}
+
+func TestWatchSelection(t *testing.T) {
+	client := fake.NewClient()
+	ports := []api.EndpointPort{{Port: 8080}}
+	client.Add(buildService("default", "web", "www.example.com"))
+	client.Add(buildEndpoints("default", "web", ports, "10.0.0.1"))
+	client.Add(buildService("other", "api", "api.example.com"))
+	client.Add(buildEndpoints("other", "api", ports, "10.0.0.2"))
+	client.Add(buildService("default", "admin", "admin.example.com"))
+	client.Add(buildEndpoints("default", "admin", ports, "10.0.0.3"))
+
+	options := &KubernetesBackendOptions{}
+	options.Namespaces = []string{"default"}
+	options.ServiceSelector = "app=web"
+	provider := newTestProvider(t, client, options)
+	defer provider.Stop()
+
+	if provider.PickBackend(nil, "www.example.com", "", nil) == nil {
+		t.Errorf("expected a backend for the selected service")
+	}
+	if provider.PickBackend(nil, "api.example.com", "", nil) != nil {
+		t.Errorf("expected no backend for a service in another namespace")
+	}
+	if provider.PickBackend(nil, "admin.example.com", "", nil) != nil {
+		t.Errorf("expected no backend for a service not matching the selector")
+	}
+}
+
+// buildCertificate builds a self-signed certificate & key for the CN, PEM encoded
+func buildCertificate(t *testing.T, cn string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	template := &x509.Certificate{}
+	template.SerialNumber = big.NewInt(1)
+	template.Subject = pkix.Name{CommonName: cn}
+	template.NotBefore = time.Now()
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error encoding key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM
+}
+
+func TestGetCertificate(t *testing.T) {
+	client := fake.NewClient()
+	for _, cn := range []string{"www.example.com", "*.example.org"} {
+		certPEM, keyPEM := buildCertificate(t, cn)
+		secret := &api.Secret{}
+		secret.Namespace = "default"
+		secret.Name = "tls-" + cn
+		secret.Labels = map[string]string{"kope.io/tls": "true"}
+		secret.Annotations = map[string]string{"cert-cn": cn}
+		secret.Data = map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}
+		client.Add(secret)
+	}
+
+	options := &KubernetesBackendOptions{}
+	options.SecretSelector = "kope.io/tls=true"
+	provider := newTestProvider(t, client, options)
+	defer provider.Stop()
+
+	grid := []struct {
+		ServerName string
+		Expected   string
+	}{
+		{"www.example.com", "www.example.com"},
+		{"WWW.Example.com", "www.example.com"},
+		{"other.example.com", ""},
+		{"www.example.org", "*.example.org"},
+		{"example.org", ""},
+	}
+	for _, g := range grid {
+		cert, err := provider.GetCertificate(&tls.ClientHelloInfo{ServerName: g.ServerName})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.ServerName, err)
+			continue
+		}
+		actual := ""
+		if cert != nil {
+			parsed, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatalf("%s: error parsing certificate: %v", g.ServerName, err)
+			}
+			actual = parsed.Subject.CommonName
+		}
+		if actual != g.Expected {
+			t.Errorf("%s: certificate was for %q, expected %q", g.ServerName, actual, g.Expected)
+		}
+	}
+}
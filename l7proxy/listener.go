@@ -36,9 +36,21 @@ type Listener struct {
 	endpoint  string
 	tlsConfig *tls.Config
 	handler   http.Handler
+
+	waitFor func()
+}
+
+// WaitFor delays listening until the function returns
+func (l *Listener) WaitFor(f func()) {
+	l.waitFor = f
 }
 
 func (l *Listener) listenAndServe() error {
+	if l.waitFor != nil {
+		glog.Info("Waiting before listening on: ", l.endpoint)
+		l.waitFor()
+	}
+
 	s := &http.Server{
 		Addr:    l.endpoint,
 		Handler: l.handler,
@@ -0,0 +1,115 @@
+package l7proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Requests for hosts we don't serve are all counted under this host label,
+// so that arbitrary Host headers can't blow up the number of metrics
+const unknownHost = "unknown"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "l7proxy",
+			Name:      "requests_total",
+			Help:      "Number of requests proxied, by host and status code.",
+		},
+		[]string{"host", "code"},
+	)
+
+	requestLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "l7proxy",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of proxied requests, by host.",
+		},
+		[]string{"host"},
+	)
+
+	retriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "l7proxy",
+			Name:      "retries_total",
+			Help:      "Number of times a request was retried against another backend, by host.",
+		},
+		[]string{"host"},
+	)
+
+	backendSelectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "l7proxy",
+			Name:      "backend_selections_total",
+			Help:      "Number of times each backend was picked, by host and backend endpoint.",
+		},
+		[]string{"host", "backend"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+	prometheus.MustRegister(requestLatency)
+	prometheus.MustRegister(retriesTotal)
+	prometheus.MustRegister(backendSelectionsTotal)
+}
+
+// NewAdminHandler returns the handler for the admin endpoint, which serves /metrics
+func NewAdminHandler(readiness ReadinessChecker) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if readiness != nil {
+			err := readiness.Ready()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// statusRecorder is a ResponseWriter that remembers the status code
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush is needed because the ReverseProxy flushes periodically
+func (r *statusRecorder) Flush() {
+	flusher, ok := r.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func recordRequest(host string, status int, start time.Time) {
+	if host == "" {
+		host = unknownHost
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	requestsTotal.WithLabelValues(host, strconv.Itoa(status)).Inc()
+	requestLatency.WithLabelValues(host).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,327 @@
+package kope
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kopeio/kope/chained"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+// LeaderAnnotation holds the leader lease (a LeaderRecord, as JSON) on the lock object
+const LeaderAnnotation = "kope.io/leader"
+
+// LeaderTasksAnnotation records (as a JSON list of names) the leader tasks that have completed, on the lock object
+const LeaderTasksAnnotation = "kope.io/leader-tasks"
+
+const (
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 2 * time.Second
+)
+
+// LeaderRecord is the lease, recorded on the lock object
+type LeaderRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+}
+
+// LeaderElectionConfig configures a LeaderElector
+type LeaderElectionConfig struct {
+	// Namespace & Name of the Endpoints object we use as the lock; it is created if it does not exist.
+	// It must not share its name with a service that has a selector, as the endpoints controller would overwrite it.
+	Namespace string
+	Name      string
+	// Identity is our name in the election (e.g. the pod name); it must be unique amongst the candidates
+	Identity string
+
+	// LeaseDuration is how long the other candidates wait (after the lease was last renewed) before taking over
+	LeaseDuration time.Duration
+	// RenewDeadline is how long we keep acting as leader when we are unable to renew the lease; it must be less than LeaseDuration
+	RenewDeadline time.Duration
+	// RetryPeriod is how often we try to acquire or renew the lease
+	RetryPeriod time.Duration
+}
+
+// LeaderElector elects one leader amongst the candidates sharing a lock object.
+// The lease is an annotation on an Endpoints object (with no addresses); because every write is conditional on the resourceVersion
+// we read, only one candidate can acquire or renew the lease at a time.
+// We never compare our clock with the RenewTime in the record (the clocks on different machines may not agree);
+// instead the lease expires if we observe no change to the record for LeaseDuration.
+//
+// We use an Endpoints object rather than a ConfigMap because the 1.1 client we build against has no ConfigMaps.
+// The candidates therefore need get, create and update on endpoints in their namespace (see the README);
+// the holder and completed tasks can be seen in the annotations, with kubectl get endpoints <name> -o yaml.
+type LeaderElector struct {
+	client Client
+	config LeaderElectionConfig
+
+	mutex sync.Mutex
+	// observedRecord is the last record we read, and observedTime is when we first saw it
+	observedRecord LeaderRecord
+	observedTime   time.Time
+	// renewTime is when we last successfully acquired or renewed the lease
+	renewTime time.Time
+	isLeader  bool
+}
+
+// NewLeaderElector builds a LeaderElector; call Run to take part in the election
+func NewLeaderElector(client Client, config *LeaderElectionConfig) *LeaderElector {
+	e := &LeaderElector{}
+	e.client = client
+	e.config = *config
+	if e.config.LeaseDuration == 0 {
+		e.config.LeaseDuration = DefaultLeaseDuration
+	}
+	if e.config.RenewDeadline == 0 {
+		e.config.RenewDeadline = DefaultRenewDeadline
+	}
+	if e.config.RetryPeriod == 0 {
+		e.config.RetryPeriod = DefaultRetryPeriod
+	}
+	return e
+}
+
+// Run takes part in the election until stopCh is closed
+func (e *LeaderElector) Run(stopCh <-chan struct{}) {
+	glog.Infof("Starting leader election for %s/%s as %q", e.config.Namespace, e.config.Name, e.config.Identity)
+	for {
+		e.tryAcquireOrRenew()
+
+		select {
+		case <-stopCh:
+			e.setLeader(false)
+			return
+		case <-time.After(e.config.RetryPeriod):
+		}
+	}
+}
+
+// IsLeader returns true if we hold the lease
+func (e *LeaderElector) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.isLeader && time.Now().After(e.renewTime.Add(e.config.RenewDeadline)) {
+		glog.Warningf("Unable to renew leader lease %s/%s; no longer leader", e.config.Namespace, e.config.Name)
+		e.isLeader = false
+	}
+	return e.isLeader
+}
+
+// WaitForLeadership blocks until we are the leader, returning false if stopCh is closed first
+func (e *LeaderElector) WaitForLeadership(stopCh <-chan struct{}) bool {
+	if stopCh == nil {
+		stopCh = util.NeverStop
+	}
+	for !e.IsLeader() {
+		select {
+		case <-stopCh:
+			return false
+		case <-time.After(e.config.RetryPeriod):
+		}
+	}
+	return true
+}
+
+// WaitForLeadershipLoss blocks while we are the leader, returning true once we are not,
+// or false if stopCh is closed first
+func (e *LeaderElector) WaitForLeadershipLoss(stopCh <-chan struct{}) bool {
+	for e.IsLeader() {
+		select {
+		case <-stopCh:
+			return false
+		case <-time.After(e.config.RetryPeriod):
+		}
+	}
+	return true
+}
+
+// IsTaskCompleted returns true if a leader recorded (with RecordTaskCompleted) that it completed the named task
+func (e *LeaderElector) IsTaskCompleted(name string) (bool, error) {
+	endpoints, err := e.client.FindEndpoints(e.config.Namespace, e.config.Name)
+	if err != nil {
+		return false, chained.Error(err, "error reading leader lock")
+	}
+	if endpoints == nil {
+		return false, nil
+	}
+	tasks, err := getLeaderTasks(endpoints)
+	if err != nil {
+		return false, err
+	}
+	for _, task := range tasks {
+		if task == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RecordTaskCompleted records on the lock object that we (as leader) completed the named task,
+// so that the other members know it has been done.
+func (e *LeaderElector) RecordTaskCompleted(name string) error {
+	endpoints, err := e.client.FindEndpoints(e.config.Namespace, e.config.Name)
+	if err != nil {
+		return chained.Error(err, "error reading leader lock")
+	}
+	if endpoints == nil {
+		return fmt.Errorf("leader lock %s/%s not found", e.config.Namespace, e.config.Name)
+	}
+	tasks, err := getLeaderTasks(endpoints)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if task == name {
+			return nil
+		}
+	}
+	tasks = append(tasks, name)
+	b, err := json.Marshal(tasks)
+	if err != nil {
+		return err
+	}
+	if endpoints.Annotations == nil {
+		endpoints.Annotations = map[string]string{}
+	}
+	endpoints.Annotations[LeaderTasksAnnotation] = string(b)
+	// As for the lease, the update is conditional on the resourceVersion we read
+	_, err = e.client.UpdateEndpoints(endpoints)
+	if err != nil {
+		return chained.Error(err, "error updating leader lock")
+	}
+	return nil
+}
+
+func getLeaderTasks(endpoints *api.Endpoints) ([]string, error) {
+	var tasks []string
+	if s := endpoints.Annotations[LeaderTasksAnnotation]; s != "" {
+		err := json.Unmarshal([]byte(s), &tasks)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation on %s/%s: %v", LeaderTasksAnnotation, endpoints.Namespace, endpoints.Name, err)
+		}
+	}
+	return tasks, nil
+}
+
+func (e *LeaderElector) setLeader(isLeader bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if isLeader {
+		e.renewTime = time.Now()
+	}
+	if isLeader != e.isLeader {
+		if isLeader {
+			glog.Infof("Became leader for %s/%s", e.config.Namespace, e.config.Name)
+		} else {
+			glog.Infof("No longer leader for %s/%s", e.config.Namespace, e.config.Name)
+		}
+	}
+	e.isLeader = isLeader
+}
+
+// tryAcquireOrRenew tries to acquire the lease (or renew it, if we hold it)
+func (e *LeaderElector) tryAcquireOrRenew() {
+	now := time.Now()
+
+	record := LeaderRecord{}
+	record.HolderIdentity = e.config.Identity
+	record.LeaseDurationSeconds = int(e.config.LeaseDuration / time.Second)
+	record.AcquireTime = now
+	record.RenewTime = now
+
+	endpoints, err := e.client.FindEndpoints(e.config.Namespace, e.config.Name)
+	if err != nil {
+		glog.Warningf("error reading leader lock %s/%s: %v", e.config.Namespace, e.config.Name, err)
+		return
+	}
+
+	if endpoints == nil {
+		endpoints = &api.Endpoints{}
+		endpoints.Namespace = e.config.Namespace
+		endpoints.Name = e.config.Name
+		endpoints.Annotations = map[string]string{}
+		err := setLeaderRecord(endpoints, &record)
+		if err != nil {
+			glog.Warningf("error building leader record: %v", err)
+			return
+		}
+		_, err = e.client.CreateEndpoints(endpoints)
+		if err != nil {
+			// Most likely another candidate created it first
+			glog.V(2).Infof("error creating leader lock %s/%s: %v", e.config.Namespace, e.config.Name, err)
+			return
+		}
+		e.observe(record, now)
+		e.setLeader(true)
+		return
+	}
+
+	existing := LeaderRecord{}
+	if s := endpoints.Annotations[LeaderAnnotation]; s != "" {
+		err := json.Unmarshal([]byte(s), &existing)
+		if err != nil {
+			glog.Warningf("ignoring invalid leader record on %s/%s: %v", e.config.Namespace, e.config.Name, err)
+		}
+	}
+
+	e.observe(existing, now)
+	e.mutex.Lock()
+	expiry := e.observedTime.Add(e.config.LeaseDuration)
+	e.mutex.Unlock()
+
+	if existing.HolderIdentity != "" && existing.HolderIdentity != e.config.Identity && now.Before(expiry) {
+		glog.V(4).Infof("Leader lock %s/%s is held by %q", e.config.Namespace, e.config.Name, existing.HolderIdentity)
+		e.setLeader(false)
+		return
+	}
+
+	if existing.HolderIdentity == e.config.Identity {
+		record.AcquireTime = existing.AcquireTime
+	}
+
+	if endpoints.Annotations == nil {
+		endpoints.Annotations = map[string]string{}
+	}
+	err = setLeaderRecord(endpoints, &record)
+	if err != nil {
+		glog.Warningf("error building leader record: %v", err)
+		return
+	}
+	// The update is conditional on the resourceVersion we read, so we fail if another candidate got there first
+	_, err = e.client.UpdateEndpoints(endpoints)
+	if err != nil {
+		glog.V(2).Infof("error updating leader lock %s/%s: %v", e.config.Namespace, e.config.Name, err)
+		return
+	}
+	e.observe(record, now)
+	e.setLeader(true)
+}
+
+// observe records the time at which we first saw a record
+func (e *LeaderElector) observe(record LeaderRecord, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.observedTime.IsZero() || record != e.observedRecord {
+		e.observedRecord = record
+		e.observedTime = now
+	}
+}
+
+func setLeaderRecord(endpoints *api.Endpoints, record *LeaderRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	endpoints.Annotations[LeaderAnnotation] = string(b)
+	return nil
+}
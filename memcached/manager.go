@@ -1,19 +1,26 @@
 package memcached
 
 import (
-	"github.com/golang/glog"
+	"bufio"
+	"fmt"
 	"github.com/kopeio/kope/base"
 	"github.com/kopeio/kope/chained"
 	"github.com/kopeio/kope/process"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
 	"strconv"
+	"strings"
 	"time"
 )
 
-const DefaultMemory = 128
+// memcached uses its memory for the cache; we leave some overhead for connections
+var memoryPolicy = &base.MemoryPolicy{DefaultMB: 128, OverheadMB: 32, HeapRatio: 1.0}
+
+const healthCheckTimeout = 5 * time.Second
 
 type Manager struct {
 	base.KopeBaseManager
-	process *process.Process
+	memory *base.MemorySizes
 }
 
 func (m *Manager) Configure() error {
@@ -22,48 +29,14 @@ func (m *Manager) Configure() error {
 		return err
 	}
 
-	if m.MemoryMB == 0 {
-		m.MemoryMB = DefaultMemory
-	} else {
-		memoryLimitMB := m.MemoryMB
-
-		// We leave 32 MB for overhead (connections etc)
-		memoryLimitMB -= 32
-
-		if memoryLimitMB < 0 {
-			glog.Warning("Memory limit was too low; ignoring")
-			m.MemoryMB = DefaultMemory
-		} else {
-			glog.Info("Setting memcached memory to ", memoryLimitMB)
-			m.MemoryMB = memoryLimitMB
-		}
-	}
+	m.memory = m.SizeMemory(memoryPolicy)
 
 	return nil
 }
 
 func (m *Manager) Manage() error {
-	err := m.Init()
-	if err != nil {
-		return chained.Error(err, "error initializing")
-	}
-
-	err = m.Configure()
-	if err != nil {
-		return chained.Error(err, "error configuring")
-	}
-
-	process, err := m.Start()
-	if err != nil {
-		return chained.Error(err, "error starting")
-	}
-	m.process = process
-
-	for {
-		time.Sleep(5 * time.Second)
-	}
-
-	return nil
+	prometheus.MustRegister(newStatsCollector())
+	return m.Run(m)
 }
 
 func (m *Manager) Start() (*process.Process, error) {
@@ -71,7 +44,7 @@ func (m *Manager) Start() (*process.Process, error) {
 	argv = append(argv, "-p", "11211")
 	argv = append(argv, "-u", "memcache")
 	argv = append(argv, "-l", "0.0.0.0")
-	argv = append(argv, "-m", strconv.Itoa(m.MemoryMB))
+	argv = append(argv, "-m", strconv.Itoa(m.memory.HeapMB))
 
 	config := &process.ProcessConfig{}
 	config.Argv = argv
@@ -82,3 +55,48 @@ func (m *Manager) Start() (*process.Process, error) {
 	}
 	return process, nil
 }
+
+// HealthCheck checks that memcached is responding to the stats command
+func (m *Manager) HealthCheck() error {
+	_, err := readStats()
+	return err
+}
+
+// readStats connects to memcached and returns the output of the stats command
+func readStats() (map[string]string, error) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:11211", healthCheckTimeout)
+	if err != nil {
+		return nil, chained.Error(err, "error connecting to memcached")
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+	if err != nil {
+		return nil, chained.Error(err, "error setting deadline")
+	}
+
+	_, err = conn.Write([]byte("stats\r\n"))
+	if err != nil {
+		return nil, chained.Error(err, "error sending stats command")
+	}
+
+	// Response is a series of lines "STAT <name> <value>", terminated by "END"
+	stats := map[string]string{}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "END" {
+			return stats, nil
+		}
+		tokens := strings.SplitN(line, " ", 3)
+		if len(tokens) != 3 || tokens[0] != "STAT" {
+			return nil, fmt.Errorf("unexpected line in stats response: %q", line)
+		}
+		stats[tokens[1]] = tokens[2]
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, chained.Error(err, "error reading stats response")
+	}
+	return nil, fmt.Errorf("unexpected end of stats response")
+}
@@ -0,0 +1,68 @@
+package memcached
+
+import (
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The memcached stats we expose, and whether they are counters or gauges
+var statTypes = map[string]prometheus.ValueType{
+	"curr_connections":  prometheus.GaugeValue,
+	"total_connections": prometheus.CounterValue,
+	"curr_items":        prometheus.GaugeValue,
+	"total_items":       prometheus.CounterValue,
+	"bytes":             prometheus.GaugeValue,
+	"limit_maxbytes":    prometheus.GaugeValue,
+	"cmd_get":           prometheus.CounterValue,
+	"cmd_set":           prometheus.CounterValue,
+	"get_hits":          prometheus.CounterValue,
+	"get_misses":        prometheus.CounterValue,
+	"evictions":         prometheus.CounterValue,
+	"bytes_read":        prometheus.CounterValue,
+	"bytes_written":     prometheus.CounterValue,
+}
+
+// statsCollector exposes the output of the memcached stats command
+type statsCollector struct {
+	descs map[string]*prometheus.Desc
+}
+
+var _ prometheus.Collector = &statsCollector{}
+
+func newStatsCollector() *statsCollector {
+	c := &statsCollector{}
+	c.descs = make(map[string]*prometheus.Desc)
+	for stat := range statTypes {
+		c.descs[stat] = prometheus.NewDesc("kope_memcached_"+stat, "memcached stat "+stat+".", nil, nil)
+	}
+	return c
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := readStats()
+	if err != nil {
+		glog.V(2).Info("error reading memcached stats: ", err)
+		return
+	}
+
+	for stat, valueType := range statTypes {
+		s, found := stats[stat]
+		if !found {
+			continue
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			glog.V(2).Infof("ignoring non-numeric memcached stat %s=%q", stat, s)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.descs[stat], valueType, v)
+	}
+}
@@ -1,9 +1,16 @@
 package mongodb
 
 import (
+	"context"
+	"embed"
+	"fmt"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/golang/glog"
 	"github.com/kopeio/kope"
 	"github.com/kopeio/kope/base"
 	"github.com/kopeio/kope/chained"
@@ -11,48 +18,116 @@ import (
 	"github.com/kopeio/kope/user"
 )
 
+//go:embed templates/*.template
+var templates embed.FS
+
+var _ = kope.RegisterTemplates(templates)
+
+// The heap ratio sizes the WiredTiger cache; mongo relies on the page cache for the rest
+var memoryPolicy = &base.MemoryPolicy{DefaultMB: 256, OverheadMB: 64, HeapRatio: 0.5}
+
+// healthCheckTimeout bounds the isMaster check (which starts the mongo shell); we also use it for mongod --version
+const healthCheckTimeout = 10 * time.Second
+
 type Manager struct {
 	base.KopeBaseManager
-	process *process.Process
-	config  Config
+	memory *base.MemorySizes
+	config Config
 }
 
 type Config struct {
 	DataDir string
 	LogDir  string
-}
 
-func (m *Manager) Configure() error {
-	m.config.DataDir = "/data/db"
-	m.config.LogDir = "/data/log"
+	// WiredTigerCacheSizeGB is only set when non-empty (see wiredTigerCacheSizeGB)
+	WiredTigerCacheSizeGB string
+}
 
-	return nil
+// mongoVersion is the version of mongod we run, as major & minor numbers
+type mongoVersion struct {
+	Major int
+	Minor int
 }
 
-func (m *Manager) Manage() error {
-	err := m.Init()
+var mongoVersionRegex = regexp.MustCompile(`db version v(\d+)\.(\d+)`)
+
+// findMongoVersion runs mongod --version
+func findMongoVersion() (*mongoVersion, error) {
+	config := &process.ProcessConfig{}
+	config.Argv = []string{"/opt/mongodb/bin/mongod", "--version"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	stdout, _, err := config.ExecContext(ctx, nil)
 	if err != nil {
-		return chained.Error(err, "error initializing")
+		return nil, err
 	}
+	return parseMongoVersion(stdout)
+}
 
-	err = m.Configure()
-	if err != nil {
-		return chained.Error(err, "error configuring")
+// parseMongoVersion parses the output of mongod --version ("db version v3.0.4" ...)
+func parseMongoVersion(s string) (*mongoVersion, error) {
+	match := mongoVersionRegex.FindStringSubmatch(s)
+	if match == nil {
+		return nil, fmt.Errorf("cannot parse mongod version from %q", s)
+	}
+	v := &mongoVersion{}
+	v.Major, _ = strconv.Atoi(match[1])
+	v.Minor, _ = strconv.Atoi(match[2])
+	return v, nil
+}
+
+// AtLeast returns true if the version is major.minor or later
+func (v *mongoVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// wiredTigerCacheSizeGB formats the cache size for the heap.  Mongo before 3.2 only accepts whole GB, so with a heap
+// under 1GB we leave the flag unset: rounding up would give a cache bigger than the container, and mongod would be
+// OOM-killed.  From 3.2 we can use a fractional value, but mongo requires at least 0.25.
+func wiredTigerCacheSizeGB(heapMB int, version *mongoVersion) string {
+	if heapMB <= 0 {
+		return ""
+	}
+	if version.AtLeast(3, 2) {
+		gb := float64(heapMB) / 1024
+		if gb < 0.25 {
+			gb = 0.25
+		}
+		return strconv.FormatFloat(gb, 'f', 2, 64)
+	}
+	gb := heapMB / 1024
+	if gb < 1 {
+		return ""
 	}
+	return strconv.Itoa(gb)
+}
 
-	process, err := m.Start()
+func (m *Manager) Configure() error {
+	err := m.KopeBaseManager.Configure()
 	if err != nil {
-		return chained.Error(err, "error starting")
+		return err
 	}
-	m.process = process
 
-	for {
-		time.Sleep(5 * time.Second)
+	m.config.DataDir = "/data/db"
+	m.config.LogDir = "/data/log"
+
+	m.memory = m.SizeMemory(memoryPolicy)
+	version, err := findMongoVersion()
+	if err != nil {
+		// The image ships 3.0, so we assume that
+		glog.Warningf("unable to determine mongod version (assuming 3.0): %v", err)
+		version = &mongoVersion{Major: 3, Minor: 0}
 	}
+	m.config.WiredTigerCacheSizeGB = wiredTigerCacheSizeGB(m.memory.HeapMB, version)
 
 	return nil
 }
 
+func (m *Manager) Manage() error {
+	return m.Run(m)
+}
+
 func (m *Manager) Start() (*process.Process, error) {
 
 	mongoUser, err := user.Find("mongodb")
@@ -77,14 +152,17 @@ func (m *Manager) Start() (*process.Process, error) {
 		return nil, err
 	}
 
-	// TODO: Should we raise ulimit??
-
 	argv := []string{"/opt/mongodb/bin/mongod"}
 	argv = append(argv, "--config", confPath)
 
 	config := &process.ProcessConfig{}
 	config.Argv = argv
 	config.SetCredential(mongoUser)
+	// The limits recommended by mongodb; it uses a file descriptor (and a thread) per connection
+	config.Rlimits = []process.Rlimit{
+		{Resource: process.RlimitNofile, Soft: 64000, Hard: 64000},
+		{Resource: process.RlimitNproc, Soft: 64000, Hard: 64000},
+	}
 
 	process, err := config.Start()
 	if err != nil {
@@ -92,3 +170,24 @@ func (m *Manager) Start() (*process.Process, error) {
 	}
 	return process, nil
 }
+
+// HealthCheck checks that mongod is responding to the isMaster command
+func (m *Manager) HealthCheck() error {
+	argv := []string{"/opt/mongodb/bin/mongo", "--quiet"}
+	argv = append(argv, "--eval", "db.isMaster().ok")
+	argv = append(argv, "127.0.0.1:27017/admin")
+
+	config := &process.ProcessConfig{}
+	config.Argv = argv
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	stdout, stderr, err := config.ExecContext(ctx, nil)
+	if err != nil {
+		return chained.Error(err, "error running isMaster: ", stderr)
+	}
+	if strings.TrimSpace(stdout) != "1" {
+		return fmt.Errorf("unexpected response from isMaster: %q", stdout)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package mongodb
+
+import (
+	"testing"
+)
+
+func TestParseMongoVersion(t *testing.T) {
+	grid := []struct {
+		Input string
+		Major int
+		Minor int
+		Error bool
+	}{
+		{"db version v3.0.15\ngit version: abc", 3, 0, false},
+		{"db version v3.2.22\n", 3, 2, false},
+		{"db version v4.10.1", 4, 10, false},
+		{"mongod: not found", 0, 0, true},
+	}
+	for _, g := range grid {
+		v, err := parseMongoVersion(g.Input)
+		if g.Error {
+			if err == nil {
+				t.Errorf("parseMongoVersion(%q): expected error", g.Input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMongoVersion(%q): unexpected error: %v", g.Input, err)
+			continue
+		}
+		if v.Major != g.Major || v.Minor != g.Minor {
+			t.Errorf("parseMongoVersion(%q) was %d.%d, expected %d.%d", g.Input, v.Major, v.Minor, g.Major, g.Minor)
+		}
+	}
+}
+
+func TestWiredTigerCacheSizeGB(t *testing.T) {
+	v30 := &mongoVersion{Major: 3, Minor: 0}
+	v32 := &mongoVersion{Major: 3, Minor: 2}
+	v40 := &mongoVersion{Major: 4, Minor: 0}
+
+	grid := []struct {
+		HeapMB   int
+		Version  *mongoVersion
+		Expected string
+	}{
+		{0, v32, ""},
+		{100, v30, ""},
+		{1023, v30, ""},
+		{1024, v30, "1"},
+		{3000, v30, "2"},
+		{100, v32, "0.25"},
+		{512, v32, "0.50"},
+		{1536, v40, "1.50"},
+	}
+	for _, g := range grid {
+		actual := wiredTigerCacheSizeGB(g.HeapMB, g.Version)
+		if actual != g.Expected {
+			t.Errorf("wiredTigerCacheSizeGB(%d, %d.%d) was %q, expected %q", g.HeapMB, g.Version.Major, g.Version.Minor, actual, g.Expected)
+		}
+	}
+}
@@ -1,7 +1,8 @@
 package postgres
 
 import (
-	"bytes"
+	"context"
+	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,26 +13,60 @@ import (
 	"github.com/kopeio/kope/process"
 	"github.com/kopeio/kope/user"
 	"github.com/kopeio/kope/utils"
+	"github.com/prometheus/client_golang/prometheus"
 	"io/ioutil"
 	"k8s.io/kubernetes/pkg/api"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-const DefaultMemory = 128
+//go:embed templates/*.template
+var templates embed.FS
+
+var _ = kope.RegisterTemplates(templates)
+
+const (
+	// psqlTimeout is how long we allow for the queries we run (creating users & databases etc)
+	psqlTimeout = 60 * time.Second
+	// healthCheckTimeout is how long we allow for the health check query
+	healthCheckTimeout = 10 * time.Second
+	// pgCtlTimeout is how long we allow pg_ctl to stop postgres after initialization; on shutdown the grace period applies
+	pgCtlTimeout = 120 * time.Second
+)
+
+// The heap ratio sizes shared_buffers; postgres relies on the page cache for the rest
+var memoryPolicy = &base.MemoryPolicy{DefaultMB: 128, OverheadMB: 32, HeapRatio: 0.25}
 
 type Manager struct {
 	base.KopeBaseManager
-	process   *process.Process
+	memory    *base.MemorySizes
 	config    Config
 	SecretDir string
+
+	// startedConfig is the configuration postgres was last started with
+	configMutex   sync.Mutex
+	startedConfig Config
+
+	// appliedPasswords are the passwords (by user) that we last set from the secrets
+	passwordsMutex   sync.Mutex
+	appliedPasswords map[string]string
+
+	// psql (if set) runs queries instead of psql, for tests
+	psql func(ctx context.Context, sql string) (*sqlResults, error)
 }
 
 type Config struct {
-	DataDir  string
-	MemoryMB int
+	DataDir string
+
+	SharedBuffersMB      int
+	EffectiveCacheSizeMB int
+	WorkMemMB            int
+
+	MaxWorkerProcesses int
 }
 
 type PostgresSecretData struct {
@@ -46,26 +81,20 @@ func (m *Manager) Configure() error {
 		return err
 	}
 
-	if m.MemoryMB == 0 {
-		m.MemoryMB = DefaultMemory
-	} else {
-		memoryLimitMB := m.MemoryMB
-
-		// We leave 32 MB for overhead (connections etc)
-		memoryLimitMB -= 32
-
-		if memoryLimitMB < 0 {
-			glog.Warning("Memory limit was too low; ignoring")
-			m.MemoryMB = DefaultMemory
-		} else {
-			glog.Info("Setting postgres memory to ", memoryLimitMB)
-			m.MemoryMB = memoryLimitMB
-		}
-	}
+	m.memory = m.SizeMemory(memoryPolicy)
 
 	m.config.DataDir = "/data/db"
 	m.SecretDir = "/data/secrets"
-	m.config.MemoryMB = m.MemoryMB
+	// shared_buffers is the heap; effective_cache_size is a hint about the page cache we expect.
+	// work_mem is per sort/hash operation, so we divide what is left amongst the connections (max_connections is 100)
+	m.config.SharedBuffersMB = m.memory.HeapMB
+	m.config.EffectiveCacheSizeMB = m.memory.Fraction(0.75)
+	m.config.WorkMemMB = (m.memory.AvailableMB - m.memory.HeapMB) / 100
+	if m.config.WorkMemMB < 1 {
+		m.config.WorkMemMB = 1
+	}
+
+	m.config.MaxWorkerProcesses = m.CPUCount()
 
 	return nil
 }
@@ -85,6 +114,10 @@ func (m *Manager) findSecretData(secretName string) (*PostgresSecretData, error)
 		return nil, nil
 	}
 
+	return parseSecretData(secret)
+}
+
+func parseSecretData(secret *api.Secret) (*PostgresSecretData, error) {
 	if secret.Data == nil {
 		return nil, nil
 	}
@@ -96,7 +129,7 @@ func (m *Manager) findSecretData(secretName string) (*PostgresSecretData, error)
 	}
 
 	config := &PostgresSecretData{}
-	err = json.Unmarshal(configData, config)
+	err := json.Unmarshal(configData, config)
 	if err != nil {
 		return nil, chained.Error(err, "error reading config.json")
 	}
@@ -120,19 +153,25 @@ func (m *Manager) writeSecretData(secretName string, config *PostgresSecretData)
 		return err
 	}
 
-	secret := &api.Secret{}
-	secret.Namespace = me.Pod.Namespace
-	secret.Name = secretName
-	secret.Type = "Opaque"
-	secret.Data = map[string][]byte{}
-	secret.Data["config.json"] = j
-
-	_, err = m.KubernetesClient.CreateSecret(secret)
+	// We create the secret if it doesn't exist; if it does, we replace the config (and complete any rotation)
+	_, err = kope.PatchSecret(m.KubernetesClient, me.Pod.Namespace, secretName, func(secret *api.Secret) error {
+		if secret.Type == "" {
+			secret.Type = "Opaque"
+		}
+		secret.Data["config.json"] = j
+		kope.ClearRotation(secret)
+		return nil
+	})
 	if err != nil {
-		return chained.Error(err, "error creating secret")
+		return chained.Error(err, "error writing secret")
 	}
 
-	err = os.MkdirAll(m.SecretDir, 0777)
+	return m.writeLocalSecret(secretName, j)
+}
+
+// writeLocalSecret writes the secret config.json to SecretDir
+func (m *Manager) writeLocalSecret(secretName string, j []byte) error {
+	err := os.MkdirAll(m.SecretDir, 0777)
 	if err != nil {
 		return chained.Error(err, "error doing mkdir on: ", m.SecretDir)
 	}
@@ -144,21 +183,128 @@ func (m *Manager) writeSecretData(secretName string, config *PostgresSecretData)
 
 	return nil
 }
-func (m *Manager) Manage() error {
-	err := m.Init()
+
+// rootSecretName is the name of the secret holding the password for the postgres superuser
+func (m *Manager) rootSecretName() string {
+	if m.ClusterID != "" {
+		return m.ClusterID
+	}
+	return "postgres"
+}
+
+// rotatePassword generates a new password for the user in the secret.  We set the password (ALTER ROLE) first and
+// then write the secret, so that if setting the password fails the secret still matches the database.
+// The other members then set the password in passwordChanged.
+func (m *Manager) rotatePassword(ctx context.Context, secret *api.Secret) error {
+	config, err := parseSecretData(secret)
 	if err != nil {
-		return chained.Error(err, "error initializing")
+		return chained.Error(err, "error reading secret data")
+	}
+	if config == nil || config.User == "" {
+		return fmt.Errorf("user not found in secret %s", secret.Name)
 	}
-	err = m.Configure()
+
+	password, err := utils.GeneratePassword(128)
 	if err != nil {
-		return chained.Error(err, "error configuring")
+		return chained.Error(err, "error generating password")
 	}
 
-	if !kope.FileExists(m.config.DataDir) {
-		secretName := m.ClusterID
-		if secretName == "" {
-			secretName = "postgres"
+	m.passwordsMutex.Lock()
+	defer m.passwordsMutex.Unlock()
+
+	exists, err := m.userExists(ctx, config.User)
+	if err != nil {
+		return err
+	}
+	if exists {
+		err = m.setPassword(ctx, config.User, password)
+		if err != nil {
+			return err
 		}
+		m.recordAppliedPassword(config.User, password)
+	}
+
+	config.Password = password
+	err = m.writeSecretData(secret.Name, config)
+	if err != nil {
+		return chained.Error(err, "error writing secret data")
+	}
+	return nil
+}
+
+// passwordChanged sets the password of the user in the secret, if it has changed
+func (m *Manager) passwordChanged(secret *api.Secret) error {
+	config, err := parseSecretData(secret)
+	if err != nil {
+		return chained.Error(err, "error reading secret data")
+	}
+	if config == nil || config.User == "" {
+		return nil
+	}
+
+	m.passwordsMutex.Lock()
+	defer m.passwordsMutex.Unlock()
+
+	if m.appliedPasswords[config.User] == config.Password {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), psqlTimeout)
+	defer cancel()
+	exists, err := m.userExists(ctx, config.User)
+	if err != nil {
+		return err
+	}
+	// The app user is only created on the leader (with the password from the secret)
+	if !exists {
+		glog.Infof("User %q does not exist; not setting password", config.User)
+		return nil
+	}
+
+	err = m.setPassword(ctx, config.User, config.Password)
+	if err != nil {
+		return err
+	}
+	m.recordAppliedPassword(config.User, config.Password)
+
+	j, err := json.Marshal(config)
+	if err != nil {
+		return chained.Error(err, "error building secret config.json")
+	}
+	return m.writeLocalSecret(secret.Name, j)
+}
+
+// recordAppliedPassword records the password we set for the user.  passwordsMutex must be held.
+func (m *Manager) recordAppliedPassword(user string, password string) {
+	if m.appliedPasswords == nil {
+		m.appliedPasswords = map[string]string{}
+	}
+	m.appliedPasswords[user] = password
+}
+
+func (m *Manager) setPassword(ctx context.Context, user string, password string) error {
+	// Note that user is not escaped :-(
+	if !isAlphanumeric(user) {
+		return fmt.Errorf("invalid user name: %q", user)
+	}
+	glog.Infof("Changing password for user %q", user)
+	sql := buildSql("ALTER ROLE "+user+" WITH PASSWORD ?", password)
+	_, err := m.runPsql(ctx, sql)
+	if err != nil {
+		return chained.Error(err, "error changing password")
+	}
+	return nil
+}
+
+func (m *Manager) Manage() error {
+	prometheus.MustRegister(newConnectionsCollector(m))
+	return m.Run(m)
+}
+
+// Prepare initializes the data directory (if needed) and writes the configuration
+func (m *Manager) Prepare(ctx context.Context) error {
+	if !kope.FileExists(m.config.DataDir) {
+		secretName := m.rootSecretName()
 
 		config, err := m.findSecretData(secretName)
 		if err != nil {
@@ -184,24 +330,24 @@ func (m *Manager) Manage() error {
 			return chained.Error(err, "error initializing database")
 		}
 
-		err = m.setRootPassword(config.Password)
+		err = m.setRootPassword(ctx, config.Password)
 		if err != nil {
 			return chained.Error(err, "error setting root password")
 		}
 	}
 
-	err = m.writeConfig()
+	err := m.writeConfig()
 	if err != nil {
 		return chained.Error(err, "error writing configuration")
 	}
 
-	process, err := m.Start()
-	if err != nil {
-		return chained.Error(err, "error starting")
-	}
-	m.process = process
+	return nil
+}
 
-	err = m.waitHealthy(120 * time.Second)
+// PostStart waits for postgres to come up, and then creates the application database (if configured, and we are the leader).
+// We then watch the secrets, so that the passwords can be rotated.
+func (m *Manager) PostStart(ctx context.Context) error {
+	err := m.waitHealthy(ctx, 120*time.Second)
 	if err != nil {
 		return chained.Error(err, "timeout waiting for postgres to start listening")
 	}
@@ -220,21 +366,63 @@ func (m *Manager) Manage() error {
 				appUser = appDB
 			}
 			secretName := "db-" + appDB
-			err = m.ensureAppDb(secretName, appDB, appUser)
+			// Only one member of the cluster should generate the credentials & create the database
+			err = m.RunAsLeader("create app db "+appDB, func(ctx context.Context) error {
+				return m.ensureAppDb(ctx, secretName, appDB, appUser)
+			})
 			if err != nil {
 				return chained.Error(err, "error creating user db")
 			}
+
+			err = m.WatchSecretRotation(secretName, m.rotatePassword, m.passwordChanged)
+			if err != nil {
+				return chained.Error(err, "error watching secret ", secretName)
+			}
 		}
 	}
 
-	for {
-		time.Sleep(5 * time.Second)
+	err = m.WatchSecretRotation(m.rootSecretName(), m.rotatePassword, m.passwordChanged)
+	if err != nil {
+		return chained.Error(err, "error watching secret ", m.rootSecretName())
 	}
 
 	return nil
 }
 
-func (m *Manager) ensureAppDb(secretName string, db string, user string) error {
+// Stop does a "fast" shutdown: clients are disconnected, but postgres shuts down cleanly
+func (m *Manager) Stop(ctx context.Context, p *process.Process, sig os.Signal) error {
+	return m.pgCtlStop(ctx, "fast")
+}
+
+// Reconfigure rewrites the configuration, and asks postgres to reload it
+func (m *Manager) Reconfigure() error {
+	err := m.Configure()
+	if err != nil {
+		return chained.Error(err, "error configuring")
+	}
+	err = m.writeConfig()
+	if err != nil {
+		return chained.Error(err, "error writing configuration")
+	}
+
+	m.configMutex.Lock()
+	needsRestart := needsRestart(&m.startedConfig, &m.config)
+	m.configMutex.Unlock()
+	if needsRestart {
+		glog.Info("Settings that need a restart have changed; restarting postgres")
+		m.RecordEvent(kope.EventReasonReconfigured, "Restarting postgres to apply shared_buffers / max_worker_processes")
+		return m.RestartProcess()
+	}
+	return m.SignalProcess(syscall.SIGHUP)
+}
+
+// needsRestart returns true if settings have changed that postgres only reads when it starts (shared_buffers and
+// max_worker_processes); the others are applied by a SIGHUP.
+func needsRestart(started *Config, config *Config) bool {
+	return started.SharedBuffersMB != config.SharedBuffersMB || started.MaxWorkerProcesses != config.MaxWorkerProcesses
+}
+
+func (m *Manager) ensureAppDb(ctx context.Context, secretName string, db string, user string) error {
 	glog.Infof("Ensuring that app db exists: db=%q, user=%q", db, user)
 	config, err := m.findSecretData(secretName)
 	if err != nil {
@@ -256,12 +444,12 @@ func (m *Manager) ensureAppDb(secretName string, db string, user string) error {
 		}
 	}
 
-	_, err = m.ensureUser(config.User, config.Password)
+	_, err = m.ensureUser(ctx, config.User, config.Password)
 	if err != nil {
 		return chained.Error(err, "error creating user")
 	}
 
-	_, err = m.ensureDb(config.Db, config.User)
+	_, err = m.ensureDb(ctx, config.Db, config.User)
 	if err != nil {
 		return chained.Error(err, "error creating database")
 	}
@@ -302,39 +490,32 @@ func isAlphanumeric(s string) bool {
 	return true
 }
 
+// escapeSqlString quotes s as an escape string constant (E'...'), which means the same whatever
+// standard_conforming_strings is set to.  The values can come from secrets that users edit, so any character must work.
 func escapeSqlString(s string) string {
-	var buffer bytes.Buffer
-	buffer.WriteString("'")
-	for _, r := range s {
-		switch {
-		case 'a' <= r && r <= 'z':
-			buffer.WriteRune(r)
-		case 'A' <= r && r <= 'Z':
-			buffer.WriteRune(r)
-		case '0' <= r && r <= '9':
-			buffer.WriteRune(r)
-		default:
-			switch r {
-			case '_', '-', ' ':
-				buffer.WriteRune(r)
-			default:
-				glog.Fatalf("unhandled character in escapeSqlString: %v", r)
-			}
-		}
-	}
-	buffer.WriteString("'")
-	return string(buffer.Bytes())
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "'", "''", -1)
+	return "E'" + s + "'"
 }
 
-func (m *Manager) ensureUser(user string, password string) (bool, error) {
-	glog.Infof("Ensuring that user exists: %q", user)
+// userExists returns true if the user exists in the database
+func (m *Manager) userExists(ctx context.Context, user string) (bool, error) {
 	sql := buildSql("SELECT * FROM pg_catalog.pg_user WHERE usename=?", user)
-	results, err := m.runPsql(sql)
+	results, err := m.runPsql(ctx, sql)
 	if err != nil {
 		return false, chained.Error(err, "error querying for user")
 	}
+	return len(results.Rows) != 0, nil
+}
 
-	if len(results.Rows) != 0 {
+func (m *Manager) ensureUser(ctx context.Context, user string, password string) (bool, error) {
+	glog.Infof("Ensuring that user exists: %q", user)
+	exists, err := m.userExists(ctx, user)
+	if err != nil {
+		return false, err
+	}
+
+	if exists {
 		return false, nil
 	}
 
@@ -344,8 +525,8 @@ func (m *Manager) ensureUser(user string, password string) (bool, error) {
 		return false, fmt.Errorf("invalid user name: %q", user)
 	}
 	glog.Infof("Creating user %q", user)
-	sql = buildSql("CREATE USER "+user+" WITH PASSWORD ?", password)
-	_, err = m.runPsql(sql)
+	sql := buildSql("CREATE USER "+user+" WITH PASSWORD ?", password)
+	_, err = m.runPsql(ctx, sql)
 	if err != nil {
 		return false, chained.Error(err, "error creating user")
 	}
@@ -353,10 +534,10 @@ func (m *Manager) ensureUser(user string, password string) (bool, error) {
 	return true, nil
 }
 
-func (m *Manager) ensureDb(db string, owner string) (bool, error) {
+func (m *Manager) ensureDb(ctx context.Context, db string, owner string) (bool, error) {
 	glog.Infof("Ensuring that database exists: %q", db)
 	sql := buildSql("SELECT * FROM pg_catalog.pg_database WHERE datname=?", db)
-	results, err := m.runPsql(sql)
+	results, err := m.runPsql(ctx, sql)
 	if err != nil {
 		return false, chained.Error(err, "error querying for database")
 	}
@@ -374,7 +555,7 @@ func (m *Manager) ensureDb(db string, owner string) (bool, error) {
 	}
 	glog.Infof("Creating database %q", db)
 	sql = buildSql("CREATE DATABASE " + db + " WITH OWNER " + owner)
-	_, err = m.runPsql(sql)
+	_, err = m.runPsql(ctx, sql)
 	if err != nil {
 		return false, chained.Error(err, "error creating db")
 	}
@@ -383,6 +564,10 @@ func (m *Manager) ensureDb(db string, owner string) (bool, error) {
 }
 
 func (m *Manager) Start() (*process.Process, error) {
+	m.configMutex.Lock()
+	m.startedConfig = m.config
+	m.configMutex.Unlock()
+
 	return m.start()
 }
 
@@ -425,11 +610,7 @@ func (m *Manager) writeConfig() error {
 	return nil
 }
 
-func sqlEscape(s string) string {
-	return strings.Replace(s, "'", "''", -1)
-}
-
-func (m *Manager) setRootPassword(password string) error {
+func (m *Manager) setRootPassword(ctx context.Context, password string) error {
 	// Start but only listen on UNIX pipes
 	glog.Info("Starting postgres (listening locally only)")
 	process, err := m.start("-c", "listen_addresses=")
@@ -449,42 +630,52 @@ func (m *Manager) setRootPassword(password string) error {
 
 	}()
 
-	err = m.waitHealthy(120 * time.Second)
+	err = m.waitHealthy(ctx, 120*time.Second)
 	if err != nil {
+		// Don't leave the local-only postgres running (e.g. if we are shutting down)
+		stopCtx, cancel := context.WithTimeout(context.Background(), pgCtlTimeout)
+		defer cancel()
+		_ = m.pgCtlStop(stopCtx, "fast")
 		return chained.Error(err, "timeout waiting for postgres to start listening")
 	}
 
-	sql := "ALTER ROLE postgres WITH PASSWORD '" + sqlEscape(password) + "'"
-	_, err = m.runPsql(sql)
+	sql := buildSql("ALTER ROLE postgres WITH PASSWORD ?", password)
+	_, err = m.runPsql(ctx, sql)
 	if err != nil {
 		return chained.Error(err, "error running psql to change root password")
 	}
 
 	glog.Info("Stopping postgres")
-	err = m.pgCtlStop()
+	ctx, cancel := context.WithTimeout(context.Background(), pgCtlTimeout)
+	defer cancel()
+	err = m.pgCtlStop(ctx, "smart")
 	if err != nil {
 		return nil
 	}
 	return nil
 }
 
-func (m *Manager) waitHealthy(timeout time.Duration) error {
-	timeoutAt := time.Now().Add(timeout)
+// waitHealthy waits for postgres to accept queries; it gives up after timeout, or when ctx is cancelled
+func (m *Manager) waitHealthy(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	for {
-		if !time.Now().Before(timeoutAt) {
-			return fmt.Errorf("postgres did not become ready before timeout")
-		}
-		if m.isHealthy() {
+		if m.isHealthy(ctx) {
 			return nil
 		}
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("postgres did not become ready before timeout")
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
 
-func (m *Manager) pgCtlStop() error {
-	argv := []string{"/usr/lib/postgresql/9.4/bin/pg_ctl", "stop", "-D", m.config.DataDir}
+// pgCtlStop stops postgres, using the specified shutdown mode (smart, fast or immediate)
+func (m *Manager) pgCtlStop(ctx context.Context, mode string) error {
+	argv := []string{"/usr/lib/postgresql/9.4/bin/pg_ctl", "stop", "-D", m.config.DataDir, "-m", mode}
 
-	_, _, err := m.runAsPostgresUser(argv)
+	_, _, err := m.runAsPostgresUser(ctx, argv)
 	if err != nil {
 		return chained.Error(err, "error stopping postgres")
 	}
@@ -492,8 +683,20 @@ func (m *Manager) pgCtlStop() error {
 	return nil
 }
 
-func (m *Manager) isHealthy() bool {
-	_, err := m.runPsql("SELECT 1")
+// HealthCheck checks that postgres is accepting queries
+func (m *Manager) HealthCheck() error {
+	return m.healthCheck(context.Background())
+}
+
+func (m *Manager) healthCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	_, err := m.runPsqlContext(ctx, "SELECT 1")
+	return err
+}
+
+func (m *Manager) isHealthy(ctx context.Context) bool {
+	err := m.healthCheck(ctx)
 	if err != nil {
 		glog.V(2).Info("postgres not yet healthy: ", err)
 		return false
@@ -501,18 +704,28 @@ func (m *Manager) isHealthy() bool {
 	return true
 }
 
-func (m *Manager) runPsql(sql string) (*sqlResults, error) {
+// runPsql runs the sql, with psqlTimeout (or until ctx is cancelled)
+func (m *Manager) runPsql(ctx context.Context, sql string) (*sqlResults, error) {
+	ctx, cancel := context.WithTimeout(ctx, psqlTimeout)
+	defer cancel()
+	return m.runPsqlContext(ctx, sql)
+}
+
+func (m *Manager) runPsqlContext(ctx context.Context, sql string) (*sqlResults, error) {
+	if m.psql != nil {
+		return m.psql(ctx, sql)
+	}
+
 	argv := []string{"/usr/lib/postgresql/9.4/bin/psql", "--username", "postgres"}
 	// Make parsable
 	argv = append(argv, "--no-align", "-z", "--pset", "footer=off")
 	argv = append(argv, "-c", sql)
 	argv = append(argv, "-h", "/var/run/postgresql")
 
-	stdout, stderr, err := m.runAsPostgresUser(argv)
+	stdout, stderr, err := m.runAsPostgresUser(ctx, argv)
 	if err != nil {
-		glog.Infof("error running sql query")
-		glog.Infof("stdout: %s", stdout)
-		glog.Infof("stderr: %s", stderr)
+		// The error includes the end of stderr
+		glog.V(2).Infof("stdout from failed psql query: %s", stdout)
 		return nil, chained.Error(err, "error running psql query")
 	}
 
@@ -549,7 +762,7 @@ func parsePsqlOutput(stdout string) (*sqlResults, error) {
 	return results, nil
 }
 
-func (m *Manager) runAsPostgresUser(argv []string) (string, string, error) {
+func (m *Manager) runAsPostgresUser(ctx context.Context, argv []string) (string, string, error) {
 	postgresUser, err := user.Find("postgres")
 	if err != nil {
 		return "", "", chained.Error(err, "error finding user")
@@ -559,7 +772,7 @@ func (m *Manager) runAsPostgresUser(argv []string) (string, string, error) {
 	config.Argv = argv
 	config.SetCredential(postgresUser)
 
-	return config.Exec()
+	return config.ExecContext(ctx, nil)
 }
 
 func (m *Manager) runInitdb() error {
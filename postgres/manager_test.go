@@ -0,0 +1,372 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+
+	"github.com/kopeio/kope"
+	"github.com/kopeio/kope/fake"
+)
+
+// newTestManager builds a manager running in a pod in the default namespace, against a fake client
+func newTestManager(t *testing.T) (*Manager, *fake.Client) {
+	client := fake.NewClient()
+	pod := &api.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "postgres-0"
+	client.Add(pod)
+	client.SelfPod = pod
+
+	m := &Manager{}
+	m.KubernetesClient = client
+	m.SecretDir = path.Join(t.TempDir(), "secrets")
+	return m, client
+}
+
+func readLocalSecret(t *testing.T, m *Manager, secretName string) *PostgresSecretData {
+	b, err := ioutil.ReadFile(path.Join(m.SecretDir, secretName))
+	if err != nil {
+		t.Fatalf("error reading local secret: %v", err)
+	}
+	config := &PostgresSecretData{}
+	err = json.Unmarshal(b, config)
+	if err != nil {
+		t.Fatalf("error parsing local secret: %v", err)
+	}
+	return config
+}
+
+func TestSecretBootstrap(t *testing.T) {
+	m, client := newTestManager(t)
+
+	config, err := m.findSecretData("postgres")
+	if err != nil {
+		t.Fatalf("unexpected error finding secret: %v", err)
+	}
+	if config != nil {
+		t.Fatalf("expected no secret data before bootstrapping, found %v", config)
+	}
+
+	written := &PostgresSecretData{User: "postgres", Password: "secret1"}
+	err = m.writeSecretData("postgres", written)
+	if err != nil {
+		t.Fatalf("unexpected error writing secret: %v", err)
+	}
+
+	secret, err := client.FindSecret("default", "postgres")
+	if err != nil || secret == nil {
+		t.Fatalf("secret was not created: %v", err)
+	}
+	if secret.Type != "Opaque" {
+		t.Errorf("secret type was %q, expected Opaque", secret.Type)
+	}
+
+	config, err = m.findSecretData("postgres")
+	if err != nil {
+		t.Fatalf("unexpected error finding secret: %v", err)
+	}
+	if config == nil || *config != *written {
+		t.Errorf("secret data was %v, expected %v", config, written)
+	}
+	if local := readLocalSecret(t, m, "postgres"); *local != *written {
+		t.Errorf("local secret was %v, expected %v", local, written)
+	}
+
+	// Writing again replaces the data, and completes any requested rotation
+	secret.Annotations = map[string]string{kope.RotateAnnotation: "true"}
+	secret.Data["other"] = []byte("kept")
+	_, err = client.UpdateSecret(secret)
+	if err != nil {
+		t.Fatalf("unexpected error updating secret: %v", err)
+	}
+	written.Password = "secret2"
+	err = m.writeSecretData("postgres", written)
+	if err != nil {
+		t.Fatalf("unexpected error writing secret: %v", err)
+	}
+
+	secret, _ = client.FindSecret("default", "postgres")
+	if kope.NeedsRotation(secret) {
+		t.Errorf("rotation was not cleared")
+	}
+	if string(secret.Data["other"]) != "kept" {
+		t.Errorf("other secret data was not kept")
+	}
+	config, _ = parseSecretData(secret)
+	if config == nil || config.Password != "secret2" {
+		t.Errorf("secret data was %v, expected password secret2", config)
+	}
+	if local := readLocalSecret(t, m, "postgres"); local.Password != "secret2" {
+		t.Errorf("local secret password was %q, expected secret2", local.Password)
+	}
+}
+
+// fakePsql answers the queries we run when setting passwords, recording the ALTER ROLE statements
+type fakePsql struct {
+	users   []string
+	fail    bool
+	altered []string
+	// onAlter (if set) is called when a password is changed
+	onAlter func()
+}
+
+func (f *fakePsql) run(ctx context.Context, sql string) (*sqlResults, error) {
+	results := &sqlResults{}
+	switch {
+	case strings.HasPrefix(sql, "SELECT * FROM pg_catalog.pg_user"):
+		results.Columns = []string{"usename"}
+		for _, user := range f.users {
+			if strings.Contains(sql, "E'"+user+"'") {
+				results.Rows = append(results.Rows, []string{user})
+			}
+		}
+	case strings.HasPrefix(sql, "ALTER ROLE"):
+		if f.fail {
+			return nil, fmt.Errorf("psql failed")
+		}
+		if f.onAlter != nil {
+			f.onAlter()
+		}
+		f.altered = append(f.altered, sql)
+	default:
+		return nil, fmt.Errorf("unexpected query %q", sql)
+	}
+	return results, nil
+}
+
+func TestRotatePassword(t *testing.T) {
+	m, client := newTestManager(t)
+	psql := &fakePsql{users: []string{"appuser"}}
+	m.psql = psql.run
+
+	err := m.writeSecretData("db-app", &PostgresSecretData{Db: "app", User: "appuser", Password: "old"})
+	if err != nil {
+		t.Fatalf("unexpected error writing secret: %v", err)
+	}
+	secret, _ := client.FindSecret("default", "db-app")
+
+	// The password must be changed in the database before it is written to the secret
+	psql.onAlter = func() {
+		current, _ := client.FindSecret("default", "db-app")
+		config, _ := parseSecretData(current)
+		if config == nil || config.Password != "old" {
+			t.Errorf("secret was updated before the password was changed")
+		}
+	}
+	err = m.rotatePassword(context.Background(), secret)
+	if err != nil {
+		t.Fatalf("unexpected error rotating password: %v", err)
+	}
+
+	secret, _ = client.FindSecret("default", "db-app")
+	config, err := parseSecretData(secret)
+	if err != nil || config == nil {
+		t.Fatalf("error reading rotated secret: %v", err)
+	}
+	if config.Db != "app" || config.User != "appuser" {
+		t.Errorf("rotation changed the db or user: %v", config)
+	}
+	if config.Password == "" || config.Password == "old" {
+		t.Errorf("password was not rotated: %q", config.Password)
+	}
+	if len(psql.altered) != 1 || !strings.Contains(psql.altered[0], config.Password) {
+		t.Errorf("password was not set in the database: %v", psql.altered)
+	}
+
+	// The rotated password is already applied, so the update to the secret needs no query
+	psql.altered = nil
+	err = m.passwordChanged(secret)
+	if err != nil || len(psql.altered) != 0 {
+		t.Errorf("password was set again after rotation: err=%v queries=%v", err, psql.altered)
+	}
+
+	// A secret without a user can't be rotated
+	empty := &api.Secret{}
+	empty.Name = "empty"
+	empty.Data = map[string][]byte{}
+	if err := m.rotatePassword(context.Background(), empty); err == nil {
+		t.Errorf("expected error rotating secret without a user")
+	}
+}
+
+func TestRotatePasswordFailure(t *testing.T) {
+	m, client := newTestManager(t)
+	m.psql = (&fakePsql{users: []string{"appuser"}, fail: true}).run
+
+	err := m.writeSecretData("db-app", &PostgresSecretData{Db: "app", User: "appuser", Password: "old"})
+	if err != nil {
+		t.Fatalf("unexpected error writing secret: %v", err)
+	}
+	secret, _ := client.FindSecret("default", "db-app")
+
+	if err := m.rotatePassword(context.Background(), secret); err == nil {
+		t.Errorf("expected error when the password could not be changed")
+	}
+	secret, _ = client.FindSecret("default", "db-app")
+	if config, _ := parseSecretData(secret); config == nil || config.Password != "old" {
+		t.Errorf("secret was changed although the password was not: %v", config)
+	}
+}
+
+func TestPasswordChanged(t *testing.T) {
+	m, _ := newTestManager(t)
+	psql := &fakePsql{users: []string{"appuser"}}
+	m.psql = psql.run
+
+	grid := []struct {
+		User     string
+		Password string
+		Expected string
+	}{
+		{"appuser", "simple", "ALTER ROLE appuser WITH PASSWORD E'simple'"},
+		// Users edit the secrets, so any character must be quoted rather than rejected
+		{"appuser", `it's @ "quoted" \ !`, `ALTER ROLE appuser WITH PASSWORD E'it''s @ "quoted" \\ !'`},
+		// Users that don't exist here are created (with the password) by the leader
+		{"missing", "x", ""},
+	}
+	for _, g := range grid {
+		psql.altered = nil
+		j, _ := json.Marshal(&PostgresSecretData{User: g.User, Password: g.Password})
+		secret := &api.Secret{}
+		secret.Name = "db-app"
+		secret.Data = map[string][]byte{"config.json": j}
+		err := m.passwordChanged(secret)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.Password, err)
+			continue
+		}
+		actual := strings.Join(psql.altered, ";")
+		if actual != g.Expected {
+			t.Errorf("%s: queries were %q, expected %q", g.Password, actual, g.Expected)
+		}
+	}
+}
+
+func TestEscapeSqlString(t *testing.T) {
+	grid := []struct {
+		Input    string
+		Expected string
+	}{
+		{"", "E''"},
+		{"abc-_ 123", "E'abc-_ 123'"},
+		{"it's", "E'it''s'"},
+		{`a\b`, `E'a\\b'`},
+		{"!@#$%^&*()", "E'!@#$%^&*()'"},
+		{"line\nbreak", "E'line\nbreak'"},
+	}
+	for _, g := range grid {
+		actual := escapeSqlString(g.Input)
+		if actual != g.Expected {
+			t.Errorf("escapeSqlString(%q) was %q, expected %q", g.Input, actual, g.Expected)
+		}
+	}
+}
+
+func TestPasswordChangedAlreadyApplied(t *testing.T) {
+	m, _ := newTestManager(t)
+	m.appliedPasswords = map[string]string{"postgres": "secret1"}
+
+	grid := []struct {
+		Name string
+		Data map[string][]byte
+	}{
+		{"no data", nil},
+		{"no config", map[string][]byte{"other": []byte("x")}},
+		{"no user", map[string][]byte{"config.json": []byte(`{"password":"x"}`)}},
+		{"unchanged", map[string][]byte{"config.json": []byte(`{"user":"postgres","password":"secret1"}`)}},
+	}
+	for _, g := range grid {
+		secret := &api.Secret{}
+		secret.Name = "postgres"
+		secret.Data = g.Data
+		// None of these should need to run psql
+		m.psql = func(ctx context.Context, sql string) (*sqlResults, error) {
+			t.Errorf("%s: unexpected query %q", g.Name, sql)
+			return nil, fmt.Errorf("unexpected query")
+		}
+		err := m.passwordChanged(secret)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.Name, err)
+		}
+	}
+}
+
+func TestParseSecretData(t *testing.T) {
+	grid := []struct {
+		Name     string
+		Data     map[string][]byte
+		Expected *PostgresSecretData
+		Error    bool
+	}{
+		{"no data", nil, nil, false},
+		{"no config.json", map[string][]byte{"other": []byte("x")}, nil, false},
+		{"invalid json", map[string][]byte{"config.json": []byte("{")}, nil, true},
+		{"empty", map[string][]byte{"config.json": []byte("{}")}, nil, true},
+		{
+			"valid",
+			map[string][]byte{"config.json": []byte(`{"db":"app","user":"appuser","password":"pw"}`)},
+			&PostgresSecretData{Db: "app", User: "appuser", Password: "pw"},
+			false,
+		},
+	}
+	for _, g := range grid {
+		secret := &api.Secret{}
+		secret.Data = g.Data
+		actual, err := parseSecretData(secret)
+		if g.Error {
+			if err == nil {
+				t.Errorf("%s: expected error", g.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.Name, err)
+			continue
+		}
+		if (actual == nil) != (g.Expected == nil) || (actual != nil && *actual != *g.Expected) {
+			t.Errorf("%s: data was %v, expected %v", g.Name, actual, g.Expected)
+		}
+	}
+}
+
+func TestRootSecretName(t *testing.T) {
+	m := &Manager{}
+	if m.rootSecretName() != "postgres" {
+		t.Errorf("root secret name without a cluster was %q", m.rootSecretName())
+	}
+	m.ClusterID = "orders"
+	if m.rootSecretName() != "orders" {
+		t.Errorf("root secret name in cluster orders was %q", m.rootSecretName())
+	}
+}
+
+func TestNeedsRestart(t *testing.T) {
+	started := Config{DataDir: "/data/db", SharedBuffersMB: 256, EffectiveCacheSizeMB: 768, WorkMemMB: 4, MaxWorkerProcesses: 2}
+
+	grid := []struct {
+		Name     string
+		Change   func(c *Config)
+		Expected bool
+	}{
+		{"unchanged", func(c *Config) {}, false},
+		{"effective_cache_size", func(c *Config) { c.EffectiveCacheSizeMB = 1024 }, false},
+		{"work_mem", func(c *Config) { c.WorkMemMB = 8 }, false},
+		{"shared_buffers", func(c *Config) { c.SharedBuffersMB = 512 }, true},
+		{"max_worker_processes", func(c *Config) { c.MaxWorkerProcesses = 4 }, true},
+	}
+	for _, g := range grid {
+		config := started
+		g.Change(&config)
+		actual := needsRestart(&started, &config)
+		if actual != g.Expected {
+			t.Errorf("%s: needsRestart was %v, expected %v", g.Name, actual, g.Expected)
+		}
+	}
+}
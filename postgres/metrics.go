@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connectionsCollector reports the number of connections, by state, from pg_stat_activity
+type connectionsCollector struct {
+	manager *Manager
+
+	connections *prometheus.Desc
+}
+
+var _ prometheus.Collector = &connectionsCollector{}
+
+func newConnectionsCollector(m *Manager) *connectionsCollector {
+	c := &connectionsCollector{manager: m}
+	c.connections = prometheus.NewDesc("kope_postgres_connections", "Number of connections to postgres, by state.", []string{"state"}, nil)
+	return c
+}
+
+func (c *connectionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connections
+}
+
+func (c *connectionsCollector) Collect(ch chan<- prometheus.Metric) {
+	results, err := c.manager.runPsql(context.Background(), "SELECT state, count(*) FROM pg_stat_activity GROUP BY state")
+	if err != nil {
+		glog.V(2).Info("error querying pg_stat_activity: ", err)
+		return
+	}
+
+	for _, row := range results.Rows {
+		if len(row) != 2 {
+			continue
+		}
+		state := row[0]
+		if state == "" {
+			state = "unknown"
+		}
+		count, err := strconv.ParseFloat(row[1], 64)
+		if err != nil {
+			glog.V(2).Infof("ignoring unexpected connection count %q", row[1])
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, count, state)
+	}
+}
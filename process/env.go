@@ -0,0 +1,93 @@
+package process
+
+import (
+	"os"
+	"strings"
+)
+
+// redacted replaces the values of secret environment variables when we log them
+const redacted = "<redacted>"
+
+// envName returns the name of the variable in a NAME=value entry
+func envName(entry string) string {
+	return strings.SplitN(entry, "=", 2)[0]
+}
+
+// matchesEnvName returns true if the name matches one of the patterns; a pattern ending in * matches by prefix
+func matchesEnvName(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// inheritedEnv returns the variables we pass through from the inherited environment
+func (p *ProcessConfig) inheritedEnv(inherited []string) []string {
+	if p.ClearEnv {
+		return nil
+	}
+	var env []string
+	for _, entry := range inherited {
+		name := envName(entry)
+		if len(p.EnvAllow) != 0 && !matchesEnvName(name, p.EnvAllow) {
+			continue
+		}
+		if matchesEnvName(name, p.EnvDeny) {
+			continue
+		}
+		env = append(env, entry)
+	}
+	return env
+}
+
+// environ builds the environment for the process from our own environment
+func (p *ProcessConfig) environ() []string {
+	return p.mergeEnv(os.Environ())
+}
+
+// mergeEnv builds the environment for the process: the inherited variables, overridden by Env and then by SecretEnv
+func (p *ProcessConfig) mergeEnv(inherited []string) []string {
+	env := p.inheritedEnv(inherited)
+	index := map[string]int{}
+	for i, entry := range env {
+		index[envName(entry)] = i
+	}
+
+	set := func(entry string) {
+		name := envName(entry)
+		if i, found := index[name]; found {
+			env[i] = entry
+		} else {
+			index[name] = len(env)
+			env = append(env, entry)
+		}
+	}
+	for _, entry := range p.Env {
+		set(entry)
+	}
+	for _, entry := range p.SecretEnv {
+		set(entry)
+	}
+
+	// An empty (but non-nil) environment, so that os/exec does not fall back to our own
+	if env == nil {
+		env = []string{}
+	}
+	return env
+}
+
+// describeEnv describes the variables we set explicitly (not those we inherit), for logging; secret values are redacted
+func (p *ProcessConfig) describeEnv() []string {
+	var env []string
+	env = append(env, p.Env...)
+	for _, entry := range p.SecretEnv {
+		env = append(env, envName(entry)+"="+redacted)
+	}
+	return env
+}
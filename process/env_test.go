@@ -0,0 +1,104 @@
+package process
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeEnv(t *testing.T) {
+	inherited := []string{"PATH=/bin", "HOME=/root", "KUBERNETES_SERVICE_HOST=10.0.0.1", "KUBERNETES_PORT=443", "SECRET=x"}
+
+	grid := []struct {
+		Name      string
+		ClearEnv  bool
+		EnvAllow  []string
+		EnvDeny   []string
+		Env       []string
+		SecretEnv []string
+		Expected  []string
+	}{
+		{
+			Name:     "inherit everything",
+			Expected: inherited,
+		},
+		{
+			Name:     "clear",
+			ClearEnv: true,
+			Env:      []string{"A=1"},
+			Expected: []string{"A=1"},
+		},
+		{
+			Name:     "clear with nothing set",
+			ClearEnv: true,
+			Expected: []string{},
+		},
+		{
+			Name:     "allow",
+			EnvAllow: []string{"PATH", "HOME"},
+			Expected: []string{"PATH=/bin", "HOME=/root"},
+		},
+		{
+			Name:     "allow by prefix",
+			EnvAllow: []string{"PATH", "KUBERNETES_*"},
+			Expected: []string{"PATH=/bin", "KUBERNETES_SERVICE_HOST=10.0.0.1", "KUBERNETES_PORT=443"},
+		},
+		{
+			Name:     "deny",
+			EnvDeny:  []string{"SECRET", "KUBERNETES_*"},
+			Expected: []string{"PATH=/bin", "HOME=/root"},
+		},
+		{
+			Name:     "deny overrides allow",
+			EnvAllow: []string{"KUBERNETES_*"},
+			EnvDeny:  []string{"KUBERNETES_PORT"},
+			Expected: []string{"KUBERNETES_SERVICE_HOST=10.0.0.1"},
+		},
+		{
+			Name:     "override keeps position",
+			EnvAllow: []string{"PATH", "HOME"},
+			Env:      []string{"HOME=/home/app", "PATH=/usr/bin", "A=1"},
+			Expected: []string{"PATH=/usr/bin", "HOME=/home/app", "A=1"},
+		},
+		{
+			Name:      "secret overrides env",
+			ClearEnv:  true,
+			Env:       []string{"A=1", "PASSWORD=default"},
+			SecretEnv: []string{"PASSWORD=hunter2"},
+			Expected:  []string{"A=1", "PASSWORD=hunter2"},
+		},
+		{
+			Name:     "value containing =",
+			ClearEnv: true,
+			Env:      []string{"OPTS=a=b", "OPTS=c=d"},
+			Expected: []string{"OPTS=c=d"},
+		},
+	}
+	for _, g := range grid {
+		p := &ProcessConfig{}
+		p.ClearEnv = g.ClearEnv
+		p.EnvAllow = g.EnvAllow
+		p.EnvDeny = g.EnvDeny
+		p.Env = g.Env
+		p.SecretEnv = g.SecretEnv
+
+		actual := p.mergeEnv(inherited)
+		if actual == nil || !reflect.DeepEqual(actual, g.Expected) {
+			t.Errorf("%s: environment was %v, expected %v", g.Name, actual, g.Expected)
+		}
+	}
+}
+
+func TestDescribeEnvRedactsSecrets(t *testing.T) {
+	p := &ProcessConfig{}
+	p.Env = []string{"A=1"}
+	p.SecretEnv = []string{"PASSWORD=hunter2"}
+
+	described := strings.Join(p.describeEnv(), " ")
+	if strings.Contains(described, "hunter2") {
+		t.Errorf("secret value was logged: %q", described)
+	}
+	if described != "A=1 PASSWORD="+redacted {
+		t.Errorf("unexpected description %q", described)
+	}
+}
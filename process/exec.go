@@ -0,0 +1,199 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/kopeio/kope/chained"
+)
+
+// How many lines of stderr we include in an ExitError
+const exitErrorStderrLines = 10
+
+// ExecOptions are the optional inputs & outputs for ExecContext
+type ExecOptions struct {
+	// Stdin (if set) is the input for the process
+	Stdin io.Reader
+	// Stdout (if set) receives the output as it is produced, instead of it being returned by ExecContext
+	Stdout io.Writer
+}
+
+// ExitError is the error when a process we ran exits unsuccessfully, or is killed because the context is done.
+// ExecContext wraps it (with chained); use AsExitError to find it.
+type ExitError struct {
+	Name string
+	// ExitCode is the exit code of the process, or -1 if it was killed by a signal
+	ExitCode int
+	// Signal is the signal that killed the process, if it was killed
+	Signal syscall.Signal
+	// Stderr is the last lines of stderr
+	Stderr []string
+	// Cause is the error from the context, if the process was killed because the context was done
+	Cause error
+}
+
+func (e *ExitError) Error() string {
+	var message string
+	if e.Cause != nil {
+		message = fmt.Sprintf("%s was killed: %v", e.Name, e.Cause)
+	} else if e.ExitCode == -1 {
+		message = fmt.Sprintf("%s was killed by signal %v", e.Name, e.Signal)
+	} else {
+		message = fmt.Sprintf("%s exited with code %d", e.Name, e.ExitCode)
+	}
+	if len(e.Stderr) != 0 {
+		message += "; stderr: " + strings.Join(e.Stderr, "\n")
+	}
+	return message
+}
+
+// AsExitError returns the ExitError the error was caused by, or nil
+func AsExitError(err error) *ExitError {
+	exitError, ok := chained.RootCause(err).(*ExitError)
+	if !ok {
+		return nil
+	}
+	return exitError
+}
+
+// ExecContext runs the process to completion, killing it if the context is done first.
+// It returns stdout (unless options.Stdout is set) and stderr; stderr is not echoed.
+// We read the output ourselves (rather than letting exec.Cmd copy it), so that we can stop reading
+// when the context is done: a child of the process could otherwise hold the pipes open indefinitely.
+func (p *ProcessConfig) ExecContext(ctx context.Context, options *ExecOptions) (string, string, error) {
+	if len(p.Argv) == 0 {
+		return "", "", fmt.Errorf("empty command line")
+	}
+	if options == nil {
+		options = &ExecOptions{}
+	}
+	argv, err := p.argv()
+	if err != nil {
+		return "", "", err
+	}
+	c := exec.Command(argv[0], argv[1:]...)
+	c.Dir = p.Dir
+	c.Env = p.environ()
+	c.SysProcAttr = p.sysProcAttr()
+
+	var stdinPipe io.WriteCloser
+	if options.Stdin != nil {
+		var err error
+		stdinPipe, err = c.StdinPipe()
+		if err != nil {
+			return "", "", fmt.Errorf("error creating stdin pipe: %v", err)
+		}
+	}
+
+	var stdout bytes.Buffer
+	stdoutWriter := io.Writer(&stdout)
+	if options.Stdout != nil {
+		stdoutWriter = options.Stdout
+	}
+	stdoutPipe, err := c.StdoutPipe()
+	if err != nil {
+		return "", "", fmt.Errorf("error creating stdout pipe: %v", err)
+	}
+	stderrPipe, err := c.StderrPipe()
+	if err != nil {
+		return "", "", fmt.Errorf("error creating stderr pipe: %v", err)
+	}
+	logs := newProcessLogs(p.name(), p.logConfig(), nil)
+	defer logs.close()
+
+	err = startChild(func() (int, error) {
+		err := c.Start()
+		if err != nil {
+			return 0, err
+		}
+		return c.Process.Pid, nil
+	})
+	if err != nil {
+		return "", "", chained.Error(err, "error starting", p.name())
+	}
+
+	proc := &Process{}
+	proc.process = c.Process
+	proc.group = p.Setpgid
+
+	if stdinPipe != nil {
+		go func() {
+			_, err := io.Copy(stdinPipe, options.Stdin)
+			if err != nil {
+				glog.V(2).Infof("error writing stdin of %s: %v", p.name(), err)
+			}
+			stdinPipe.Close()
+		}()
+	}
+
+	exited := make(chan struct{})
+	killed := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			close(killed)
+			_ = proc.Kill()
+			// A child of the process could be holding the pipes open
+			stdoutPipe.Close()
+			stderrPipe.Close()
+			if stdinPipe != nil {
+				stdinPipe.Close()
+			}
+		}
+	}()
+
+	// We must read all the output before calling Wait
+	stdoutDone := make(chan struct{})
+	go func() {
+		_, err := io.Copy(stdoutWriter, stdoutPipe)
+		if err != nil {
+			glog.V(2).Infof("error reading stdout of %s: %v", p.name(), err)
+		}
+		close(stdoutDone)
+	}()
+	var stderrBuffer bytes.Buffer
+	logs.copy("stderr", io.TeeReader(stderrPipe, &stderrBuffer))
+	<-stdoutDone
+
+	err = c.Wait()
+	close(exited)
+	releaseChild(c.Process.Pid)
+
+	stderr := stderrBuffer.String()
+	if err == nil {
+		return stdout.String(), stderr, nil
+	}
+	stderrLines := logs.tail.Lines()
+
+	exitError := &ExitError{}
+	exitError.Name = p.name()
+	exitError.ExitCode = -1
+	if len(stderrLines) > exitErrorStderrLines {
+		stderrLines = stderrLines[len(stderrLines)-exitErrorStderrLines:]
+	}
+	exitError.Stderr = stderrLines
+	select {
+	case <-killed:
+		exitError.Cause = ctx.Err()
+	default:
+	}
+	if c.ProcessState == nil || c.ProcessState.Success() {
+		// The process did not fail; we were not able to wait for it, or to copy its output
+		return stdout.String(), stderr, chained.Error(err, "error running", p.name())
+	}
+	if status, ok := c.ProcessState.Sys().(syscall.WaitStatus); ok {
+		if status.Signaled() {
+			exitError.Signal = status.Signal()
+		} else {
+			exitError.ExitCode = status.ExitStatus()
+		}
+	}
+	return stdout.String(), stderr, chained.Error(exitError, "error running", p.name())
+}
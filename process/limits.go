@@ -0,0 +1,89 @@
+package process
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+)
+
+// The rlimit resources (as in setrlimit(2)); the syscall package does not define all of them
+const (
+	RlimitCore    = syscall.RLIMIT_CORE
+	RlimitNofile  = syscall.RLIMIT_NOFILE
+	RlimitNproc   = 6
+	RlimitMemlock = 8
+)
+
+// RlimitInfinity means there is no limit
+const RlimitInfinity = ^uint64(0)
+
+// Rlimit is a resource limit (ulimit) for a process
+type Rlimit struct {
+	Resource int
+	Soft     uint64
+	Hard     uint64
+}
+
+func (r *Rlimit) String() string {
+	return fmt.Sprintf("%s=%s:%s", rlimitName(r.Resource), rlimitValue(r.Soft, 1), rlimitValue(r.Hard, 1))
+}
+
+func rlimitName(resource int) string {
+	switch resource {
+	case RlimitCore:
+		return "core"
+	case RlimitNofile:
+		return "nofile"
+	case RlimitNproc:
+		return "nproc"
+	case RlimitMemlock:
+		return "memlock"
+	default:
+		return strconv.Itoa(resource)
+	}
+}
+
+// rlimitValue formats a limit for ulimit, which takes some limits in units (of bytes) rather than bytes
+func rlimitValue(v uint64, unit uint64) string {
+	if v == RlimitInfinity {
+		return "unlimited"
+	}
+	return strconv.FormatUint(v/unit, 10)
+}
+
+// ulimitFlag returns the ulimit option for the resource, and the unit in which ulimit takes the value.
+// These are the options of dash and busybox (our images' /bin/sh); note that bash uses -u (not -p) for nproc.
+func ulimitFlag(resource int) (string, uint64, error) {
+	switch resource {
+	case RlimitCore:
+		return "-c", 512, nil
+	case RlimitNofile:
+		return "-n", 1, nil
+	case RlimitNproc:
+		return "-p", 1, nil
+	case RlimitMemlock:
+		return "-l", 1024, nil
+	default:
+		return "", 0, fmt.Errorf("rlimit resource %d is not supported", resource)
+	}
+}
+
+// ulimitScript returns the shell commands that set the limit.  We lower the soft limit first (in case we are lowering
+// the hard limit below it), then set the hard limit and then the soft limit.  The limits are raised in the shell
+// before it execs the command, so they apply from the start; if a limit cannot be set (e.g. raising a hard limit
+// needs CAP_SYS_RESOURCE) we warn on stderr and run the command anyway.
+func ulimitScript(limit *Rlimit) (string, error) {
+	flag, unit, err := ulimitFlag(limit.Resource)
+	if err != nil {
+		return "", err
+	}
+	soft := rlimitValue(limit.Soft, unit)
+	hard := rlimitValue(limit.Hard, unit)
+	return fmt.Sprintf("{ ulimit -S %s %s 2>/dev/null; ulimit -H %s %s && ulimit -S %s %s; } || echo \"unable to set rlimit %s\" >&2",
+		flag, soft, flag, hard, flag, soft, limit), nil
+}
+
+// oomScoreAdjScript returns the shell command that sets the OOM score adjustment; it is inherited across the exec
+func oomScoreAdjScript(score int) string {
+	return fmt.Sprintf("echo %d > /proc/self/oom_score_adj || echo \"unable to set oom_score_adj %d\" >&2", score, score)
+}
@@ -0,0 +1,66 @@
+package process
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestRlimitsApplyBeforeExec(t *testing.T) {
+	var current syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &current)
+	if err != nil {
+		t.Fatalf("error reading rlimit: %v", err)
+	}
+	if current.Max < 100 {
+		t.Skipf("hard nofile limit %d is too low to test", current.Max)
+	}
+
+	// Raising oom_score_adj does not need any privileges
+	oomScoreAdj := 500
+
+	config := &ProcessConfig{}
+	config.Argv = []string{"/bin/sh", "-c", "ulimit -n; cat /proc/self/oom_score_adj"}
+	config.Rlimits = []Rlimit{{Resource: RlimitNofile, Soft: 100, Hard: current.Max}}
+	config.OOMScoreAdj = &oomScoreAdj
+	stdout, stderr, err := config.Exec()
+	if err != nil {
+		t.Fatalf("unexpected error: %v (stderr %q)", err, stderr)
+	}
+	if stderr != "" {
+		t.Errorf("unexpected stderr: %q", stderr)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	expected := []string{"100", strconv.Itoa(oomScoreAdj)}
+	if len(lines) != len(expected) || lines[0] != expected[0] || lines[1] != expected[1] {
+		t.Errorf("output was %q, expected %q", lines, expected)
+	}
+}
+
+func TestUlimitScript(t *testing.T) {
+	grid := []struct {
+		Limit    Rlimit
+		Expected string
+	}{
+		{Rlimit{Resource: RlimitNofile, Soft: 1024, Hard: 4096}, "ulimit -H -n 4096 && ulimit -S -n 1024"},
+		{Rlimit{Resource: RlimitMemlock, Soft: RlimitInfinity, Hard: RlimitInfinity}, "ulimit -H -l unlimited && ulimit -S -l unlimited"},
+		{Rlimit{Resource: RlimitMemlock, Soft: 64 * 1024, Hard: 64 * 1024}, "ulimit -H -l 64 && ulimit -S -l 64"},
+	}
+	for _, g := range grid {
+		script, err := ulimitScript(&g.Limit)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", &g.Limit, err)
+			continue
+		}
+		if !strings.Contains(script, g.Expected) {
+			t.Errorf("%s: script %q did not contain %q", &g.Limit, script, g.Expected)
+		}
+	}
+
+	_, err := ulimitScript(&Rlimit{Resource: 99})
+	if err == nil {
+		t.Errorf("expected error for unsupported resource")
+	}
+}
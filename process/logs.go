@@ -0,0 +1,363 @@
+package process
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DefaultTailLines is how many lines of recent output we keep for each process
+	DefaultTailLines = 100
+	// DefaultMaxLogFileBytes is the size at which we rotate log files
+	DefaultMaxLogFileBytes = 10 * 1024 * 1024
+	// DefaultMaxLogFiles is how many log files we keep (including the current one)
+	DefaultMaxLogFiles = 5
+)
+
+// Lines longer than this are split, so that a process that never writes a newline can't use unbounded memory
+const maxLineLength = 64 * 1024
+
+// LogConfig controls how the output of a process is captured
+type LogConfig struct {
+	// JSON writes each line as a JSON object, instead of as prefixed text; set with LOG_FORMAT=json
+	JSON bool
+	// Dir is where we also write the output to (rotating) log files, if set; set with LOG_DIR (e.g. /data/logs)
+	Dir string
+	// MaxFileBytes is the size at which we rotate the log file
+	MaxFileBytes int64
+	// MaxFiles is how many log files we keep
+	MaxFiles int
+	// TailLines is how many recent lines we keep in memory (see Process.RecentOutput)
+	TailLines int
+}
+
+// DefaultLogConfig builds the log configuration from the environment
+func DefaultLogConfig() *LogConfig {
+	c := &LogConfig{}
+	c.JSON = os.Getenv("LOG_FORMAT") == "json"
+	c.Dir = os.Getenv("LOG_DIR")
+	c.MaxFileBytes = DefaultMaxLogFileBytes
+	c.MaxFiles = DefaultMaxLogFiles
+	c.TailLines = DefaultTailLines
+	return c
+}
+
+// LogMultiplexer writes the output of all our processes, a line at a time, so that lines are never interleaved
+type LogMultiplexer struct {
+	mutex  sync.Mutex
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// DefaultLogMultiplexer writes to our own stdout & stderr
+var DefaultLogMultiplexer = NewLogMultiplexer(os.Stdout, os.Stderr)
+
+func NewLogMultiplexer(stdout io.Writer, stderr io.Writer) *LogMultiplexer {
+	m := &LogMultiplexer{}
+	m.stdout = stdout
+	m.stderr = stderr
+	return m
+}
+
+func (m *LogMultiplexer) writeLine(stream string, line []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	w := m.stdout
+	if stream == "stderr" {
+		w = m.stderr
+	}
+	_, err := w.Write(line)
+	if err != nil {
+		glog.V(2).Infof("error writing log line: %v", err)
+	}
+}
+
+// LogTail is a ring buffer of the most recent lines
+type LogTail struct {
+	mutex sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func NewLogTail(size int) *LogTail {
+	if size <= 0 {
+		size = DefaultTailLines
+	}
+	t := &LogTail{}
+	t.lines = make([]string, size)
+	return t
+}
+
+// Add records a line, discarding the oldest if the buffer is full
+func (t *LogTail) Add(line string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.lines[t.next] = line
+	t.next++
+	if t.next == len(t.lines) {
+		t.next = 0
+		t.full = true
+	}
+}
+
+// Lines returns the lines we have, oldest first
+func (t *LogTail) Lines() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var lines []string
+	if t.full {
+		lines = append(lines, t.lines[t.next:]...)
+	}
+	lines = append(lines, t.lines[:t.next]...)
+	return lines
+}
+
+// RotatingFile is a log file that is rotated (to <path>.1, <path>.2 ...) when it reaches a maximum size
+type RotatingFile struct {
+	mutex    sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	file *os.File
+	size int64
+
+	// refs counts the users of a shared file (see openSharedFile); it is guarded by sharedFilesMutex
+	refs int
+}
+
+// Processes with the same name (e.g. concurrent Exec calls of the same command) log to the same path;
+// they share one RotatingFile, so that they agree on the size, and only one of them rotates the file.
+var (
+	sharedFilesMutex sync.Mutex
+	sharedFiles      = map[string]*RotatingFile{}
+)
+
+// openSharedFile returns the RotatingFile for the path, creating it if no one else has it open.
+// The caller must call closeSharedFile when done with it.
+func openSharedFile(p string, maxBytes int64, maxFiles int) *RotatingFile {
+	sharedFilesMutex.Lock()
+	defer sharedFilesMutex.Unlock()
+
+	f := sharedFiles[p]
+	if f == nil {
+		f = NewRotatingFile(p, maxBytes, maxFiles)
+		sharedFiles[p] = f
+	}
+	f.refs++
+	return f
+}
+
+// closeSharedFile releases a file from openSharedFile, closing it when the last user is done
+func closeSharedFile(f *RotatingFile) error {
+	sharedFilesMutex.Lock()
+	defer sharedFilesMutex.Unlock()
+
+	f.refs--
+	if f.refs > 0 {
+		return nil
+	}
+	delete(sharedFiles, f.path)
+	return f.Close()
+}
+
+func NewRotatingFile(p string, maxBytes int64, maxFiles int) *RotatingFile {
+	f := &RotatingFile{}
+	f.path = p
+	f.maxBytes = maxBytes
+	f.maxFiles = maxFiles
+	return f
+}
+
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// We open the file first, so that existing contents (e.g. from before a restart) count towards the size
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxBytes {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+		err = f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) open() error {
+	err := os.MkdirAll(path.Dir(f.path), 0755)
+	if err != nil {
+		return fmt.Errorf("error creating log directory: %v", err)
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening log file %s: %v", f.path, err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error reading log file %s: %v", f.path, err)
+	}
+	f.file = file
+	f.size = stat.Size()
+	return nil
+}
+
+// rotate closes the current file, and shifts the old files along (deleting the oldest)
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		glog.Warningf("error closing log file %s: %v", f.path, err)
+	}
+
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		src := f.path
+		if i > 1 {
+			src += "." + strconv.Itoa(i-1)
+		}
+		err := os.Rename(src, f.path+"."+strconv.Itoa(i))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error rotating log file %s: %v", src, err)
+		}
+	}
+	if f.maxFiles <= 1 {
+		err := os.Remove(f.path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing log file %s: %v", f.path, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the current file
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// processLogs captures the output of one process; if mux is nil, the output is not echoed
+type processLogs struct {
+	name   string
+	config *LogConfig
+	mux    *LogMultiplexer
+	tail   *LogTail
+	file   *RotatingFile
+}
+
+func newProcessLogs(name string, config *LogConfig, mux *LogMultiplexer) *processLogs {
+	l := &processLogs{}
+	l.name = name
+	l.config = config
+	l.mux = mux
+	l.tail = NewLogTail(config.TailLines)
+	if config.Dir != "" {
+		l.file = openSharedFile(path.Join(config.Dir, name+".log"), config.MaxFileBytes, config.MaxFiles)
+	}
+	return l
+}
+
+// logLine is the format of a line when we are writing JSON
+type logLine struct {
+	Time    time.Time `json:"time"`
+	Process string    `json:"process"`
+	Stream  string    `json:"stream"`
+	Message string    `json:"message"`
+}
+
+func (l *processLogs) format(stream string, line string) []byte {
+	if l.config.JSON {
+		b, err := json.Marshal(&logLine{Time: time.Now().UTC(), Process: l.name, Stream: stream, Message: line})
+		if err == nil {
+			return append(b, '\n')
+		}
+		glog.V(2).Infof("error formatting log line as JSON: %v", err)
+	}
+	return []byte("[" + l.name + "] " + line + "\n")
+}
+
+func (l *processLogs) writeLine(stream string, line string) {
+	l.tail.Add(line)
+
+	formatted := l.format(stream, line)
+	if l.mux != nil {
+		l.mux.writeLine(stream, formatted)
+	}
+	if l.file != nil {
+		_, err := l.file.Write(formatted)
+		if err != nil {
+			glog.V(2).Infof("error writing to log file: %v", err)
+		}
+	}
+}
+
+// copy reads the stream until EOF, writing each line
+func (l *processLogs) copy(stream string, r io.Reader) {
+	var partial []byte
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buffer)
+		partial = append(partial, buffer[:n]...)
+		for {
+			i := bytes.IndexByte(partial, '\n')
+			if i == -1 {
+				break
+			}
+			l.writeLine(stream, string(bytes.TrimSuffix(partial[:i], []byte("\r"))))
+			partial = partial[i+1:]
+		}
+		if len(partial) > maxLineLength {
+			l.writeLine(stream, string(partial))
+			partial = nil
+		}
+		if err != nil {
+			if err != io.EOF {
+				glog.V(2).Infof("error reading %s of %s: %v", stream, l.name, err)
+			}
+			break
+		}
+	}
+	if len(partial) != 0 {
+		l.writeLine(stream, string(partial))
+	}
+}
+
+func (l *processLogs) close() {
+	if l.file != nil {
+		err := closeSharedFile(l.file)
+		if err != nil {
+			glog.V(2).Infof("error closing log file: %v", err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package process
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLogTail(t *testing.T) {
+	grid := []struct {
+		Size     int
+		Add      []string
+		Expected []string
+	}{
+		{3, nil, nil},
+		{3, []string{"a"}, []string{"a"}},
+		{3, []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{3, []string{"a", "b", "c", "d"}, []string{"b", "c", "d"}},
+		{3, []string{"a", "b", "c", "d", "e", "f", "g"}, []string{"e", "f", "g"}},
+		{1, []string{"a", "b"}, []string{"b"}},
+	}
+	for _, g := range grid {
+		tail := NewLogTail(g.Size)
+		for _, line := range g.Add {
+			tail.Add(line)
+		}
+		actual := tail.Lines()
+		if !reflect.DeepEqual(actual, g.Expected) {
+			t.Errorf("size %d, added %v: lines were %v, expected %v", g.Size, g.Add, actual, g.Expected)
+		}
+	}
+
+	if len(NewLogTail(0).lines) != DefaultTailLines {
+		t.Errorf("expected a zero size to use the default")
+	}
+}
+
+func readLogFiles(t *testing.T, dir string) map[string]string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("error reading dir: %v", err)
+	}
+	contents := map[string]string{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatalf("error reading file: %v", err)
+		}
+		contents[f.Name()] = string(b)
+	}
+	return contents
+}
+
+func TestRotatingFile(t *testing.T) {
+	grid := []struct {
+		MaxFiles int
+		Writes   []string
+		Expected map[string]string
+	}{
+		{
+			MaxFiles: 3,
+			Writes:   []string{"aaaa\n", "bbbb\n"},
+			Expected: map[string]string{"test.log": "aaaa\nbbbb\n"},
+		},
+		{
+			MaxFiles: 3,
+			Writes:   []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			Expected: map[string]string{"test.log": "cccc\n", "test.log.1": "aaaa\nbbbb\n"},
+		},
+		{
+			MaxFiles: 3,
+			Writes:   []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffff\n", "gggg\n"},
+			Expected: map[string]string{"test.log": "gggg\n", "test.log.1": "eeee\nffff\n", "test.log.2": "cccc\ndddd\n"},
+		},
+		{
+			MaxFiles: 1,
+			Writes:   []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			Expected: map[string]string{"test.log": "cccc\n"},
+		},
+		{
+			// A write bigger than the limit still goes to a (new) file
+			MaxFiles: 2,
+			Writes:   []string{"aaaa\n", strings.Repeat("x", 20) + "\n"},
+			Expected: map[string]string{"test.log": strings.Repeat("x", 20) + "\n", "test.log.1": "aaaa\n"},
+		},
+	}
+	for i, g := range grid {
+		dir := t.TempDir()
+		f := NewRotatingFile(path.Join(dir, "test.log"), 10, g.MaxFiles)
+		for _, w := range g.Writes {
+			n, err := f.Write([]byte(w))
+			if err != nil || n != len(w) {
+				t.Fatalf("case %d: error writing: n=%d err=%v", i, n, err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("case %d: error closing: %v", i, err)
+		}
+
+		actual := readLogFiles(t, dir)
+		if !reflect.DeepEqual(actual, g.Expected) {
+			t.Errorf("case %d: files were %v, expected %v", i, actual, g.Expected)
+		}
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	dir := t.TempDir()
+	p := path.Join(dir, "test.log")
+	err := ioutil.WriteFile(p, []byte("aaaa\nbbbb\n"), 0644)
+	if err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	// The existing contents count towards the size, so the first write rotates
+	f := NewRotatingFile(p, 10, 2)
+	for _, w := range []string{"cccc\n", "dddd\n"} {
+		if _, err := f.Write([]byte(w)); err != nil {
+			t.Fatalf("error writing: %v", err)
+		}
+	}
+	f.Close()
+
+	actual := readLogFiles(t, dir)
+	expected := map[string]string{"test.log": "cccc\ndddd\n", "test.log.1": "aaaa\nbbbb\n"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("files were %v, expected %v", actual, expected)
+	}
+
+	if _, err := os.Stat(p + ".2"); !os.IsNotExist(err) {
+		t.Errorf("expected only one old file to be kept")
+	}
+}
+
+func TestProcessLogsShareFile(t *testing.T) {
+	config := &LogConfig{}
+	config.Dir = t.TempDir()
+	config.MaxFileBytes = 100
+	config.MaxFiles = 100
+
+	a := newProcessLogs("test", config, nil)
+	b := newProcessLogs("test", config, nil)
+	if a.file != b.file {
+		t.Fatalf("expected processes with the same name to share a log file")
+	}
+
+	var wg sync.WaitGroup
+	for _, l := range []*processLogs{a, b} {
+		wg.Add(1)
+		go func(l *processLogs) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				l.writeLine("stdout", "line")
+			}
+		}(l)
+	}
+	wg.Wait()
+	a.close()
+	b.close()
+
+	if len(sharedFiles) != 0 {
+		t.Errorf("expected the shared file to be released, found %v", sharedFiles)
+	}
+
+	lines := 0
+	for name, contents := range readLogFiles(t, config.Dir) {
+		if int64(len(contents)) > config.MaxFileBytes {
+			t.Errorf("%s was %d bytes, larger than the maximum %d", name, len(contents), config.MaxFileBytes)
+		}
+		lines += strings.Count(contents, "\n")
+	}
+	if lines != 100 {
+		t.Errorf("found %d lines in the log files, expected %d", lines, 100)
+	}
+}
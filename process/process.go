@@ -1,80 +1,245 @@
 package process
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/kopeio/kope/user"
 	"os"
-	"os/exec"
+	"path"
 	"strings"
 	"syscall"
+	"time"
 )
 
+// How long we wait for the output of a process to be drained after it exits;
+// a daemonized child could otherwise keep the pipes open forever
+const drainTimeout = 5 * time.Second
+
 type ProcessConfig struct {
 	Argv []string
 
 	Dir string
+	// Env overrides (or adds to) the environment the process inherits from us, as NAME=value entries
 	Env []string
+	// SecretEnv is like Env, but the values are never logged
+	SecretEnv []string
+	// ClearEnv stops the process inheriting our environment; it gets only Env and SecretEnv
+	ClearEnv bool
+	// EnvAllow (if set) limits the variables that are inherited to those named; a name ending in * matches by prefix
+	EnvAllow []string
+	// EnvDeny names variables that are not inherited; a name ending in * matches by prefix
+	EnvDeny []string
 
 	Credential *syscall.Credential
+	// Groups are supplementary groups for the process
+	Groups []uint32
+
+	// Umask (if set) is the umask for the process (e.g. 0027).  The umask is shared by all our threads,
+	// so we set it in the child, by running the command through /bin/sh.
+	Umask *int
+	// Rlimits are the resource limits (ulimits) for the process.  Like the umask, they are set by running
+	// the command through /bin/sh, so they apply before the command starts.
+	Rlimits []Rlimit
+	// OOMScoreAdj (if set) adjusts how likely the process is to be picked by the OOM killer (-1000 to 1000);
+	// it is also set through /bin/sh
+	OOMScoreAdj *int
+	// Setpgid runs the process in its own process group; signals are then sent to the whole group,
+	// so that processes started by wrapper scripts are also stopped
+	Setpgid bool
+
+	// Name labels the output of the process; the default is the name of the command
+	Name string
+	// Logs controls how the output is captured; if nil we use DefaultLogConfig
+	Logs *LogConfig
 }
 
 type Process struct {
 	process *os.Process
+	// group is true if the process leads its own process group
+	group bool
+
+	logs *processLogs
+	// drained is closed once we have read all the output
+	drained chan struct{}
 }
 
-func (p *ProcessConfig) Exec() (string, string, error) {
-	if len(p.Argv) == 0 {
-		return "", "", fmt.Errorf("empty command line")
+func (p *ProcessConfig) name() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return path.Base(p.Argv[0])
+}
+
+func (p *ProcessConfig) logConfig() *LogConfig {
+	if p.Logs != nil {
+		return p.Logs
+	}
+	return DefaultLogConfig()
+}
+
+// sysProcAttr builds the attributes we set when starting the process
+func (p *ProcessConfig) sysProcAttr() *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{}
+	if p.Credential != nil || len(p.Groups) != 0 {
+		credential := &syscall.Credential{}
+		if p.Credential != nil {
+			*credential = *p.Credential
+		} else {
+			credential.Uid = uint32(os.Getuid())
+			credential.Gid = uint32(os.Getgid())
+		}
+		credential.Groups = append(append([]uint32{}, credential.Groups...), p.Groups...)
+		attr.Credential = credential
 	}
-	name := p.Argv[0]
-	args := p.Argv[1:]
-	c := exec.Command(name, args...)
-	c.SysProcAttr = &syscall.SysProcAttr{}
+	attr.Setpgid = p.Setpgid
+	return attr
+}
 
-	if p.Credential != nil {
-		c.SysProcAttr.Credential = p.Credential
+// argv returns the command line to run.  If Umask, Rlimits or OOMScoreAdj is set, the command is run through /bin/sh,
+// which sets them and then execs the command (the command is passed as arguments, so it does not need quoting)
+func (p *ProcessConfig) argv() ([]string, error) {
+	var commands []string
+	for i := range p.Rlimits {
+		command, err := ulimitScript(&p.Rlimits[i])
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+	if p.OOMScoreAdj != nil {
+		commands = append(commands, oomScoreAdjScript(*p.OOMScoreAdj))
+	}
+	if len(commands) == 0 && p.Umask == nil {
+		return p.Argv, nil
 	}
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	c.Stdout = &stdout
-	c.Stderr = &stderr
+	exec := "exec \"$0\" \"$@\""
+	if p.Umask != nil {
+		exec = fmt.Sprintf("umask %04o && ", *p.Umask) + exec
+	}
+	commands = append(commands, exec)
+	script := strings.Join(commands, "; ")
+	return append([]string{"/bin/sh", "-c", script}, p.Argv...), nil
+}
 
-	err := c.Run()
-	return string(stdout.Bytes()), string(stderr.Bytes()), err
+// Exec runs the process to completion, returning its stdout and stderr
+func (p *ProcessConfig) Exec() (string, string, error) {
+	return p.ExecContext(context.Background(), nil)
 }
 
 func (p *ProcessConfig) Start() (*Process, error) {
-	argv := p.Argv
+	argv, err := p.argv()
+	if err != nil {
+		return nil, err
+	}
 	name := argv[0]
 
 	attr := &os.ProcAttr{}
 	attr.Dir = p.Dir
-	attr.Env = p.Env
+	attr.Env = p.environ()
 
-	attr.Files = []*os.File{os.Stdin, os.Stdout, os.Stderr}
-
-	attr.Sys = &syscall.SysProcAttr{}
-	if p.Credential != nil {
-		attr.Sys.Credential = p.Credential
+	logs := newProcessLogs(p.name(), p.logConfig(), DefaultLogMultiplexer)
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating stdout pipe: %v", err)
 	}
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdoutReader.Close()
+		stdoutWriter.Close()
+		return nil, fmt.Errorf("error creating stderr pipe: %v", err)
+	}
+	attr.Files = []*os.File{os.Stdin, stdoutWriter, stderrWriter}
+
+	attr.Sys = p.sysProcAttr()
 
-	glog.Info("Running: ", strings.Join(argv, " "))
-	process, err := os.StartProcess(name, argv, attr)
+	glog.Info("Running: ", strings.Join(append(p.describeEnv(), argv...), " "))
+	var process *os.Process
+	err = startChild(func() (int, error) {
+		var err error
+		process, err = os.StartProcess(name, argv, attr)
+		if err != nil {
+			return 0, err
+		}
+		return process.Pid, nil
+	})
+
+	// The child has its own copies of the write ends; we must close ours so that we see EOF when it exits
+	stdoutWriter.Close()
+	stderrWriter.Close()
 
 	if err != nil {
+		stdoutReader.Close()
+		stderrReader.Close()
 		return nil, err
 	}
 
 	proc := &Process{}
 	proc.process = process
+	proc.group = p.Setpgid
+	proc.logs = logs
+	proc.drained = make(chan struct{})
+
+	copied := make(chan struct{}, 2)
+	go func() {
+		logs.copy("stdout", stdoutReader)
+		stdoutReader.Close()
+		copied <- struct{}{}
+	}()
+	go func() {
+		logs.copy("stderr", stderrReader)
+		stderrReader.Close()
+		copied <- struct{}{}
+	}()
+	go func() {
+		<-copied
+		<-copied
+		logs.close()
+		close(proc.drained)
+	}()
+
 	return proc, nil
 }
 
 func (p *Process) Wait() (*os.ProcessState, error) {
-	return p.process.Wait()
+	state, err := p.process.Wait()
+	releaseChild(p.process.Pid)
+
+	// Make sure we have captured the last of the output (e.g. for crash reports)
+	select {
+	case <-p.drained:
+	case <-time.After(drainTimeout):
+		glog.Warningf("output of process %d not closed after exit; not waiting for it", p.process.Pid)
+	}
+	return state, err
+}
+
+// RecentOutput returns the most recent lines of output (stdout and stderr), oldest first
+func (p *Process) RecentOutput() []string {
+	return p.logs.tail.Lines()
+}
+
+func (p *Process) Pid() int {
+	return p.process.Pid
+}
+
+// Signal sends a signal to the process (or to its process group, if it was started with Setpgid)
+func (p *Process) Signal(sig os.Signal) error {
+	if p.group {
+		if s, ok := sig.(syscall.Signal); ok {
+			return syscall.Kill(-p.process.Pid, s)
+		}
+	}
+	return p.process.Signal(sig)
+}
+
+// Kill forcibly terminates the process (or its process group, if it was started with Setpgid)
+func (p *Process) Kill() error {
+	if p.group {
+		return syscall.Kill(-p.process.Pid, syscall.SIGKILL)
+	}
+	return p.process.Kill()
 }
 
 func (p *ProcessConfig) SetCredential(user *user.User) {
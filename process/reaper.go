@@ -0,0 +1,153 @@
+package process
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// When we run as PID 1 (as we do in our images), orphaned processes are re-parented to us,
+// and nobody will reap them unless we do.  But we can't simply wait4(-1), because that
+// would steal the exit status of the children we started (and are waiting on) ourselves.
+//
+// Instead, we track the children we start ("owned" children), and the reaper only reaps
+// zombies that are not owned.  The mutex is held while starting a child and registering it,
+// and while the reaper is scanning, so the reaper can never see an unregistered owned child.
+
+const reaperInterval = 30 * time.Second
+
+var reaper struct {
+	mutex   sync.Mutex
+	owned   map[int]bool
+	started bool
+}
+
+// startChild starts a child process (via the start function) and registers it as owned.
+func startChild(start func() (int, error)) error {
+	reaper.mutex.Lock()
+	defer reaper.mutex.Unlock()
+
+	pid, err := start()
+	if err != nil {
+		return err
+	}
+	if reaper.owned == nil {
+		reaper.owned = make(map[int]bool)
+	}
+	reaper.owned[pid] = true
+	return nil
+}
+
+// releaseChild must be called once we have waited for an owned child
+func releaseChild(pid int) {
+	reaper.mutex.Lock()
+	defer reaper.mutex.Unlock()
+
+	delete(reaper.owned, pid)
+}
+
+// StartReaper reaps orphaned (zombie) processes, for when we are running as init (PID 1)
+func StartReaper() {
+	reaper.mutex.Lock()
+	defer reaper.mutex.Unlock()
+
+	if reaper.started {
+		return
+	}
+	reaper.started = true
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGCHLD)
+
+	go func() {
+		// SIGCHLD signals can be coalesced, so we also scan periodically
+		ticker := time.NewTicker(reaperInterval)
+		for {
+			select {
+			case <-signals:
+			case <-ticker.C:
+			}
+			reapOrphans()
+		}
+	}()
+}
+
+func reapOrphans() {
+	reaper.mutex.Lock()
+	defer reaper.mutex.Unlock()
+
+	zombies, err := findZombieChildren()
+	if err != nil {
+		glog.Warning("error finding zombie processes: ", err)
+		return
+	}
+
+	for _, pid := range zombies {
+		if reaper.owned[pid] {
+			continue
+		}
+
+		var status syscall.WaitStatus
+		wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+		if err != nil {
+			glog.V(2).Infof("error reaping process %d: %v", pid, err)
+			continue
+		}
+		if wpid == pid {
+			glog.V(2).Infof("reaped orphaned process %d (exit status %d)", pid, status.ExitStatus())
+		}
+	}
+}
+
+// findZombieChildren returns the pids of our children that have exited but not been reaped
+func findZombieChildren() ([]int, error) {
+	self := os.Getpid()
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var zombies []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		stat, err := ioutil.ReadFile(path.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			// Most likely the process has gone away
+			continue
+		}
+
+		// Format is "pid (comm) state ppid ..."; comm can contain spaces and parentheses
+		s := string(stat)
+		end := strings.LastIndex(s, ")")
+		if end == -1 {
+			continue
+		}
+		fields := strings.Fields(s[end+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		state := fields[0]
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+
+		if state == "Z" && ppid == self {
+			zombies = append(zombies, pid)
+		}
+	}
+	return zombies, nil
+}
@@ -0,0 +1,380 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	DefaultInitialBackoff = 1 * time.Second
+	DefaultMaxBackoff     = 60 * time.Second
+
+	// DefaultMaxCrashes is the number of consecutive crashes we tolerate before giving up
+	DefaultMaxCrashes = 5
+
+	// DefaultStableAfter is how long a process must run before we forget about previous crashes
+	DefaultStableAfter = 10 * time.Minute
+)
+
+// ExitStatus records how (and when) a supervised process exited
+type ExitStatus struct {
+	Time  time.Time
+	State *os.ProcessState
+	Err   error
+
+	// Output is the most recent output of the process (see Process.RecentOutput)
+	Output []string
+}
+
+// Tail returns the last n lines of the output
+func (e *ExitStatus) Tail(n int) []string {
+	if len(e.Output) <= n {
+		return e.Output
+	}
+	return e.Output[len(e.Output)-n:]
+}
+
+func (e *ExitStatus) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("error waiting for process: %v", e.Err)
+	}
+	if e.State == nil {
+		return "unknown"
+	}
+	return e.State.String()
+}
+
+// StopFunc asks the process to shut down; the context is cancelled when the grace period expires (and the process is killed)
+type StopFunc func(ctx context.Context, p *Process) error
+
+// Supervisor keeps a process running, restarting it with exponential backoff when it exits.
+// If the process keeps crashing, the supervisor gives up so that the manager can exit,
+// and kubernetes can restart the whole pod.
+type Supervisor struct {
+	// Starts (or restarts) the process
+	StartFunc func() (*Process, error)
+
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxCrashes     int
+	StableAfter    time.Duration
+
+	// OnRestart (if set) is called when the process has exited and we are going to restart it;
+	// requested is true if the restart was requested (by Restart), false if the process crashed
+	OnRestart func(exit *ExitStatus, requested bool)
+
+	mutex     sync.Mutex
+	process   *Process
+	startedAt time.Time
+	exited    chan struct{}
+	restarts  int
+	crashes   int
+	lastExit  *ExitStatus
+
+	stopping         bool
+	stopCh           chan struct{}
+	restartRequested bool
+}
+
+func NewSupervisor(startFunc func() (*Process, error)) *Supervisor {
+	s := &Supervisor{}
+	s.StartFunc = startFunc
+	s.InitialBackoff = DefaultInitialBackoff
+	s.MaxBackoff = DefaultMaxBackoff
+	s.MaxCrashes = DefaultMaxCrashes
+	s.StableAfter = DefaultStableAfter
+	s.stopCh = make(chan struct{})
+	return s
+}
+
+// Process returns the currently running process, or nil if it is not running
+func (s *Supervisor) Process() *Process {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.process
+}
+
+// Uptime returns how long the current process has been running, or 0 if it is not running
+func (s *Supervisor) Uptime() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.process == nil {
+		return 0
+	}
+	return time.Since(s.startedAt)
+}
+
+// Restarts returns the number of times the process has been restarted
+func (s *Supervisor) Restarts() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.restarts
+}
+
+// LastExit returns the exit status of the most recent exit, or nil if the process has not exited
+func (s *Supervisor) LastExit() *ExitStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastExit
+}
+
+// Run supervises the process, which may already have been started (if p is non-nil).
+// It returns nil once the process has exited after a call to Stop,
+// or an error if the process is crash-looping.
+func (s *Supervisor) Run(p *Process) error {
+	var r *registration
+	if p != nil {
+		r = s.register(p)
+		if r == nil {
+			return nil
+		}
+	}
+	return s.run(p, r)
+}
+
+// Go supervises an already-started process in the background (as Run does), sending the result of Run on the returned channel.
+// Unlike calling Run in a goroutine, the process is registered before Go returns, so that a Stop from then on stops it cleanly.
+func (s *Supervisor) Go(p *Process) <-chan error {
+	result := make(chan error, 1)
+	r := s.register(p)
+	if r == nil {
+		result <- nil
+		return result
+	}
+	go func() {
+		result <- s.run(p, r)
+	}()
+	return result
+}
+
+// registration records when the current process was started, and is closed when it exits
+type registration struct {
+	startedAt time.Time
+	exited    chan struct{}
+}
+
+// register makes p the current process; if we are stopping, it kills p instead and returns nil
+func (s *Supervisor) register(p *Process) *registration {
+	s.mutex.Lock()
+	if s.stopping {
+		s.mutex.Unlock()
+		glog.Info("supervisor is stopping; killing newly started process")
+		_ = p.Kill()
+		_, _ = p.Wait()
+		return nil
+	}
+	defer s.mutex.Unlock()
+
+	r := &registration{}
+	r.startedAt = time.Now()
+	r.exited = make(chan struct{})
+	s.process = p
+	s.startedAt = r.startedAt
+	s.exited = r.exited
+	return r
+}
+
+// run is the supervision loop; p (if non-nil) has already been registered as r
+func (s *Supervisor) run(p *Process, r *registration) error {
+	for {
+		if p == nil {
+			if s.isStopping() {
+				return nil
+			}
+
+			var err error
+			p, err = s.StartFunc()
+			if err != nil {
+				glog.Warning("error starting process: ", err)
+				exit := &ExitStatus{Time: time.Now(), Err: err}
+				if giveUp := s.recordExit(exit, 0); giveUp {
+					return fmt.Errorf("process failed to start %d times; giving up: %v", s.MaxCrashes, err)
+				}
+				s.sleepBackoff()
+				continue
+			}
+
+			r = s.register(p)
+			if r == nil {
+				return nil
+			}
+		}
+		startedAt := r.startedAt
+
+		state, err := p.Wait()
+
+		s.mutex.Lock()
+		s.process = nil
+		s.exited = nil
+		s.mutex.Unlock()
+		close(r.exited)
+
+		exit := &ExitStatus{Time: time.Now(), State: state, Err: err, Output: p.RecentOutput()}
+		if s.isStopping() {
+			glog.Infof("process exited during shutdown: %s", exit)
+			s.mutex.Lock()
+			s.lastExit = exit
+			s.mutex.Unlock()
+			return nil
+		}
+
+		s.mutex.Lock()
+		restartRequested := s.restartRequested
+		s.restartRequested = false
+		if restartRequested {
+			s.lastExit = exit
+			s.restarts++
+		}
+		s.mutex.Unlock()
+		if restartRequested {
+			glog.Infof("process exited for restart: %s", exit)
+			if s.OnRestart != nil {
+				s.OnRestart(exit, true)
+			}
+			p = nil
+			continue
+		}
+
+		glog.Warningf("process exited after %v: %s", exit.Time.Sub(startedAt), exit)
+		if len(exit.Output) != 0 {
+			glog.Warningf("last output of process before it exited:\n%s", strings.Join(exit.Output, "\n"))
+		}
+		if giveUp := s.recordExit(exit, exit.Time.Sub(startedAt)); giveUp {
+			return fmt.Errorf("process exited %d times in quick succession; giving up (last exit: %s)", s.MaxCrashes, exit)
+		}
+		if s.OnRestart != nil {
+			s.OnRestart(exit, false)
+		}
+
+		s.sleepBackoff()
+		p = nil
+	}
+}
+
+// recordExit records the exit status, and returns true if we have hit the crash-loop limit
+func (s *Supervisor) recordExit(exit *ExitStatus, ranFor time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastExit = exit
+	if ranFor >= s.StableAfter {
+		s.crashes = 0
+	}
+	s.crashes++
+	if s.crashes >= s.MaxCrashes {
+		return true
+	}
+	s.restarts++
+	return false
+}
+
+// backoff returns how long we wait before restarting: InitialBackoff, doubling with each crash, up to MaxBackoff
+func (s *Supervisor) backoff() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	backoff := s.InitialBackoff
+	for i := 1; i < s.crashes && backoff < s.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.MaxBackoff {
+		backoff = s.MaxBackoff
+	}
+	return backoff
+}
+
+func (s *Supervisor) sleepBackoff() {
+	backoff := s.backoff()
+	glog.Infof("will restart process in %v", backoff)
+	select {
+	case <-time.After(backoff):
+	case <-s.stopCh:
+	}
+}
+
+func (s *Supervisor) isStopping() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stopping
+}
+
+// Stop stops the process, and prevents it from being restarted.
+// The stop function is called to ask the process to shut down (if nil, we send SIGTERM);
+// if the process has not exited after the grace period, it is killed.
+func (s *Supervisor) Stop(stop StopFunc, gracePeriod time.Duration) error {
+	s.mutex.Lock()
+	if !s.stopping {
+		s.stopping = true
+		close(s.stopCh)
+	}
+	p := s.process
+	exited := s.exited
+	s.mutex.Unlock()
+
+	if p == nil {
+		return nil
+	}
+
+	return stopProcess(p, exited, stop, gracePeriod)
+}
+
+// Restart stops the process (in the same way as Stop), and then starts it again immediately.
+// Unlike a crash, this does not count towards the crash-loop limit.
+func (s *Supervisor) Restart(stop StopFunc, gracePeriod time.Duration) error {
+	s.mutex.Lock()
+	if s.stopping {
+		s.mutex.Unlock()
+		return fmt.Errorf("cannot restart process; supervisor is stopping")
+	}
+	p := s.process
+	exited := s.exited
+	if p == nil {
+		s.mutex.Unlock()
+		return fmt.Errorf("cannot restart process; process is not running")
+	}
+	s.restartRequested = true
+	s.mutex.Unlock()
+
+	glog.Info("restarting process")
+	return stopProcess(p, exited, stop, gracePeriod)
+}
+
+// stopProcess asks the process to stop, and kills it if it has not stopped after the grace period.
+// The grace period starts immediately: the stop function may block (e.g. waiting for a clean shutdown),
+// so it runs in the background, and its context is cancelled when the grace period expires.
+func stopProcess(p *Process, exited chan struct{}, stop StopFunc, gracePeriod time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	go func() {
+		var err error
+		if stop != nil {
+			err = stop(ctx, p)
+		} else {
+			err = p.Signal(syscall.SIGTERM)
+		}
+		if err != nil {
+			glog.Warning("error stopping process; will wait for grace period before killing: ", err)
+		}
+	}()
+
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+		glog.Warningf("process did not exit within %v; killing", gracePeriod)
+		err := p.Kill()
+		if err != nil {
+			return fmt.Errorf("error killing process: %v", err)
+		}
+		<-exited
+		return nil
+	}
+}
@@ -0,0 +1,60 @@
+package process
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	grid := []struct {
+		Crashes  int
+		Initial  time.Duration
+		Max      time.Duration
+		Expected time.Duration
+	}{
+		{0, time.Second, time.Minute, time.Second},
+		{1, time.Second, time.Minute, time.Second},
+		{2, time.Second, time.Minute, 2 * time.Second},
+		{3, time.Second, time.Minute, 4 * time.Second},
+		{6, time.Second, time.Minute, 32 * time.Second},
+		{7, time.Second, time.Minute, time.Minute},
+		{100, time.Second, time.Minute, time.Minute},
+		{3, 3 * time.Second, 10 * time.Second, 10 * time.Second},
+		{1, 2 * time.Minute, time.Minute, time.Minute},
+	}
+	for _, g := range grid {
+		s := NewSupervisor(nil)
+		s.InitialBackoff = g.Initial
+		s.MaxBackoff = g.Max
+		s.crashes = g.Crashes
+		actual := s.backoff()
+		if actual != g.Expected {
+			t.Errorf("backoff after %d crashes (initial=%v, max=%v) was %v, expected %v", g.Crashes, g.Initial, g.Max, actual, g.Expected)
+		}
+	}
+}
+
+func TestRecordExit(t *testing.T) {
+	s := NewSupervisor(nil)
+	s.MaxCrashes = 3
+	s.StableAfter = time.Minute
+
+	grid := []struct {
+		RanFor  time.Duration
+		Crashes int
+		GiveUp  bool
+	}{
+		{time.Second, 1, false},
+		{time.Second, 2, false},
+		// A process that ran for a while resets the count
+		{time.Hour, 1, false},
+		{time.Second, 2, false},
+		{time.Second, 3, true},
+	}
+	for i, g := range grid {
+		giveUp := s.recordExit(&ExitStatus{}, g.RanFor)
+		if s.crashes != g.Crashes || giveUp != g.GiveUp {
+			t.Errorf("exit %d: crashes=%d giveUp=%v, expected crashes=%d giveUp=%v", i, s.crashes, giveUp, g.Crashes, g.GiveUp)
+		}
+	}
+}
@@ -2,11 +2,14 @@ package registry
 
 import (
 	"bytes"
+	"context"
 	crypto_rand "crypto/rand"
+	"embed"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"time"
@@ -24,17 +27,26 @@ import (
 	"github.com/kopeio/kope/utils"
 )
 
+//go:embed templates/*.template
+var templates embed.FS
+
+var _ = kope.RegisterTemplates(templates)
+
 // cost parameter for bcrypting hashing when generating htpasswd
 const BcryptCost = 11
 
+const healthCheckTimeout = 5 * time.Second
+
 type Manager struct {
 	base.KopeBaseManager
 
 	secretName string
 	serverName string
 	dataDir    string
-	process    *process.Process
 	config     ConfigData
+
+	// appliedAuth is the docker auth we last wrote to the htpasswd file
+	appliedAuth string
 }
 
 type ConfigData struct {
@@ -67,6 +79,11 @@ func (m *Manager) findDockerAuth() (*DockerServerConfig, error) {
 		return nil, nil
 	}
 
+	return parseDockerAuth(secret)
+}
+
+// parseDockerAuth returns the credentials in the .dockercfg in the secret, or nil if there are none
+func parseDockerAuth(secret *api.Secret) (*DockerServerConfig, error) {
 	if secret.Data == nil {
 		return nil, nil
 	}
@@ -79,7 +96,7 @@ func (m *Manager) findDockerAuth() (*DockerServerConfig, error) {
 
 	dockerConfig := &DockerConfig{}
 	dockerConfig.Servers = map[string]*DockerServerConfig{}
-	err = json.Unmarshal(dockercfg, &dockerConfig.Servers)
+	err := json.Unmarshal(dockercfg, &dockerConfig.Servers)
 	if err != nil {
 		return nil, chained.Error(err, "error reading .dockercfg")
 	}
@@ -112,21 +129,38 @@ func (m *Manager) writeDockerAuth(serverName string, config *DockerServerConfig)
 		return err
 	}
 
-	secret := &api.Secret{}
-	secret.Namespace = me.Pod.Namespace
-	secret.Name = m.secretName
-	secret.Type = "kubernetes.io/dockercfg"
-	secret.Data = map[string][]byte{}
-	secret.Data[".dockercfg"] = j
-
-	_, err = m.KubernetesClient.CreateSecret(secret)
+	// We create the secret if it doesn't exist; if it does, we replace the config (and complete any rotation)
+	_, err = kope.PatchSecret(m.KubernetesClient, me.Pod.Namespace, m.secretName, func(secret *api.Secret) error {
+		if secret.Type == "" {
+			secret.Type = "kubernetes.io/dockercfg"
+		}
+		secret.Data[".dockercfg"] = j
+		kope.ClearRotation(secret)
+		return nil
+	})
 	if err != nil {
-		return chained.Error(err, "error creating secret")
+		return chained.Error(err, "error writing secret")
 	}
 
 	return nil
 }
 
+// generateDockerAuth generates new credentials
+func generateDockerAuth() (*DockerServerConfig, error) {
+	password, err := utils.GeneratePassword(128)
+	if err != nil {
+		return nil, err
+	}
+
+	username := "docker"
+	email := "not@val.id"
+
+	dockerServerConfig := &DockerServerConfig{}
+	dockerServerConfig.Email = email
+	dockerServerConfig.Auth = base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return dockerServerConfig, nil
+}
+
 func (m *Manager) writeHtpasswd(path string) error {
 	dockerServerConfig, err := m.findDockerAuth()
 	if err != nil {
@@ -136,18 +170,11 @@ func (m *Manager) writeHtpasswd(path string) error {
 	if dockerServerConfig == nil {
 		glog.Info("Generating new credentials")
 
-		password, err := utils.GeneratePassword(128)
+		dockerServerConfig, err = generateDockerAuth()
 		if err != nil {
 			return err
 		}
 
-		username := "docker"
-		email := "not@val.id"
-
-		dockerServerConfig = &DockerServerConfig{}
-		dockerServerConfig.Email = email
-		dockerServerConfig.Auth = base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
-
 		err = m.writeDockerAuth(m.serverName, dockerServerConfig)
 		if err != nil {
 			return err
@@ -156,6 +183,46 @@ func (m *Manager) writeHtpasswd(path string) error {
 		glog.Info("Using existing credentials")
 	}
 
+	err = writeHtpasswdFile(path, dockerServerConfig)
+	if err != nil {
+		return err
+	}
+	m.appliedAuth = dockerServerConfig.Auth
+	return nil
+}
+
+// rotateCredentials generates new credentials and writes them to the secret; every member then picks them up in credentialsChanged
+func (m *Manager) rotateCredentials(ctx context.Context, secret *api.Secret) error {
+	dockerServerConfig, err := generateDockerAuth()
+	if err != nil {
+		return err
+	}
+
+	return m.writeDockerAuth(m.serverName, dockerServerConfig)
+}
+
+// credentialsChanged writes the htpasswd file and restarts the registry, if the credentials in the secret have changed
+func (m *Manager) credentialsChanged(secret *api.Secret) error {
+	dockerServerConfig, err := parseDockerAuth(secret)
+	if err != nil {
+		return err
+	}
+	if dockerServerConfig == nil || dockerServerConfig.Auth == m.appliedAuth {
+		return nil
+	}
+
+	glog.Info("Credentials changed; updating htpasswd")
+	err = writeHtpasswdFile(m.config.HtpasswdPath, dockerServerConfig)
+	if err != nil {
+		return err
+	}
+	m.appliedAuth = dockerServerConfig.Auth
+
+	// The registry only reads the htpasswd file when it starts
+	return m.RestartProcess()
+}
+
+func writeHtpasswdFile(path string, dockerServerConfig *DockerServerConfig) error {
 	authBytes, err := base64.StdEncoding.DecodeString(dockerServerConfig.Auth)
 	if err != nil {
 		return fmt.Errorf("unable to decode docker auth")
@@ -188,13 +255,7 @@ func (m *Manager) writeHtpasswd(path string) error {
 }
 
 func (m *Manager) Configure() error {
-	// TODO: Merge Init and Config?
-	err := m.Init()
-	if err != nil {
-		return err
-	}
-
-	err = m.KopeBaseManager.Configure()
+	err := m.KopeBaseManager.Configure()
 	if err != nil {
 		return err
 	}
@@ -241,22 +302,21 @@ func (m *Manager) Configure() error {
 }
 
 func (m *Manager) Manage() error {
+	return m.Run(m)
+}
+
+// PostStart watches the secret, so that the credentials can be rotated
+func (m *Manager) PostStart(ctx context.Context) error {
+	return m.WatchSecretRotation(m.secretName, m.rotateCredentials, m.credentialsChanged)
+}
+
+// Reconfigure recomputes the configuration, and restarts the registry to pick it up
+func (m *Manager) Reconfigure() error {
 	err := m.Configure()
 	if err != nil {
 		return chained.Error(err, "error configuring")
 	}
-
-	process, err := m.Start()
-	if err != nil {
-		return chained.Error(err, "error starting")
-	}
-	m.process = process
-
-	for {
-		time.Sleep(5 * time.Second)
-	}
-
-	return nil
+	return m.RestartProcess()
 }
 
 func (m *Manager) Start() (*process.Process, error) {
@@ -300,3 +360,19 @@ func (m *Manager) Start() (*process.Process, error) {
 	}
 	return process, nil
 }
+
+// HealthCheck checks that the registry is responding to the /v2/ API endpoint
+func (m *Manager) HealthCheck() error {
+	client := &http.Client{Timeout: healthCheckTimeout}
+	response, err := client.Get("http://127.0.0.1:5000/v2/")
+	if err != nil {
+		return chained.Error(err, "error querying registry")
+	}
+	response.Body.Close()
+
+	// We require authentication, so we expect a 401
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("unexpected status from registry: %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package kope
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// RotateAnnotation is set on a secret to request that the credentials in it be regenerated.
+// The value is ignored; the annotation is removed once the new credentials are in place.
+const RotateAnnotation = "kope.io/rotate"
+
+// How many times we retry a patch when the secret is changed underneath us
+const maxPatchAttempts = 5
+
+// SecretMutator changes a secret in place; see PatchSecret
+type SecretMutator func(secret *api.Secret) error
+
+// PatchSecret applies mutate to the current version of the secret, and writes it back.
+// If the secret does not exist, mutate is applied to an empty secret, which is created.
+// If the secret is changed by someone else while we are doing this, we start again with the new version.
+func PatchSecret(client Client, namespace string, name string, mutate SecretMutator) (*api.Secret, error) {
+	for attempt := 1; ; attempt++ {
+		secret, err := client.FindSecret(namespace, name)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching secret %s/%s: %v", namespace, name, err)
+		}
+
+		create := secret == nil
+		if create {
+			secret = &api.Secret{}
+			secret.Namespace = namespace
+			secret.Name = name
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+
+		err = mutate(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		var updated *api.Secret
+		if create {
+			updated, err = client.CreateSecret(secret)
+		} else {
+			updated, err = client.UpdateSecret(secret)
+		}
+		if err == nil {
+			return updated, nil
+		}
+
+		if (isConflict(err) || isAlreadyExists(err)) && attempt < maxPatchAttempts {
+			glog.Infof("Secret %s/%s changed while we were updating it; will retry", namespace, name)
+			continue
+		}
+		return nil, fmt.Errorf("error writing secret %s/%s: %v", namespace, name, err)
+	}
+}
+
+// NeedsRotation returns true if the secret has been annotated with RotateAnnotation
+func NeedsRotation(secret *api.Secret) bool {
+	if secret == nil || secret.Annotations == nil {
+		return false
+	}
+	_, found := secret.Annotations[RotateAnnotation]
+	return found
+}
+
+// ClearRotation removes RotateAnnotation; call it (from a SecretMutator) when writing the new credentials
+func ClearRotation(secret *api.Secret) {
+	if secret.Annotations != nil {
+		delete(secret.Annotations, RotateAnnotation)
+	}
+}
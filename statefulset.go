@@ -0,0 +1,246 @@
+package kope
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// DefaultClusterDomain is the DNS domain of the cluster, unless CLUSTER_DOMAIN is set
+const DefaultClusterDomain = "cluster.local"
+
+// Kubelet sets up the pod's DNS name from these annotations (they are set from the governing service by the StatefulSet controller)
+const subdomainAnnotation = "pod.beta.kubernetes.io/subdomain"
+
+// A StatefulSet names its pods <set>-<ordinal>
+var statefulPodName = regexp.MustCompile(`^(.+)-([0-9]+)$`)
+
+// StatefulSetIdentity is the stable identity a StatefulSet gives each pod: the pod (and its hostname) is named <set>-<ordinal>,
+// and the governing headless service gives it the DNS name <set>-<ordinal>.<service>.<namespace>.svc.<domain>.
+// This lets us find our nodeid and our peers without labelling volumes.
+type StatefulSetIdentity struct {
+	SetName string
+	Ordinal int
+
+	// ServiceName is the headless service governing the set
+	ServiceName string
+	Namespace   string
+	// ClusterDomain can be set with CLUSTER_DOMAIN; the default is cluster.local
+	ClusterDomain string
+	// Replicas is the expected size of the set (from CLUSTER_SIZE), or 0 if it is not known
+	Replicas int
+}
+
+// FindStatefulSetIdentity returns our identity if we are running in a StatefulSet, or nil if we are not.
+// We need both an ordinal name, and the name of the headless service (from HEADLESS_SERVICE, the pod subdomain, or our FQDN in /etc/hosts),
+// so that ordinary pods whose generated names happen to end in digits are not mistaken for StatefulSet members.
+func FindStatefulSetIdentity(pod *api.Pod) (*StatefulSetIdentity, error) {
+	name := ""
+	namespace := ""
+	if pod != nil {
+		name = pod.Name
+		namespace = pod.Namespace
+	} else {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("error getting hostname: %v", err)
+		}
+		name = hostname
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+
+	match := statefulPodName.FindStringSubmatch(name)
+	if match == nil {
+		return nil, nil
+	}
+	ordinal, err := strconv.Atoi(match[2])
+	if err != nil {
+		return nil, nil
+	}
+
+	s := &StatefulSetIdentity{}
+	s.SetName = match[1]
+	s.Ordinal = ordinal
+	s.Namespace = namespace
+
+	s.ClusterDomain = os.Getenv("CLUSTER_DOMAIN")
+	if s.ClusterDomain == "" {
+		s.ClusterDomain = DefaultClusterDomain
+	}
+
+	clusterSize := os.Getenv("CLUSTER_SIZE")
+	if clusterSize != "" {
+		s.Replicas, err = strconv.Atoi(clusterSize)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing CLUSTER_SIZE: %q", clusterSize)
+		}
+	}
+
+	s.ServiceName = os.Getenv("HEADLESS_SERVICE")
+	if s.ServiceName == "" && pod != nil {
+		s.ServiceName = pod.Annotations[subdomainAnnotation]
+	}
+	if s.ServiceName == "" {
+		fqdn, err := findFQDN(name)
+		if err != nil {
+			return nil, err
+		}
+		// <pod>.<service>.<namespace>.svc.<domain>
+		tokens := strings.Split(fqdn, ".")
+		if len(tokens) >= 4 && tokens[3] == "svc" {
+			s.ServiceName = tokens[1]
+			if s.Namespace == "" {
+				s.Namespace = tokens[2]
+			}
+		}
+	}
+	if s.ServiceName == "" {
+		glog.V(2).Infof("Pod name %q looks like a StatefulSet member, but no headless service found", name)
+		return nil, nil
+	}
+
+	if s.Namespace == "" {
+		s.Namespace, err = readServiceAccountNamespace()
+		if err != nil {
+			return nil, err
+		}
+		if s.Namespace == "" {
+			return nil, fmt.Errorf("cannot determine namespace; set POD_NAMESPACE")
+		}
+	}
+
+	return s, nil
+}
+
+// findFQDN looks for our fully-qualified name in /etc/hosts; kubelet writes it there for pods with a subdomain
+func findFQDN(hostname string) (string, error) {
+	b, err := ioutil.ReadFile(EtcHostsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("error reading %s: %v", EtcHostsPath, err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		for _, token := range strings.Fields(line) {
+			if strings.HasPrefix(token, hostname+".") {
+				return token, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (s *StatefulSetIdentity) String() string {
+	return fmt.Sprintf("%s/%s (service %s)", s.Namespace, s.PodName(s.Ordinal), s.ServiceName)
+}
+
+// NodeID returns the nodeid for our ordinal
+func (s *StatefulSetIdentity) NodeID() string {
+	return OrdinalNodeID(s.Ordinal)
+}
+
+// OrdinalNodeID maps a StatefulSet ordinal to a nodeid: ordinals start at 0, but our nodeids start at 1
+// (as zookeeper requires of its server ids)
+func OrdinalNodeID(ordinal int) string {
+	return strconv.Itoa(ordinal + 1)
+}
+
+// PodName returns the name of the pod with the ordinal
+func (s *StatefulSetIdentity) PodName(ordinal int) string {
+	return s.SetName + "-" + strconv.Itoa(ordinal)
+}
+
+// ServiceDomain returns the DNS name of the headless service
+func (s *StatefulSetIdentity) ServiceDomain() string {
+	return s.ServiceName + "." + s.Namespace + ".svc." + s.ClusterDomain
+}
+
+// Hostname returns the stable DNS name of the pod with the ordinal
+func (s *StatefulSetIdentity) Hostname(ordinal int) string {
+	return s.PodName(ordinal) + "." + s.ServiceDomain()
+}
+
+// DiscoverOrdinals returns the ordinals of the members of the set: those up to Replicas (if known),
+// those published in the DNS of the headless service, and our own.
+func (s *StatefulSetIdentity) DiscoverOrdinals() []int {
+	ordinals := map[int]bool{}
+	ordinals[s.Ordinal] = true
+	for i := 0; i < s.Replicas; i++ {
+		ordinals[i] = true
+	}
+
+	// A headless service publishes an SRV record for each (ready) pod
+	_, srvs, err := net.LookupSRV("", "", s.ServiceDomain())
+	if err != nil {
+		glog.V(2).Infof("error looking up SRV records for %s: %v", s.ServiceDomain(), err)
+	}
+	prefix := s.SetName + "-"
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		podName := strings.SplitN(host, ".", 2)[0]
+		if !strings.HasPrefix(podName, prefix) {
+			continue
+		}
+		ordinal, err := strconv.Atoi(strings.TrimPrefix(podName, prefix))
+		if err != nil {
+			continue
+		}
+		ordinals[ordinal] = true
+	}
+
+	var sorted []int
+	for ordinal := range ordinals {
+		sorted = append(sorted, ordinal)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// GetClusterMap builds the cluster map for the set.  If client is non-nil, we also look up the pod for each member;
+// otherwise (or if the pod is not found) we only have the address the DNS gives us.
+func (s *StatefulSetIdentity) GetClusterMap(client Client) (*ClusterMap, error) {
+	clusterMap := &ClusterMap{}
+	clusterMap.ClusterID = s.SetName
+	clusterMap.SelfNodeID = s.NodeID()
+	clusterMap.Members = map[string]*ClusterMember{}
+
+	for _, ordinal := range s.DiscoverOrdinals() {
+		member := &ClusterMember{}
+		member.NodeID = OrdinalNodeID(ordinal)
+		member.Hostname = s.Hostname(ordinal)
+
+		if client != nil {
+			pod, err := client.FindPod(s.Namespace, s.PodName(ordinal))
+			if err != nil {
+				return nil, fmt.Errorf("error reading pod %s/%s: %v", s.Namespace, s.PodName(ordinal), err)
+			}
+			if pod != nil {
+				kopePod := &KopePod{}
+				kopePod.Pod = pod
+				kopePod.KubernetesClient = client
+				member.Pod = kopePod
+			}
+		}
+
+		// Pods that are not ready are (by default) not published in the DNS, so this is expected to fail sometimes
+		addresses, err := net.LookupHost(member.Hostname)
+		if err != nil {
+			glog.V(2).Infof("error resolving %s: %v", member.Hostname, err)
+		} else if len(addresses) != 0 {
+			member.Address = addresses[0]
+		}
+
+		clusterMap.Members[member.NodeID] = member
+	}
+
+	return clusterMap, nil
+}
@@ -4,14 +4,95 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/golang/glog"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
+// DefaultTemplatePath is where we look for template overrides and settings, unless KOPE_TEMPLATE_PATH is set.
+// It is typically a mounted volume.
+const DefaultTemplatePath = "/templates"
+
+// defaultTemplates are the templates built into the binary (see RegisterTemplates)
+var defaultTemplates struct {
+	mutex   sync.Mutex
+	sources []fs.FS
+}
+
+// RegisterTemplates registers the default templates built into the binary; they are used when no override
+// is found on the template path.  The template for a file named <name> is templates/<name>.template in fsys.
+// A service package embeds its templates directory and registers it with a package-level declaration:
+//
+//	//go:embed templates/*.template
+//	var templates embed.FS
+//
+//	var _ = kope.RegisterTemplates(templates)
+//
+// It always returns true; the result only lets it be called from a var declaration.
+func RegisterTemplates(fsys fs.FS) bool {
+	defaultTemplates.mutex.Lock()
+	defer defaultTemplates.mutex.Unlock()
+
+	defaultTemplates.sources = append(defaultTemplates.sources, fsys)
+	return true
+}
+
+// templateSearchPath returns the directories we search for overrides, from KOPE_TEMPLATE_PATH (a colon-separated list)
+func templateSearchPath() []string {
+	s := os.Getenv("KOPE_TEMPLATE_PATH")
+	if s == "" {
+		return []string{DefaultTemplatePath}
+	}
+	var dirs []string
+	for _, dir := range strings.Split(s, ":") {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// readTemplate finds the template: the first <dir>/<key>.template on the search path, or else the default built into the binary
+func readTemplate(key string) (string, []byte, error) {
+	for _, dir := range templateSearchPath() {
+		p := filepath.Join(dir, key+".template")
+		b, err := ioutil.ReadFile(p)
+		if err == nil {
+			glog.V(2).Infof("Using template override %s", p)
+			return p, b, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", nil, fmt.Errorf("error reading template file (%s): %v", p, err)
+		}
+	}
+
+	defaultTemplates.mutex.Lock()
+	sources := defaultTemplates.sources
+	defaultTemplates.mutex.Unlock()
+
+	p := "templates/" + key + ".template"
+	for _, fsys := range sources {
+		b, err := fs.ReadFile(fsys, p)
+		if err == nil {
+			return "builtin:" + p, b, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", nil, fmt.Errorf("error reading built-in template (%s): %v", p, err)
+		}
+	}
+
+	return "", nil, fmt.Errorf("template not found for %s (searched %s and the built-in templates)", key, strings.Join(templateSearchPath(), ":"))
+}
+
+// WriteTemplate renders the template for the file, and (atomically) replaces the file.
+// The template for a file named <name> is <dir>/<name>.template from the first directory on the template path
+// that has one, or else the default built into the binary; any settings in <name>.settings are then merged in.
 func WriteTemplate(path string, data interface{}) error {
 	tempPath, err := WriteTemplateTempFile(path, data)
 	if err != nil {
@@ -31,11 +112,10 @@ func WriteTemplateTempFile(path string, data interface{}) (string, error) {
 	t := template.New("template:" + path)
 
 	templateKey := filepath.Base(path)
-	templatePath := "/templates/" + templateKey + ".template"
 
-	templateDefinition, err := ioutil.ReadFile(templatePath)
+	templatePath, templateDefinition, err := readTemplate(templateKey)
 	if err != nil {
-		return "", fmt.Errorf("error reading template file (%s): %v", templatePath, err)
+		return "", err
 	}
 
 	template, err := t.Parse(string(templateDefinition))
@@ -50,13 +130,19 @@ func WriteTemplateTempFile(path string, data interface{}) (string, error) {
 		return "", fmt.Errorf("error executing template file (%s): %v", templatePath, err)
 	}
 
+	settings, err := readTemplateSettings(templateKey)
+	if err != nil {
+		return "", err
+	}
+	contents := mergeSettings(buffer.Bytes(), settingsFormatFor(templateKey), settings)
+
 	if glog.V(4) {
-		glog.Info("Writing file %s\n%s", path, string(buffer.Bytes()))
+		glog.Infof("Writing file %s\n%s", path, string(contents))
 	}
 
 	tempPath := path + "." + strconv.FormatInt(time.Now().UnixNano(), 10)
 
-	err = ioutil.WriteFile(tempPath, buffer.Bytes(), 0777)
+	err = ioutil.WriteFile(tempPath, contents, 0777)
 	if err != nil {
 		_ = os.Remove(tempPath)
 		return "", fmt.Errorf("error writing templated file (%s): %v", path, err)
@@ -0,0 +1,162 @@
+package kope
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Extra settings for a templated file <name> can be supplied in <dir>/<name>.settings on the template path,
+// as lines of key=value (blank lines and lines starting with # are ignored).
+// Each setting replaces the line setting the same key in the rendered file, or is appended if there is no such line.
+// This lets settings be tuned without replacing the whole template.
+
+// templateSetting is one key/value setting
+type templateSetting struct {
+	Key   string
+	Value string
+}
+
+// settingsFormat describes how keys and values are written in a file
+type settingsFormat struct {
+	// Separator is written between key and value
+	Separator string
+	// YAML files only have their top-level keys replaced (along with any nested block)
+	YAML bool
+}
+
+// settingsFormatFor guesses the format from the file name
+func settingsFormatFor(name string) *settingsFormat {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		return &settingsFormat{Separator: ": ", YAML: true}
+	case ".conf":
+		return &settingsFormat{Separator: " = "}
+	default:
+		return &settingsFormat{Separator: "="}
+	}
+}
+
+// readTemplateSettings reads the settings for the file from every directory on the template path;
+// where a key is set more than once, the directory earliest on the path wins
+func readTemplateSettings(key string) ([]templateSetting, error) {
+	dirs := templateSearchPath()
+
+	var settings []templateSetting
+	for i := len(dirs) - 1; i >= 0; i-- {
+		p := filepath.Join(dirs[i], key+".settings")
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error reading settings file (%s): %v", p, err)
+		}
+		glog.V(2).Infof("Applying settings from %s", p)
+
+		for n, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			tokens := strings.SplitN(line, "=", 2)
+			if len(tokens) != 2 || strings.TrimSpace(tokens[0]) == "" {
+				return nil, fmt.Errorf("invalid setting at %s:%d (expected key=value): %q", p, n+1, line)
+			}
+			setting := templateSetting{}
+			setting.Key = strings.TrimSpace(tokens[0])
+			setting.Value = strings.TrimSpace(tokens[1])
+			settings = append(settings, setting)
+		}
+	}
+	return settings, nil
+}
+
+// settingKey returns the key set by a line of the file, or "" if the line does not set a key
+func (f *settingsFormat) settingKey(line string) string {
+	if f.YAML {
+		// Only top-level keys
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' || line[0] == '-' {
+			return ""
+		}
+		i := strings.Index(line, ":")
+		if i == -1 {
+			return ""
+		}
+		return strings.TrimSpace(line[:i])
+	}
+
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ""
+	}
+	i := strings.Index(line, "=")
+	if i == -1 {
+		return ""
+	}
+	return strings.TrimSpace(line[:i])
+}
+
+// isContinuation returns true if the line is part of the (nested) value of the previous key
+func (f *settingsFormat) isContinuation(line string) bool {
+	if !f.YAML {
+		return false
+	}
+	return line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '-'
+}
+
+// mergeSettings applies the settings to the rendered file; later settings win
+func mergeSettings(contents []byte, format *settingsFormat, settings []templateSetting) []byte {
+	if len(settings) == 0 {
+		return contents
+	}
+
+	values := map[string]string{}
+	var keys []string
+	for _, setting := range settings {
+		if _, found := values[setting.Key]; !found {
+			keys = append(keys, setting.Key)
+		}
+		values[setting.Key] = setting.Value
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	replaced := map[string]bool{}
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		key := format.settingKey(line)
+		value, found := values[key]
+		if key == "" || !found {
+			out = append(out, line)
+			continue
+		}
+
+		if !replaced[key] {
+			out = append(out, key+format.Separator+value)
+			replaced[key] = true
+		}
+		// Drop any nested block belonging to the old value (but keep blank lines that separate sections)
+		for i+1 < len(lines) && format.isContinuation(lines[i+1]) && lines[i+1] != "" {
+			i++
+		}
+	}
+
+	for _, key := range keys {
+		if !replaced[key] {
+			out = append(out, key+format.Separator+values[key])
+		}
+	}
+
+	var buffer bytes.Buffer
+	for _, line := range out {
+		buffer.WriteString(line)
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes()
+}
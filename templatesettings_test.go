@@ -0,0 +1,84 @@
+package kope
+
+import (
+	"testing"
+)
+
+func TestMergeSettings(t *testing.T) {
+	grid := []struct {
+		Name     string
+		File     string
+		Contents string
+		Settings []templateSetting
+		Expected string
+	}{
+		{
+			Name:     "no settings",
+			File:     "zoo.cfg",
+			Contents: "a=1\nb=2",
+			Expected: "a=1\nb=2",
+		},
+		{
+			Name:     "replace",
+			File:     "server.properties",
+			Contents: "# comment\na=1\nb = 2\n",
+			Settings: []templateSetting{{"b", "3"}},
+			Expected: "# comment\na=1\nb=3\n",
+		},
+		{
+			Name:     "append",
+			File:     "server.properties",
+			Contents: "a=1\n",
+			Settings: []templateSetting{{"c", "3"}, {"d", "4"}},
+			Expected: "a=1\nc=3\nd=4\n",
+		},
+		{
+			Name:     "commented out keys are not replaced",
+			File:     "server.properties",
+			Contents: "#a=1\n",
+			Settings: []templateSetting{{"a", "2"}},
+			Expected: "#a=1\na=2\n",
+		},
+		{
+			Name:     "later settings win",
+			File:     "server.properties",
+			Contents: "a=1\n",
+			Settings: []templateSetting{{"a", "2"}, {"b", "1"}, {"a", "3"}},
+			Expected: "a=3\nb=1\n",
+		},
+		{
+			Name:     "duplicate lines collapse",
+			File:     "server.properties",
+			Contents: "a=1\nb=2\na=1\n",
+			Settings: []templateSetting{{"a", "2"}},
+			Expected: "a=2\nb=2\n",
+		},
+		{
+			Name:     "conf separator",
+			File:     "postgresql.conf",
+			Contents: "shared_buffers = 128MB\nport = 5432\n",
+			Settings: []templateSetting{{"shared_buffers", "1GB"}, {"work_mem", "4MB"}},
+			Expected: "shared_buffers = 1GB\nport = 5432\nwork_mem = 4MB\n",
+		},
+		{
+			Name:     "yaml replaces nested block",
+			File:     "cassandra.yaml",
+			Contents: "cluster_name: test\nseed_provider:\n  - class_name: x\n    parameters:\n      - seeds: a\n\nnum_tokens: 256\n",
+			Settings: []templateSetting{{"seed_provider", "[]"}, {"num_tokens", "16"}},
+			Expected: "cluster_name: test\nseed_provider: []\n\nnum_tokens: 16\n",
+		},
+		{
+			Name:     "yaml only replaces top-level keys",
+			File:     "config.yml",
+			Contents: "http:\n  addr: :5000\n",
+			Settings: []templateSetting{{"addr", ":6000"}},
+			Expected: "http:\n  addr: :5000\naddr: :6000\n",
+		},
+	}
+	for _, g := range grid {
+		actual := string(mergeSettings([]byte(g.Contents), settingsFormatFor(g.File), g.Settings))
+		if actual != g.Expected {
+			t.Errorf("%s: result was %q, expected %q", g.Name, actual, g.Expected)
+		}
+	}
+}
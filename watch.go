@@ -0,0 +1,431 @@
+package kope
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/controller/framework"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+const (
+	// Resync period for the kube controller loop.
+	resyncPeriod = 60 * time.Second
+)
+
+// WatchOptions restricts what a watch returns, and allows it to be stopped.  A nil WatchOptions watches everything, forever.
+type WatchOptions struct {
+	// Namespaces to watch; if empty we watch all namespaces
+	Namespaces []string
+	// LabelSelector filters by label; if nil we don't filter
+	LabelSelector labels.Selector
+	// FieldSelector filters by field; if nil we don't filter
+	FieldSelector fields.Selector
+	// StopCh stops the watch when it is closed; if nil the watch runs forever
+	StopCh <-chan struct{}
+	// ResyncPeriod is how often every object is re-delivered (as an update); if 0 we use the default (60 seconds)
+	ResyncPeriod time.Duration
+}
+
+func (o *WatchOptions) String() string {
+	if o == nil {
+		return "all"
+	}
+	return fmt.Sprintf("namespaces=%v labels=%q fields=%q", o.Namespaces, o.labelSelector(), o.fieldSelector())
+}
+
+func (o *WatchOptions) namespaces() []string {
+	if o == nil || len(o.Namespaces) == 0 {
+		return []string{api.NamespaceAll}
+	}
+	return o.Namespaces
+}
+
+func (o *WatchOptions) labelSelector() labels.Selector {
+	if o == nil || o.LabelSelector == nil {
+		return labels.Everything()
+	}
+	return o.LabelSelector
+}
+
+func (o *WatchOptions) fieldSelector() fields.Selector {
+	if o == nil || o.FieldSelector == nil {
+		return fields.Everything()
+	}
+	return o.FieldSelector
+}
+
+func (o *WatchOptions) stopCh() <-chan struct{} {
+	if o == nil || o.StopCh == nil {
+		return util.NeverStop
+	}
+	return o.StopCh
+}
+
+func (o *WatchOptions) resyncPeriod() time.Duration {
+	if o == nil || o.ResyncPeriod == 0 {
+		return resyncPeriod
+	}
+	return o.ResyncPeriod
+}
+
+// Matches returns true if an object with the given metadata is included by the options
+func (o *WatchOptions) Matches(meta *api.ObjectMeta) bool {
+	if o == nil {
+		return true
+	}
+	if len(o.Namespaces) != 0 {
+		found := false
+		for _, namespace := range o.Namespaces {
+			if namespace == meta.Namespace {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !o.labelSelector().Matches(labels.Set(meta.Labels)) {
+		return false
+	}
+	return o.matchesFields(meta)
+}
+
+// matchesFields applies the field selector to the fields that every object supports
+func (o *WatchOptions) matchesFields(meta *api.ObjectMeta) bool {
+	objectFields := fields.Set{}
+	objectFields["metadata.name"] = meta.Name
+	objectFields["metadata.namespace"] = meta.Namespace
+	return o.fieldSelector().Matches(objectFields)
+}
+
+// ResourceType describes how to list and watch one kind of resource
+type ResourceType struct {
+	// Name is used for logging
+	Name string
+	// Object is an empty object of the type we expect
+	Object runtime.Object
+
+	List  func(k *Kubernetes, namespace string, options *WatchOptions) (runtime.Object, error)
+	Watch func(k *Kubernetes, namespace string, options *WatchOptions, resourceVersion string) (watch.Interface, error)
+}
+
+// WatchHandler receives the changes to the watched objects.  Any of the functions can be nil.
+type WatchHandler struct {
+	OnAdd    func(obj interface{})
+	OnUpdate func(oldObj, newObj interface{})
+	OnDelete func(obj interface{})
+}
+
+// Watcher is a running watch
+type Watcher interface {
+	// HasSynced returns true once the initial list of objects has been delivered
+	HasSynced() bool
+	// WaitForSync waits until HasSynced, returning false if the watch is stopped or the timeout expires first.
+	// A timeout of 0 means we wait indefinitely.
+	WaitForSync(timeout time.Duration) bool
+	// List returns the objects we currently know about
+	List() []interface{}
+	// Wait blocks until the watch is stopped
+	Wait()
+}
+
+// ResourceWatch is a running watch against the API server, started by Kubernetes.WatchResource
+type ResourceWatch struct {
+	resource    *ResourceType
+	stopCh      <-chan struct{}
+	stores      []cache.Store
+	controllers []*framework.Controller
+}
+
+// WatchResource starts watching a kind of resource (in each of the namespaces in options),
+// calling the handler for each change, until the options StopCh is closed.
+func (k *Kubernetes) WatchResource(resource *ResourceType, handler *WatchHandler, options *WatchOptions) Watcher {
+	glog.Infof("Starting watch on k8s %s (%s)", resource.Name, options)
+
+	w := &ResourceWatch{}
+	w.resource = resource
+	w.stopCh = options.stopCh()
+
+	expectedType := reflect.TypeOf(resource.Object)
+	checkType := func(o interface{}) bool {
+		if reflect.TypeOf(o) != expectedType {
+			glog.Warningf("Got unexpected object of type %T, expecting %v", o, expectedType)
+			return false
+		}
+		return true
+	}
+
+	funcs := framework.ResourceEventHandlerFuncs{
+		AddFunc: func(o interface{}) {
+			if handler.OnAdd != nil && checkType(o) {
+				handler.OnAdd(o)
+			}
+		},
+		DeleteFunc: func(o interface{}) {
+			// If we missed the delete, we are given the last state we knew
+			if unknown, ok := o.(cache.DeletedFinalStateUnknown); ok {
+				o = unknown.Obj
+			}
+			if handler.OnDelete != nil && checkType(o) {
+				handler.OnDelete(o)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if handler.OnUpdate != nil && checkType(oldObj) && checkType(newObj) {
+				handler.OnUpdate(oldObj, newObj)
+			}
+		},
+	}
+
+	for _, namespace := range options.namespaces() {
+		namespace := namespace
+		lw := &cache.ListWatch{}
+		lw.ListFunc = func() (runtime.Object, error) {
+			return resource.List(k, namespace, options)
+		}
+		lw.WatchFunc = func(resourceVersion string) (watch.Interface, error) {
+			return resource.Watch(k, namespace, options, resourceVersion)
+		}
+
+		store, controller := framework.NewInformer(lw, resource.Object, options.resyncPeriod(), funcs)
+		w.stores = append(w.stores, store)
+		w.controllers = append(w.controllers, controller)
+		go controller.Run(w.stopCh)
+	}
+
+	return w
+}
+
+var _ Watcher = &ResourceWatch{}
+
+// HasSynced returns true once the initial list of objects has been delivered (in every namespace)
+func (w *ResourceWatch) HasSynced() bool {
+	for _, controller := range w.controllers {
+		if !controller.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitForSync waits until HasSynced, returning false if the watch is stopped or the timeout expires first.
+// A timeout of 0 means we wait indefinitely.
+func (w *ResourceWatch) WaitForSync(timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	if timeout != 0 {
+		deadline = time.After(timeout)
+	}
+	for !w.HasSynced() {
+		select {
+		case <-w.stopCh:
+			return false
+		case <-deadline:
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// List returns the objects we currently know about
+func (w *ResourceWatch) List() []interface{} {
+	var objects []interface{}
+	for _, store := range w.stores {
+		objects = append(objects, store.List()...)
+	}
+	return objects
+}
+
+// Wait blocks until the watch is stopped
+func (w *ResourceWatch) Wait() {
+	<-w.stopCh
+	glog.Infof("Stopped watch on k8s %s", w.resource.Name)
+}
+
+var EndpointsResource = &ResourceType{
+	Name:   "endpoints",
+	Object: &api.Endpoints{},
+	List: func(k *Kubernetes, namespace string, options *WatchOptions) (runtime.Object, error) {
+		list, err := k.kubeClient.Endpoints(namespace).List(options.labelSelector())
+		if err != nil {
+			return nil, err
+		}
+		// The API only supports filtering this list by label, so we apply the field selector ourselves
+		items := list.Items[:0]
+		for i := range list.Items {
+			if options.matchesFields(&list.Items[i].ObjectMeta) {
+				items = append(items, list.Items[i])
+			}
+		}
+		list.Items = items
+		return list, nil
+	},
+	Watch: func(k *Kubernetes, namespace string, options *WatchOptions, resourceVersion string) (watch.Interface, error) {
+		return k.kubeClient.Endpoints(namespace).Watch(options.labelSelector(), options.fieldSelector(), resourceVersion)
+	},
+}
+
+var ServicesResource = &ResourceType{
+	Name:   "services",
+	Object: &api.Service{},
+	List: func(k *Kubernetes, namespace string, options *WatchOptions) (runtime.Object, error) {
+		list, err := k.kubeClient.Services(namespace).List(options.labelSelector())
+		if err != nil {
+			return nil, err
+		}
+		// The API only supports filtering this list by label, so we apply the field selector ourselves
+		items := list.Items[:0]
+		for i := range list.Items {
+			if options.matchesFields(&list.Items[i].ObjectMeta) {
+				items = append(items, list.Items[i])
+			}
+		}
+		list.Items = items
+		return list, nil
+	},
+	Watch: func(k *Kubernetes, namespace string, options *WatchOptions, resourceVersion string) (watch.Interface, error) {
+		return k.kubeClient.Services(namespace).Watch(options.labelSelector(), options.fieldSelector(), resourceVersion)
+	},
+}
+
+var SecretsResource = &ResourceType{
+	Name:   "secrets",
+	Object: &api.Secret{},
+	List: func(k *Kubernetes, namespace string, options *WatchOptions) (runtime.Object, error) {
+		return k.kubeClient.Secrets(namespace).List(options.labelSelector(), options.fieldSelector())
+	},
+	Watch: func(k *Kubernetes, namespace string, options *WatchOptions, resourceVersion string) (watch.Interface, error) {
+		return k.kubeClient.Secrets(namespace).Watch(options.labelSelector(), options.fieldSelector(), resourceVersion)
+	},
+}
+
+var PodsResource = &ResourceType{
+	Name:   "pods",
+	Object: &api.Pod{},
+	List: func(k *Kubernetes, namespace string, options *WatchOptions) (runtime.Object, error) {
+		return k.kubeClient.Pods(namespace).List(options.labelSelector(), options.fieldSelector())
+	},
+	Watch: func(k *Kubernetes, namespace string, options *WatchOptions, resourceVersion string) (watch.Interface, error) {
+		return k.kubeClient.Pods(namespace).Watch(options.labelSelector(), options.fieldSelector(), resourceVersion)
+	},
+}
+
+var PersistentVolumeClaimsResource = &ResourceType{
+	Name:   "persistentvolumeclaims",
+	Object: &api.PersistentVolumeClaim{},
+	List: func(k *Kubernetes, namespace string, options *WatchOptions) (runtime.Object, error) {
+		return k.kubeClient.PersistentVolumeClaims(namespace).List(options.labelSelector(), options.fieldSelector())
+	},
+	Watch: func(k *Kubernetes, namespace string, options *WatchOptions, resourceVersion string) (watch.Interface, error) {
+		return k.kubeClient.PersistentVolumeClaims(namespace).Watch(options.labelSelector(), options.fieldSelector(), resourceVersion)
+	},
+}
+
+type EndpointWatch interface {
+	AddEndpoints(e *api.Endpoints)
+	DeleteEndpoints(e *api.Endpoints)
+	UpdateEndpoints(oldEndpoints, newEndpoints *api.Endpoints)
+}
+
+func WatchEndpoints(client Client, watcher EndpointWatch, options *WatchOptions) Watcher {
+	handler := &WatchHandler{}
+	handler.OnAdd = func(o interface{}) {
+		watcher.AddEndpoints(o.(*api.Endpoints))
+	}
+	handler.OnUpdate = func(oldObj, newObj interface{}) {
+		watcher.UpdateEndpoints(oldObj.(*api.Endpoints), newObj.(*api.Endpoints))
+	}
+	handler.OnDelete = func(o interface{}) {
+		watcher.DeleteEndpoints(o.(*api.Endpoints))
+	}
+	return client.WatchResource(EndpointsResource, handler, options)
+}
+
+type ServiceWatch interface {
+	AddService(s *api.Service)
+	DeleteService(s *api.Service)
+	UpdateService(oldService, newService *api.Service)
+}
+
+func WatchServices(client Client, watcher ServiceWatch, options *WatchOptions) Watcher {
+	handler := &WatchHandler{}
+	handler.OnAdd = func(o interface{}) {
+		watcher.AddService(o.(*api.Service))
+	}
+	handler.OnUpdate = func(oldObj, newObj interface{}) {
+		watcher.UpdateService(oldObj.(*api.Service), newObj.(*api.Service))
+	}
+	handler.OnDelete = func(o interface{}) {
+		watcher.DeleteService(o.(*api.Service))
+	}
+	return client.WatchResource(ServicesResource, handler, options)
+}
+
+type SecretWatch interface {
+	AddSecret(s *api.Secret)
+	DeleteSecret(s *api.Secret)
+	UpdateSecret(oldSecret, newSecret *api.Secret)
+}
+
+func WatchSecrets(client Client, watcher SecretWatch, options *WatchOptions) Watcher {
+	handler := &WatchHandler{}
+	handler.OnAdd = func(o interface{}) {
+		watcher.AddSecret(o.(*api.Secret))
+	}
+	handler.OnUpdate = func(oldObj, newObj interface{}) {
+		watcher.UpdateSecret(oldObj.(*api.Secret), newObj.(*api.Secret))
+	}
+	handler.OnDelete = func(o interface{}) {
+		watcher.DeleteSecret(o.(*api.Secret))
+	}
+	return client.WatchResource(SecretsResource, handler, options)
+}
+
+type PodWatch interface {
+	AddPod(p *api.Pod)
+	DeletePod(p *api.Pod)
+	UpdatePod(oldPod, newPod *api.Pod)
+}
+
+func WatchPods(client Client, watcher PodWatch, options *WatchOptions) Watcher {
+	handler := &WatchHandler{}
+	handler.OnAdd = func(o interface{}) {
+		watcher.AddPod(o.(*api.Pod))
+	}
+	handler.OnUpdate = func(oldObj, newObj interface{}) {
+		watcher.UpdatePod(oldObj.(*api.Pod), newObj.(*api.Pod))
+	}
+	handler.OnDelete = func(o interface{}) {
+		watcher.DeletePod(o.(*api.Pod))
+	}
+	return client.WatchResource(PodsResource, handler, options)
+}
+
+type PersistentVolumeClaimWatch interface {
+	AddPersistentVolumeClaim(pvc *api.PersistentVolumeClaim)
+	DeletePersistentVolumeClaim(pvc *api.PersistentVolumeClaim)
+	UpdatePersistentVolumeClaim(oldPVC, newPVC *api.PersistentVolumeClaim)
+}
+
+func WatchPersistentVolumeClaims(client Client, watcher PersistentVolumeClaimWatch, options *WatchOptions) Watcher {
+	handler := &WatchHandler{}
+	handler.OnAdd = func(o interface{}) {
+		watcher.AddPersistentVolumeClaim(o.(*api.PersistentVolumeClaim))
+	}
+	handler.OnUpdate = func(oldObj, newObj interface{}) {
+		watcher.UpdatePersistentVolumeClaim(oldObj.(*api.PersistentVolumeClaim), newObj.(*api.PersistentVolumeClaim))
+	}
+	handler.OnDelete = func(o interface{}) {
+		watcher.DeletePersistentVolumeClaim(o.(*api.PersistentVolumeClaim))
+	}
+	return client.WatchResource(PersistentVolumeClaimsResource, handler, options)
+}
@@ -1,23 +1,58 @@
 package zookeeper
 
 import (
+	"embed"
+	"fmt"
 	"github.com/golang/glog"
 	"github.com/kopeio/kope"
 	"github.com/kopeio/kope/base"
 	"github.com/kopeio/kope/chained"
 	"github.com/kopeio/kope/process"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-const DefaultMemory = 256
+//go:embed templates/*.template
+var templates embed.FS
+
+var _ = kope.RegisterTemplates(templates)
+
+// Zookeeper keeps the whole tree in the heap
+var memoryPolicy = &base.MemoryPolicy{DefaultMB: 256, OverheadMB: 64, HeapRatio: 0.75}
+
+const healthCheckTimeout = 5 * time.Second
+
+// When the cluster changes, each member restarts this long after the member with the previous nodeid
+const rollingRestartInterval = 30 * time.Second
+
+// While waiting for our turn in a rolling restart, we check the other members this often
+const rollingRestartPollInterval = 10 * time.Second
+
+// If the other members are still not ready this long after our turn, we restart anyway; a member that cannot rejoin
+// until we restart would otherwise stop the restart forever
+const rollingRestartMaxWait = 5 * time.Minute
+
+// The members are named in /etc/hosts as cluster-zk-<nodeid>
+const hostPrefix = "cluster-zk-"
 
 type Manager struct {
 	base.KopeBaseManager
-	process *process.Process
-	config  Config
+	memory *base.MemorySizes
+	config Config
+
+	mutex sync.Mutex
+	// restartPending is set while a rolling restart is waiting for our turn
+	restartPending bool
+	// addresses are the member addresses (by nodeid) we last wrote to /etc/hosts
+	addresses map[string]string
+	// movedPeers are the members whose address has changed since the pending restart was scheduled
+	movedPeers map[string]bool
 }
 
 type ZkServer struct {
@@ -37,48 +72,166 @@ func (m *Manager) Configure() error {
 		return err
 	}
 
-	if m.MemoryMB == 0 {
-		m.MemoryMB = DefaultMemory
-	} else {
-		memoryLimitMB := m.MemoryMB
-
-		// We leave 32 MB for overhead (connections etc)
-		memoryLimitMB -= 32
-
-		if memoryLimitMB < 0 {
-			glog.Warning("Memory limit was too low; ignoring")
-			m.MemoryMB = DefaultMemory
-		} else {
-			glog.Info("Setting memory to ", memoryLimitMB)
-			m.MemoryMB = memoryLimitMB
-		}
-	}
+	m.memory = m.SizeMemory(memoryPolicy)
 
 	return nil
 }
 
 func (m *Manager) Manage() error {
-	err := m.Init()
+	prometheus.MustRegister(newMntrCollector())
+	return m.Run(m)
+}
+
+// Reconfigure recomputes the configuration, and restarts the process to pick it up
+func (m *Manager) Reconfigure() error {
+	err := m.Configure()
 	if err != nil {
-		return chained.Error(err, "error initializing")
+		return chained.Error(err, "error configuring")
 	}
+	return m.RestartProcess()
+}
+
+// ClusterChanged rewrites /etc/hosts, and schedules a rolling restart when the cluster membership changes: zookeeper
+// resolves the peer addresses only at startup, so it must be restarted to find peers that have moved.
+// The restart happens in the background; further changes before then are picked up by the same restart.
+func (m *Manager) ClusterChanged(clusterMap *kope.ClusterMap) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	err = m.Configure()
+	// We write /etc/hosts now, so that anything resolving the names (including a member restarting) sees the new addresses
+	moved, err := m.updateEtcHosts(clusterMap)
 	if err != nil {
-		return chained.Error(err, "error configuring")
+		glog.Warning("error updating /etc/hosts after cluster change: ", err)
+	}
+	if m.movedPeers == nil {
+		m.movedPeers = map[string]bool{}
+	}
+	for _, nodeID := range moved {
+		m.movedPeers[nodeID] = true
 	}
 
-	process, err := m.Start()
+	if m.restartPending {
+		glog.Info("Rolling restart already scheduled")
+		return nil
+	}
+
+	// Without our nodeid we can't take our turn, and restarting out of turn could lose the quorum
+	id, err := clusterMap.Ordinal()
 	if err != nil {
-		return chained.Error(err, "error starting")
+		glog.Warning("Unable to determine our nodeid; not restarting zookeeper: ", err)
+		m.RecordWarning(kope.EventReasonReconfigureFailed, "Not restarting after cluster membership change: %v", err)
+		return nil
 	}
-	m.process = process
 
+	m.restartPending = true
+	go m.rollingRestart(id)
+	return nil
+}
+
+// rollingRestart restarts zookeeper once it is our turn.  We stagger the restarts by nodeid, and then wait until
+// the members with lower nodeids are ready again, and the other members can keep a quorum while we restart.
+// We don't wait for members that have moved: zookeeper 3.4 only resolves peers at startup, and the member with the
+// higher nodeid makes the connection, so a moved member may not become ready until we have restarted.
+func (m *Manager) rollingRestart(id int) {
+	delay := time.Duration(id) * rollingRestartInterval
+	glog.Infof("Will restart zookeeper in %v to pick up cluster changes", delay)
+	time.Sleep(delay)
+
+	deadline := time.Now().Add(rollingRestartMaxWait)
 	for {
-		time.Sleep(5 * time.Second)
+		m.mutex.Lock()
+		moved := map[string]bool{}
+		for nodeID := range m.movedPeers {
+			moved[nodeID] = true
+		}
+		m.mutex.Unlock()
+
+		clusterMap, err := m.LookupClusterMap()
+		if err != nil {
+			glog.Warning("error building cluster map: ", err)
+		} else {
+			waitingFor := readyToRestart(clusterMap, id, moved)
+			if waitingFor == "" {
+				break
+			}
+			if time.Now().After(deadline) {
+				glog.Warningf("Restarting zookeeper although still %s, after waiting %v", waitingFor, rollingRestartMaxWait)
+				break
+			}
+			glog.Infof("Delaying zookeeper restart: %s", waitingFor)
+		}
+		time.Sleep(rollingRestartPollInterval)
 	}
 
-	return nil
+	// Changes from here on need another restart
+	m.mutex.Lock()
+	m.restartPending = false
+	m.movedPeers = nil
+	m.mutex.Unlock()
+
+	glog.Info("Restarting zookeeper to pick up cluster changes")
+	err := m.Reconfigure()
+	if err != nil {
+		glog.Warning("error restarting zookeeper after cluster change: ", err)
+		m.RecordWarning(kope.EventReasonReconfigureFailed, "Error restarting after cluster membership change: %v", err)
+	}
+}
+
+// readyToRestart returns "" if we can restart now, otherwise what we are waiting for.
+// Members in moved are not waited for (see rollingRestart), and count towards the quorum.
+func readyToRestart(clusterMap *kope.ClusterMap, id int, moved map[string]bool) string {
+	readyPeers := clusterMap.ReadyPeers()
+	ready := map[string]bool{}
+	for _, peer := range readyPeers {
+		ready[peer.NodeID] = true
+	}
+
+	available := 0
+	for _, peer := range clusterMap.Peers() {
+		if ready[peer.NodeID] || moved[peer.NodeID] {
+			available++
+		}
+		ordinal, err := peer.Ordinal()
+		if err != nil {
+			continue
+		}
+		if ordinal < id && !ready[peer.NodeID] && !moved[peer.NodeID] {
+			return fmt.Sprintf("waiting for member %s to be ready", peer.NodeID)
+		}
+	}
+
+	// While we restart, the others must form a quorum (a cluster of 2 can't lose any member, so we don't wait)
+	quorum := clusterMap.Len()/2 + 1
+	if clusterMap.Len() > 2 && available < quorum {
+		return fmt.Sprintf("waiting for quorum (%d of %d other members ready)", available, quorum)
+	}
+	return ""
+}
+
+// updateEtcHosts writes the member addresses to /etc/hosts, returning the nodeids whose address has changed since
+// we last wrote it.  The mutex must be held.
+func (m *Manager) updateEtcHosts(clusterMap *kope.ClusterMap) ([]string, error) {
+	hosts := map[string]string{}
+	addresses := map[string]string{}
+	var moved []string
+	for _, member := range clusterMap.All() {
+		if _, err := member.Ordinal(); err != nil {
+			continue
+		}
+		ip := member.IP()
+		hosts[hostPrefix+member.NodeID] = ip
+		addresses[member.NodeID] = ip
+		if m.addresses != nil && m.addresses[member.NodeID] != ip {
+			moved = append(moved, member.NodeID)
+		}
+	}
+
+	err := kope.SetEtcHosts(hostPrefix, hosts)
+	if err != nil {
+		return nil, err
+	}
+	m.addresses = addresses
+	return moved, nil
 }
 
 func (m *Manager) Start() (*process.Process, error) {
@@ -94,37 +247,41 @@ func (m *Manager) Start() (*process.Process, error) {
 		return nil, err
 	}
 
-	if len(clusterMap) != 0 {
+	if clusterMap.Len() != 0 {
 		glog.Info("Detected cluster configuration")
-		hosts := map[string]string{}
-		hostPrefix := "cluster-zk-"
 
 		m.config.Servers = []ZkServer{}
-		for k, pod := range clusterMap {
+		for _, member := range clusterMap.All() {
 			zkServer := ZkServer{}
-			id, err := strconv.Atoi(k)
+			id, err := member.Ordinal()
 			if err != nil {
-				glog.Warning("Ignoring cluster entries with invalid nodeid: ", k)
+				glog.Warning("Ignoring cluster entries with invalid nodeid: ", member.NodeID)
 				continue
 			}
 			zkServer.Id = id
-			host := hostPrefix + k
+			host := hostPrefix + member.NodeID
 			zkServer.Host = host
 			zkServer.ProxyPort = 2888
 			zkServer.LeaderPort = 3888
 			m.config.Servers = append(m.config.Servers, zkServer)
-
-			podIP := ""
-			if pod != nil {
-				podIP = pod.Pod.Status.PodIP
-			}
-			hosts[host] = podIP
 		}
 
-		err = kope.SetEtcHosts(hostPrefix, hosts)
+		m.mutex.Lock()
+		_, err = m.updateEtcHosts(clusterMap)
+		m.mutex.Unlock()
 		if err != nil {
 			return nil, err
 		}
+
+		// Each server finds its own id in myid
+		id, err := clusterMap.Ordinal()
+		if err != nil {
+			return nil, chained.Error(err, "error determining zookeeper server id")
+		}
+		err = ioutil.WriteFile("/data/zk/data/myid", []byte(strconv.Itoa(id)+"\n"), 0644)
+		if err != nil {
+			return nil, chained.Error(err, "error writing myid")
+		}
 	}
 
 	err = kope.WriteTemplate("/data/conf/zoo.cfg", &m.config)
@@ -138,9 +295,8 @@ func (m *Manager) Start() (*process.Process, error) {
 
 	//export ZOOCFGDIR=/data/conf
 
-	// TODO: Actually set memory
-
 	argv := []string{"/usr/bin/java"}
+	argv = append(argv, base.JavaHeapArgs(m.memory.HeapMB)...)
 
 	//java -Dzookeeper.log.dir=. -Dzookeeper.root.logger=INFO,CONSOLE -cp /opt/zk/bin/../build/classes:/opt/zk/bin/../build/lib/*.jar:/opt/zk/bin/../lib/slf4j-log4j12-1.6.1.jar:/opt/zk/bin/../lib/slf4j-api-1.6.1.jar:/opt/zk/bin/../lib/netty-3.7.0.Final.jar:/opt/zk/bin/../lib/log4j-1.2.16.jar:/opt/zk/bin/../lib/jline-0.9.94.jar:/opt/zk/bin/../zookeeper-3.4.6.jar:/opt/zk/bin/../src/java/lib/*.jar:/data/conf: -Dcom.sun.management.jmxremote -Dcom.sun.management.jmxremote.local.only=false org.apache.zookeeper.server.quorum.QuorumPeerMain /data/conf/zoo.cfg
 	classpath := []string{"/opt/zk/bin/../build/classes", "/opt/zk/bin/../build/lib/*.jar", "/opt/zk/bin/../lib/slf4j-log4j12-1.6.1.jar", "/opt/zk/bin/../lib/slf4j-api-1.6.1.jar", "/opt/zk/bin/../lib/netty-3.7.0.Final.jar", "/opt/zk/bin/../lib/log4j-1.2.16.jar", "/opt/zk/bin/../lib/jline-0.9.94.jar", "/opt/zk/bin/../zookeeper-3.4.6.jar", "/opt/zk/bin/../src/java/lib/*.jar", "/data/conf"}
@@ -155,11 +311,74 @@ func (m *Manager) Start() (*process.Process, error) {
 
 	config := &process.ProcessConfig{}
 	config.Argv = argv
+	config.Name = "zookeeper"
 
 	process, err := config.Start()
 	if err != nil {
 		return nil, err
 	}
 	return process, nil
-	//echo "ruok" | nc 127.0.0.1 2181
+}
+
+// HealthCheck checks that zookeeper is running (ruok), and is serving requests (mntr)
+func (m *Manager) HealthCheck() error {
+	response, err := sendFourLetterWord("ruok")
+	if err != nil {
+		return err
+	}
+	if response != "imok" {
+		return fmt.Errorf("unexpected response to ruok: %q", response)
+	}
+
+	// ruok only tells us the server is running; in a cluster it may not have joined the quorum
+	response, err = sendFourLetterWord("mntr")
+	if err != nil {
+		return err
+	}
+	stats := parseMntr(response)
+	state := stats["zk_server_state"]
+	switch state {
+	case "standalone", "leader", "follower", "observer":
+		return nil
+	default:
+		return fmt.Errorf("zookeeper is not serving requests (state=%q)", state)
+	}
+}
+
+// sendFourLetterWord sends one of the zookeeper "four letter word" admin commands, and returns the response
+func sendFourLetterWord(command string) (string, error) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:2181", healthCheckTimeout)
+	if err != nil {
+		return "", chained.Error(err, "error connecting to zookeeper")
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+	if err != nil {
+		return "", chained.Error(err, "error setting deadline")
+	}
+
+	_, err = conn.Write([]byte(command))
+	if err != nil {
+		return "", chained.Error(err, "error sending command to zookeeper: ", command)
+	}
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", chained.Error(err, "error reading response from zookeeper: ", command)
+	}
+	return strings.TrimSpace(string(response)), nil
+}
+
+// parseMntr parses the output of mntr, which is a tab-separated list of keys & values
+func parseMntr(response string) map[string]string {
+	stats := map[string]string{}
+	for _, line := range strings.Split(response, "\n") {
+		tokens := strings.SplitN(line, "\t", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		stats[tokens[0]] = strings.TrimSpace(tokens[1])
+	}
+	return stats
 }
@@ -0,0 +1,72 @@
+package zookeeper
+
+import (
+	"strconv"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+
+	"github.com/kopeio/kope"
+)
+
+// buildClusterMap builds a cluster of the given size, as seen from member self; ready lists the members that are ready
+func buildClusterMap(size int, self int, ready ...int) *kope.ClusterMap {
+	clusterMap := &kope.ClusterMap{}
+	clusterMap.SelfNodeID = strconv.Itoa(self)
+	clusterMap.Members = map[string]*kope.ClusterMember{}
+	for i := 1; i <= size; i++ {
+		pod := &api.Pod{}
+		pod.Status.Phase = api.PodRunning
+		status := api.ConditionStatus("False")
+		for _, r := range ready {
+			if r == i {
+				status = api.ConditionTrue
+			}
+		}
+		pod.Status.Conditions = []api.PodCondition{{Type: api.PodReady, Status: status}}
+
+		member := &kope.ClusterMember{}
+		member.NodeID = strconv.Itoa(i)
+		member.Pod = &kope.KopePod{Pod: pod}
+		clusterMap.Members[member.NodeID] = member
+	}
+	return clusterMap
+}
+
+func TestReadyToRestart(t *testing.T) {
+	grid := []struct {
+		Name     string
+		Size     int
+		Self     int
+		Ready    []int
+		Moved    []int
+		Expected bool
+	}{
+		{"single member", 1, 1, nil, nil, true},
+		{"two members, first", 2, 1, nil, nil, true},
+		{"two members, waiting for first", 2, 2, nil, nil, false},
+		{"two members, first ready", 2, 2, []int{1}, nil, true},
+		{"three members, no quorum", 3, 1, []int{3}, nil, false},
+		{"three members, quorum", 3, 1, []int{2, 3}, nil, true},
+		{"three members, waiting for lower", 3, 3, []int{2}, nil, false},
+		{"three members, lower ready", 3, 3, []int{1, 2}, nil, true},
+		// The moved member can't rejoin until we restart, so we must not wait for it
+		{"three members, lower member moved and is not ready", 3, 3, []int{2}, []int{1}, true},
+		{"three members, higher member moved and is not ready", 3, 2, []int{1}, []int{3}, true},
+		{"three members, other lower member not ready", 3, 3, nil, []int{1}, false},
+		{"five members, no quorum", 5, 5, []int{1, 2}, nil, false},
+		{"five members, quorum", 5, 5, []int{1, 2, 3, 4}, nil, true},
+		{"five members, quorum with moved member", 5, 5, []int{1, 2, 4}, []int{3}, true},
+	}
+	for _, g := range grid {
+		clusterMap := buildClusterMap(g.Size, g.Self, g.Ready...)
+		moved := map[string]bool{}
+		for _, nodeID := range g.Moved {
+			moved[strconv.Itoa(nodeID)] = true
+		}
+		reason := readyToRestart(clusterMap, g.Self, moved)
+		if (reason == "") != g.Expected {
+			t.Errorf("%s: readyToRestart was %q, expected ready=%v", g.Name, reason, g.Expected)
+		}
+	}
+}
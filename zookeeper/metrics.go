@@ -0,0 +1,79 @@
+package zookeeper
+
+import (
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The mntr values we expose, and whether they are counters or gauges
+var mntrTypes = map[string]prometheus.ValueType{
+	"zk_avg_latency":                prometheus.GaugeValue,
+	"zk_max_latency":                prometheus.GaugeValue,
+	"zk_min_latency":                prometheus.GaugeValue,
+	"zk_packets_received":           prometheus.CounterValue,
+	"zk_packets_sent":               prometheus.CounterValue,
+	"zk_num_alive_connections":      prometheus.GaugeValue,
+	"zk_outstanding_requests":       prometheus.GaugeValue,
+	"zk_znode_count":                prometheus.GaugeValue,
+	"zk_watch_count":                prometheus.GaugeValue,
+	"zk_ephemerals_count":           prometheus.GaugeValue,
+	"zk_approximate_data_size":      prometheus.GaugeValue,
+	"zk_open_file_descriptor_count": prometheus.GaugeValue,
+	"zk_followers":                  prometheus.GaugeValue,
+	"zk_synced_followers":           prometheus.GaugeValue,
+	"zk_pending_syncs":              prometheus.GaugeValue,
+}
+
+// mntrCollector exposes the output of the zookeeper mntr command
+type mntrCollector struct {
+	descs       map[string]*prometheus.Desc
+	serverState *prometheus.Desc
+}
+
+var _ prometheus.Collector = &mntrCollector{}
+
+func newMntrCollector() *mntrCollector {
+	c := &mntrCollector{}
+	c.descs = make(map[string]*prometheus.Desc)
+	for key := range mntrTypes {
+		c.descs[key] = prometheus.NewDesc("kope_zookeeper_"+key[len("zk_"):], "zookeeper mntr value "+key+".", nil, nil)
+	}
+	c.serverState = prometheus.NewDesc("kope_zookeeper_server_state", "The state of the zookeeper server (always 1).", []string{"state"}, nil)
+	return c
+}
+
+func (c *mntrCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+	ch <- c.serverState
+}
+
+func (c *mntrCollector) Collect(ch chan<- prometheus.Metric) {
+	response, err := sendFourLetterWord("mntr")
+	if err != nil {
+		glog.V(2).Info("error querying zookeeper mntr: ", err)
+		return
+	}
+	stats := parseMntr(response)
+
+	for key, valueType := range mntrTypes {
+		s, found := stats[key]
+		if !found {
+			continue
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			glog.V(2).Infof("ignoring non-numeric mntr value %s=%q", key, s)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.descs[key], valueType, v)
+	}
+
+	state := stats["zk_server_state"]
+	if state != "" {
+		ch <- prometheus.MustNewConstMetric(c.serverState, prometheus.GaugeValue, 1, state)
+	}
+}